@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var allowedBackends backendAllowlist
+
+var rejectedBackends = expvar.NewInt("backend_rejected")
+
+func init() {
+	flag.Var(&allowedBackends, "allowed-backends", "comma-separated host names, IPs or CIDRs teeproxy may connect to as backends, checked at startup and on every connection; empty allows any")
+}
+
+// backendAllowlist is a flag value of the backends teeproxy may dial, so that
+// it cannot be turned into a way to reach arbitrary internal addresses. Host
+// names are allowed as such, whatever they resolve to; other hosts must
+// resolve to allowed IPs only.
+type backendAllowlist struct {
+	raw   string
+	names map[string]bool
+	nets  cidrList
+}
+
+func (l *backendAllowlist) String() string {
+	return l.raw
+}
+
+func (l *backendAllowlist) Set(value string) error {
+	parsed := backendAllowlist{raw: value, names: make(map[string]bool)}
+	var nets []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if strings.Contains(v, "/") || net.ParseIP(v) != nil {
+			nets = append(nets, v)
+		} else {
+			parsed.names[strings.ToLower(v)] = true
+		}
+	}
+	if err := parsed.nets.Set(strings.Join(nets, ",")); err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Empty reports whether any backend is allowed.
+func (l backendAllowlist) Empty() bool {
+	return len(l.names) == 0 && len(l.nets) == 0
+}
+
+// Resolve returns the address to dial for the backend at addr, a host and
+// port: addr itself for an allowed host name, or else the first of its IPs,
+// all of which must be allowed. Dialing the checked IP, rather than resolving
+// the name again, keeps the check from being bypassed by a changing DNS answer.
+func (l backendAllowlist) Resolve(ctx context.Context, addr string) (string, error) {
+	if l.Empty() {
+		return addr, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if l.names[strings.ToLower(host)] {
+		return addr, nil
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if !l.nets.Contains(ip) {
+			return "", fmt.Errorf("backend %s (%s) is not in -allowed-backends", host, ip)
+		}
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// guardDial makes dial reject the backends not in allowed.
+func guardDial(dial func(ctx context.Context, network, addr string) (net.Conn, error), allowed backendAllowlist) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if allowed.Empty() {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		resolved, err := allowed.Resolve(ctx, addr)
+		if err != nil {
+			rejectedBackends.Add(1)
+			log.Println("ERROR: Rejected backend:", err)
+			return nil, err
+		}
+		return dial(ctx, network, resolved)
+	}
+}
+
+// checkBackends fails if one of the backend targets is not allowed.
+func checkBackends(allowed backendAllowlist, targets ...string) error {
+	for _, target := range targets {
+		// Targets are a host, optionally followed by a path.
+		u, err := url.Parse("http://" + target)
+		if err != nil {
+			return err
+		}
+		// The port is irrelevant to the check.
+		if _, err := allowed.Resolve(context.Background(), net.JoinHostPort(u.Hostname(), "80")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
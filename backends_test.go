@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDisallowedBackendIsRejected(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	setFlag(t, "allowed-backends", "10.0.0.0/8,backend.internal")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	rejected := rejectedBackends.Value()
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, recorder.Code)
+	}
+	waitLog(t, logs, "is not in -allowed-backends", 2)
+	expectNoHit(t, prodHits)
+	expectNoHit(t, altHits)
+	if n := rejectedBackends.Value() - rejected; n != 2 {
+		t.Errorf("Expected '%d' rejected backends, but received '%d'", 2, n)
+	}
+
+	var allowed backendAllowlist
+	allowed.Set("10.0.0.0/8")
+	if err := checkBackends(allowed, hostOf(production)); err == nil {
+		t.Errorf("Expected %s to be rejected at startup", hostOf(production))
+	}
+}
+
+func TestBackendAllowlist(t *testing.T) {
+	var allowed backendAllowlist
+	if err := allowed.Set("127.0.0.1, Backend.Internal, 10.0.0.0/8"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		addr, expected string
+	}{
+		{"127.0.0.1:80", "127.0.0.1:80"},
+		{"10.1.2.3:8080", "10.1.2.3:8080"},
+		{"backend.internal:80", "backend.internal:80"},
+		{"127.0.0.2:80", ""},
+		{"[::1]:80", ""},
+	} {
+		resolved, err := allowed.Resolve(context.Background(), test.addr)
+		if resolved != test.expected || (err == nil) != (test.expected != "") {
+			t.Errorf("Expected '%s' for %s, but received '%s' (%v)", test.expected, test.addr, resolved, err)
+		}
+	}
+	if err := checkBackends(allowed, "10.0.0.1:8080/prefix", "backend.internal"); err != nil {
+		t.Errorf("Expected the targets to be allowed, but received '%s'", err)
+	}
+}
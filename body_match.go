@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var compareBodyMatch jsonMatch
+
+func init() {
+	flag.Var(&compareBodyMatch, "compare.body-match", "only compare requests whose JSON body has a value at a path, e.g. 'feature.enabled=true'")
+}
+
+// jsonMatch is a flag value of the form 'path=value' matching JSON documents
+// that hold value at the dot-separated path. Numeric path elements index
+// arrays. The value is parsed as JSON, falling back to a plain string.
+type jsonMatch struct {
+	Path  []string
+	Value interface{}
+	raw   string
+}
+
+func (m *jsonMatch) String() string {
+	return m.raw
+}
+
+func (m *jsonMatch) Set(value string) error {
+	if value == "" {
+		*m = jsonMatch{}
+		return nil
+	}
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected 'path=value', got %q", value)
+	}
+	var expected interface{}
+	if err := json.Unmarshal([]byte(value[i+1:]), &expected); err != nil {
+		expected = value[i+1:]
+	}
+	*m = jsonMatch{Path: strings.Split(value[:i], "."), Value: expected, raw: value}
+	return nil
+}
+
+// Matches reports whether body is a JSON document holding the expected value
+// at the path.
+func (m *jsonMatch) Matches(body []byte) bool {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return false
+	}
+	for _, key := range m.Path {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return false
+			}
+			document = value
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return false
+			}
+			document = node[i]
+		default:
+			return false
+		}
+	}
+	return reflect.DeepEqual(document, m.Value)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONMatch(t *testing.T) {
+	var m jsonMatch
+	if err := m.Set("feature.flags.1=true"); err != nil {
+		t.Fatal(err)
+	}
+	for body, expectation := range map[string]bool{
+		`{"feature": {"flags": [false, true]}}`:   true,
+		`{"feature": {"flags": [true, false]}}`:   false,
+		`{"feature": {"flags": [false, "true"]}}`: false,
+		`{"feature": {}}`:                         false,
+		`not json`:                                false,
+	} {
+		if m.Matches([]byte(body)) != expectation {
+			t.Errorf("Expected '%t' for '%s', but received '%t'", expectation, body, !expectation)
+		}
+	}
+
+	if err := m.Set("user.name=alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Matches([]byte(`{"user": {"name": "alice"}}`)) {
+		t.Errorf("Expected a plain string value to match")
+	}
+	if err := m.Set("missing-equals-sign"); err == nil {
+		t.Errorf("Expected an error for a value without '='")
+	}
+}
+
+func TestOnlyMatchingBodiesAreCompared(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "compare.body-match", "feature.enabled=true")
+	logs := captureLog(t)
+
+	disabled, disabledID := newRequest("POST", "/", strings.NewReader(`{"feature": {"enabled": false}}`))
+	serve(h, disabled)
+	waitHit(t, altHits)
+	enabled, enabledID := newRequest("POST", "/", strings.NewReader(`{"feature": {"enabled": true}}`))
+	serve(h, enabled)
+	waitHit(t, altHits)
+
+	waitComparison(t, logs, enabledID, "Equal", 1)
+	time.Sleep(100 * time.Millisecond)
+	if strings.Contains(logs.String(), "(request id "+disabledID+")") {
+		t.Errorf("Expected no comparison of request '%s', but received '%s'", disabledID, logs.String())
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	breakerFailures = flag.Int("b.breaker-failures", 0, "consecutive failures, errors or 5xx responses, after which an alternate site is no longer mirrored to for -b.breaker-cooldown; 0 disables the circuit breaker")
+	breakerCooldown = flag.Int("b.breaker-cooldown", 10000, "milliseconds an alternate site is not mirrored to once its circuit opens, after which a single request probes it again")
+)
+
+var openedCircuits = expvar.NewInt("circuit_opened")
+
+// Circuit states.
+const (
+	circuitClosed int32 = iota
+	circuitOpen
+	circuitHalfOpen
+	circuitProbing
+)
+
+// circuitBreaker stops mirroring to an alternate site that keeps failing, so
+// that its outage costs production nothing. Once the cooldown is over the
+// circuit is half open: a single request probes the site, while the others
+// are still kept out. Its result closes the circuit again, or reopens it if it
+// is a failure.
+type circuitBreaker struct {
+	target    string
+	threshold int64
+	cooldown  time.Duration
+
+	state    int32 // circuitClosed, circuitOpen, circuitHalfOpen or circuitProbing
+	failures int64 // consecutive
+}
+
+func newCircuitBreaker(target string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{target: target, threshold: int64(threshold), cooldown: cooldown}
+}
+
+// newCircuitBreakers returns a circuit breaker by alternate target, or nil if
+// threshold is 0.
+func newCircuitBreakers(targets []string, threshold int, cooldown time.Duration) map[string]*circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	breakers := make(map[string]*circuitBreaker, len(targets))
+	for _, target := range targets {
+		breakers[target] = newCircuitBreaker(target, threshold, cooldown)
+	}
+	return breakers
+}
+
+// Open reports whether requests are not to be mirrored. For a closed circuit
+// it is a single atomic load, cheap enough for every request. A half-open
+// circuit lets the first request through as the probe; should its result not
+// be recorded, e.g. because the request was not mirrored after all, another
+// one is let through after the cooldown. A nil breaker is never open.
+func (b *circuitBreaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	switch atomic.LoadInt32(&b.state) {
+	case circuitClosed:
+		return false
+	case circuitHalfOpen:
+		if atomic.CompareAndSwapInt32(&b.state, circuitHalfOpen, circuitProbing) {
+			time.AfterFunc(b.cooldown, func() {
+				atomic.CompareAndSwapInt32(&b.state, circuitProbing, circuitHalfOpen)
+			})
+			return false
+		}
+	}
+	return true
+}
+
+// Record counts the result of a request to the alternate site. Canceled
+// requests, e.g. with -b.cancel-on-loss, say nothing about the site and are
+// ignored.
+func (b *circuitBreaker) Record(resp *http.Response, err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil && resp != nil && resp.StatusCode < 500 {
+		atomic.StoreInt64(&b.failures, 0)
+		if atomic.CompareAndSwapInt32(&b.state, circuitProbing, circuitClosed) ||
+			atomic.CompareAndSwapInt32(&b.state, circuitHalfOpen, circuitClosed) {
+			log.Printf("Circuit of alternate %s closed", b.target)
+		}
+		return
+	}
+	if atomic.AddInt64(&b.failures, 1) < b.threshold &&
+		atomic.LoadInt32(&b.state) == circuitClosed {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&b.state, circuitClosed, circuitOpen) ||
+		atomic.CompareAndSwapInt32(&b.state, circuitProbing, circuitOpen) ||
+		atomic.CompareAndSwapInt32(&b.state, circuitHalfOpen, circuitOpen) {
+		openedCircuits.Add(1)
+		log.Printf("Circuit of alternate %s opened for %s", b.target, b.cooldown)
+		time.AfterFunc(b.cooldown, func() {
+			atomic.StoreInt32(&b.state, circuitHalfOpen)
+		})
+	}
+}
+
+// liveAlternatives returns the alternate targets whose circuit is closed and
+// that are not down. It allocates only when some target is left out.
+func (h handler) liveAlternatives() []string {
+	if h.Breakers == nil && h.Health == nil {
+		return h.Alternatives
+	}
+	live := func(target string) bool {
+		return !h.Breakers[target].Open() && h.Health.Up(target)
+	}
+	for i, target := range h.Alternatives {
+		if !live(target) {
+			alternatives := append([]string{}, h.Alternatives[:i]...)
+			for _, target := range h.Alternatives[i+1:] {
+				if live(target) {
+					alternatives = append(alternatives, target)
+				}
+			}
+			return alternatives
+		}
+	}
+	return h.Alternatives
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFailingAlternateOpensTheCircuit(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	var failing int32 = 1
+	hits := make(chan *http.Request, 100)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- r
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer alternate.Close()
+	h := newTestHandler(t, production, alternate)
+	h.Breakers = newCircuitBreakers(h.Alternatives, 2, 200*time.Millisecond)
+	logs := captureLog(t)
+
+	for i := 0; i < 2; i++ {
+		serve(h, httptest.NewRequest("GET", "/", nil))
+		waitHit(t, hits)
+	}
+	waitLog(t, logs, "Circuit of alternate "+hostOf(alternate)+" opened", 1)
+
+	// Production is still served, without mirroring.
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if expectation := "production"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	expectNoHit(t, hits)
+
+	// After the cooldown a request probes the alternate site again.
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(200 * time.Millisecond)
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	waitHit(t, hits)
+	waitLog(t, logs, "Circuit of alternate "+hostOf(alternate)+" closed", 1)
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	waitHit(t, hits)
+}
+
+func TestOpenCircuitsAreLeftOut(t *testing.T) {
+	h := handler{Alternatives: []string{"a", "b", "c"}}
+	h.Breakers = newCircuitBreakers(h.Alternatives, 1, time.Minute)
+	captureLog(t)
+
+	h.Breakers["b"].Record(nil, http.ErrHandlerTimeout)
+	live := h.liveAlternatives()
+	if len(live) != 2 || live[0] != "a" || live[1] != "c" {
+		t.Errorf("Expected '%v', but received '%v'", []string{"a", "c"}, live)
+	}
+	if h.Alternatives[1] != "b" {
+		t.Errorf("Expected the alternatives to be left alone, but received '%v'", h.Alternatives)
+	}
+}
+
+func TestHalfOpenCircuitLetsASingleProbeThrough(t *testing.T) {
+	b := newCircuitBreaker("a", 1, 50*time.Millisecond)
+	captureLog(t)
+	b.Record(nil, http.ErrHandlerTimeout)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&b.state) != circuitHalfOpen; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the circuit to be half open after the cooldown")
+		}
+	}
+
+	var probes int32
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			if !b.Open() {
+				atomic.AddInt32(&probes, 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	if n := atomic.LoadInt32(&probes); n != 1 {
+		t.Errorf("Expected '%d' probe, but received '%d'", 1, n)
+	}
+
+	b.Record(&http.Response{StatusCode: 200}, nil)
+	if b.Open() {
+		t.Errorf("Expected the probe to close the circuit")
+	}
+}
+
+// BenchmarkCircuit compares the cost of a mirrored request with the one of a
+// request whose alternate circuit is open, which should be that of a plain
+// proxy.
+func BenchmarkCircuit(b *testing.B) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("production"))
+	}))
+	defer production.Close()
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("production"))
+	}))
+	defer alternate.Close()
+	target := hostOf(production)
+	saved := *targetProduction
+	*targetProduction = target
+	defer func() { *targetProduction = saved }()
+	productionTransport, alternateTransport = newProductionTransport(), newAlternateTransport()
+	defer productionTransport.CloseIdleConnections()
+	defer alternateTransport.CloseIdleConnections()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, open := range []bool{false, true} {
+		name := "closed"
+		if open {
+			name = "open"
+		}
+		b.Run(name, func(b *testing.B) {
+			h := handler{Target: target, Alternatives: []string{hostOf(alternate)}}
+			h.Breakers = newCircuitBreakers(h.Alternatives, 1, time.Hour)
+			if open {
+				h.Breakers[hostOf(alternate)].state = circuitOpen
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				serve(h, httptest.NewRequest("GET", "/", nil))
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	captureSink      = flag.String("response-capture", "", "sink receiving a copy of sampled production responses, as 'file:PATH', disabled when empty")
+	captureSample    = flag.Float64("response-capture.sample", 1.0, "percentage of production responses captured")
+	captureMaxSize   = flag.Int("response-capture.max-size", 1<<20, "bytes of a response body captured, longer bodies are truncated")
+	captureBuffer    = flag.Int("response-capture.buffer", 256, "responses queued for the capture sink before new ones are dropped")
+	captureKeepCreds = flag.Bool("response-capture.keep-credentials", false, "capture the credential headers like Set-Cookie as they are, instead of redacted")
+)
+
+var captureDropped = expvar.NewInt("capture_dropped")
+
+// capturedResponse is a production response as written to the capture sink,
+// one JSON object per line, or an alternate response as posted to the
+// observer. Body is base64 encoded by encoding/json.
+type capturedResponse struct {
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id"`
+	Method    string      `json:"method"`
+	URI       string      `json:"uri"`
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+func newCapturedResponse(x *exchange, resp *http.Response, body []byte) *capturedResponse {
+	return &capturedResponse{
+		Time:      time.Now(),
+		RequestID: x.RequestID,
+		Method:    x.Request.Method,
+		URI:       x.Request.URL.RequestURI(),
+		Status:    resp.StatusCode,
+		Header:    resp.Header,
+		Body:      body,
+	}
+}
+
+// responseCapture writes copies of production responses to a sink in the
+// background. Like the write-ahead log, it queues them in a bounded buffer and
+// drops them when it is full, so that the client is never slowed down.
+type responseCapture struct {
+	sink      io.WriteCloser
+	maxSize   int
+	responses chan *capturedResponse
+	done      chan struct{}
+}
+
+// newResponseCapture opens the sink, given as 'file:PATH'. Files are appended
+// to, and created readable by their owner only.
+func newResponseCapture(sink string, maxSize, buffer int) (*responseCapture, error) {
+	if !strings.HasPrefix(sink, "file:") {
+		return nil, fmt.Errorf("unsupported sink %q, expected 'file:PATH'", sink)
+	}
+	file, err := os.OpenFile(strings.TrimPrefix(sink, "file:"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	c := &responseCapture{
+		sink:      file,
+		maxSize:   maxSize,
+		responses: make(chan *capturedResponse, buffer),
+		done:      make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+// Capture queues the production response of the exchange if it is sampled by
+// -response-capture.sample. Its credential headers are redacted unless
+// -response-capture.keep-credentials is set.
+func (c *responseCapture) Capture(x *exchange) {
+	if x.Production == nil || *captureSample < 100.0 && rand.Float64()*100 >= *captureSample {
+		return
+	}
+	r := newCapturedResponse(x, x.Production, x.ProductionBody)
+	if !*captureKeepCreds {
+		r.Header = redactedHeader(r.Header)
+	}
+	if len(r.Body) > c.maxSize {
+		// Don't hold on to the whole body while queued.
+		r.Body = append([]byte(nil), r.Body[:c.maxSize]...)
+		r.Truncated = true
+	}
+	select {
+	case c.responses <- r:
+	default:
+		captureDropped.Add(1)
+	}
+}
+
+// Close writes the queued responses and closes the sink.
+func (c *responseCapture) Close() error {
+	close(c.responses)
+	<-c.done
+	return c.sink.Close()
+}
+
+func (c *responseCapture) run() {
+	defer close(c.done)
+	encoder := json.NewEncoder(c.sink)
+	for r := range c.responses {
+		if err := encoder.Encode(r); err != nil {
+			log.Println("Failed to write to the response capture:", err)
+		}
+	}
+}
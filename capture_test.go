@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readCaptured returns the responses written to a capture file.
+func readCaptured(t *testing.T, name string) []*capturedResponse {
+	t.Helper()
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var responses []*capturedResponse
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		r := &capturedResponse{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, r)
+	}
+	return responses
+}
+
+func TestSampledResponsesAreCaptured(t *testing.T) {
+	body := strings.Repeat("production ", 100)
+	production, _ := newBackend(t, body)
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	name := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, err := newResponseCapture("file:"+name, 64, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Capture = capture
+
+	setFlag(t, "response-capture.sample", "100")
+	recorder := serve(h, httptest.NewRequest("GET", "/captured?q=1", nil))
+	if recorder.Body.String() != body {
+		t.Errorf("Expected the full body, but received '%s'", recorder.Body.String())
+	}
+	setFlag(t, "response-capture.sample", "0")
+	serve(h, httptest.NewRequest("GET", "/skipped", nil))
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := readCaptured(t, name)
+	if len(responses) != 1 {
+		t.Fatalf("Expected '%d' captured responses, but received '%d'", 1, len(responses))
+	}
+	r := responses[0]
+	if r.URI != "/captured?q=1" || r.Status != 200 || r.RequestID == "" {
+		t.Errorf("Expected the sampled response, but received '%+v'", r)
+	}
+	if string(r.Body) != body[:64] || !r.Truncated {
+		t.Errorf("Expected the body truncated to '%s', but received '%s'", body[:64], r.Body)
+	}
+}
+
+func TestCapturedResponsesArePrivate(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret"})
+		w.Header().Set("X-Version", "1")
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	name := filepath.Join(t.TempDir(), "capture.jsonl")
+	capture, err := newResponseCapture("file:"+name, 64, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Capture = capture
+	setFlag(t, "response-capture.sample", "100")
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(recorder.Header().Get("Set-Cookie"), "secret") {
+		t.Errorf("Expected the cookie sent to the client, but received '%v'", recorder.Header())
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Expected '%v', but received '%v'", os.FileMode(0600), mode)
+	}
+	responses := readCaptured(t, name)
+	if len(responses) != 1 {
+		t.Fatalf("Expected '%d' captured responses, but received '%d'", 1, len(responses))
+	}
+	if header := responses[0].Header; header.Get("Set-Cookie") != redacted || header.Get("X-Version") != "1" {
+		t.Errorf("Expected the cookie redacted, but received '%v'", header)
+	}
+}
+
+func TestResponseCaptureSink(t *testing.T) {
+	if _, err := newResponseCapture("kafka:topic", 64, 10); err == nil {
+		t.Errorf("Expected an error for an unsupported sink")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// certificateReloader serves the certificate of the listener, reloaded from
+// its files on demand, e.g. on SIGHUP after they were rotated, so that new
+// handshakes present the new certificate without a restart.
+type certificateReloader struct {
+	certFile, keyFile string
+	certificate       atomic.Pointer[tls.Certificate]
+}
+
+func newCertificateReloader(certFile, keyFile string) (*certificateReloader, error) {
+	r := &certificateReloader{certFile: certFile, keyFile: keyFile}
+	return r, r.Reload()
+}
+
+// Reload loads the certificate from the files. On failure, the certificate
+// loaded before is kept.
+func (r *certificateReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.certificate.Store(&certificate)
+	return nil
+}
+
+// GetCertificate returns the certificate, for tls.Config.GetCertificate.
+func (r *certificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.certificate.Load(), nil
+}
+
+// ReloadOn reloads the certificate on every signal received, until signals is
+// closed.
+func (r *certificateReloader) ReloadOn(signals <-chan os.Signal) {
+	for range signals {
+		if err := r.Reload(); err != nil {
+			log.Printf("Failed to reload certificate: %s and private key: %s, keeping the old one: %s", r.certFile, r.keyFile, err)
+			continue
+		}
+		log.Printf("Reloaded certificate: %s", r.certFile)
+	}
+}
+
+// reloadOnHangup reloads the certificate on SIGHUP.
+func reloadOnHangup(r *certificateReloader) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	r.ReloadOn(signals)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate with serial to certFile
+// and its key to keyFile.
+func writeCertificate(t *testing.T, serial int64, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestCertificateIsReloadedOnHangup(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, 1, certFile, keyFile)
+	certificates, err := newCertificateReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer close(signals)
+	defer signal.Stop(signals)
+	go certificates.ReloadOn(signals)
+	logs := captureLog(t)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: certificates.GetCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	serial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	waitSerial := func(expected int64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for serial() != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected the certificate with serial %d, but received %d", expected, serial())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if s := serial(); s != 1 {
+		t.Errorf("Expected '%d', but received '%d'", 1, s)
+	}
+
+	writeCertificate(t, 2, certFile, keyFile)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitSerial(2)
+
+	// A broken key keeps the certificate loaded before.
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitLog(t, logs, "keeping the old one", 1)
+	if s := serial(); s != 2 {
+		t.Errorf("Expected '%d', but received '%d'", 2, s)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	collectorAddr   = flag.String("compare.grpc-collector", "", "host:port of a gRPC collector streamed every comparison result, disabled when empty")
+	collectorBuffer = flag.Int("compare.grpc-buffer", 1000, "comparison results queued for the gRPC collector before new ones are dropped")
+)
+
+var collectorDropped = expvar.NewInt("collector_dropped")
+
+// Comparison results are sent over a client-streaming call of the Collector
+// service in collector.proto. The call is made over HTTP/2 without TLS, as
+// gRPC does: every message is prefixed by a compression flag byte and its
+// big-endian uint32 length, and the status arrives in the Grpc-Status trailer.
+const collectorMethod = "/teeproxy.Collector/Collect"
+
+// Delay before reconnecting to the collector, doubled after every failed
+// attempt.
+const (
+	collectorMinBackoff = 100 * time.Millisecond
+	collectorMaxBackoff = 10 * time.Second
+)
+
+var errCollectorEnded = errors.New("collector ended the stream")
+
+// comparisonResult is the outcome of comparing the responses to a request.
+type comparisonResult struct {
+	RequestID        string `json:"request_id"`
+	Method           string `json:"method"`
+	Path             string `json:"path"`
+	Equal            bool   `json:"equal"`
+	ProductionStatus int    `json:"production_status"`
+	AlternateStatus  int    `json:"alternate_status"`
+	Env              string `json:"env,omitempty"`
+	Instance         string `json:"instance,omitempty"`
+	Alternate        string `json:"alternate,omitempty"`
+	Flaky            bool   `json:"flaky,omitempty"`
+}
+
+func newComparisonResult(x *exchange, equal bool) *comparisonResult {
+	r := &comparisonResult{
+		RequestID: x.RequestID,
+		Method:    x.Request.Method,
+		Path:      x.Request.URL.Path,
+		Equal:     equal,
+		Alternate: x.AlternateTarget,
+		Flaky:     !equal && x.ProductionFlaky,
+	}
+	if x.Production != nil {
+		r.ProductionStatus = x.Production.StatusCode
+	}
+	if x.Alternate != nil {
+		r.AlternateStatus = x.Alternate.StatusCode
+	}
+	return r
+}
+
+// marshal encodes the result as a ComparisonResult protobuf message. Fields
+// holding their zero value are omitted, as in proto3.
+func (r *comparisonResult) marshal() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, r.RequestID)
+	b = appendProtoString(b, 2, r.Method)
+	b = appendProtoString(b, 3, r.Path)
+	if r.Equal {
+		b = appendProtoVarint(b, 4, 1)
+	}
+	b = appendProtoVarint(b, 5, uint64(r.ProductionStatus))
+	b = appendProtoVarint(b, 6, uint64(r.AlternateStatus))
+	b = appendProtoString(b, 7, r.Env)
+	b = appendProtoString(b, 8, r.Instance)
+	b = appendProtoString(b, 9, r.Alternate)
+	if r.Flaky {
+		b = appendProtoVarint(b, 10, 1)
+	}
+	return b
+}
+
+// result names the outcome as in the metrics: equal, not_equal, or flaky for a
+// mismatch with a production not deterministic itself.
+func (r *comparisonResult) result() string {
+	switch {
+	case r.Equal:
+		return "equal"
+	case r.Flaky:
+		return "flaky"
+	}
+	return "not_equal"
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// grpcFrame prefixes an uncompressed message for a gRPC stream.
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// collector streams comparison results to a gRPC collector in the background.
+// Results are queued in a bounded buffer, which also holds them while the
+// collector is unreachable, and dropped when it is full.
+type collector struct {
+	addr    string
+	client  *http.Client
+	results chan *comparisonResult
+	closing chan struct{}
+	done    chan struct{}
+}
+
+func newCollector(addr string, buffer int) *collector {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	c := &collector{
+		addr:    addr,
+		client:  &http.Client{Transport: &http.Transport{Protocols: &protocols}},
+		results: make(chan *comparisonResult, buffer),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Send queues a result for the collector.
+func (c *collector) Send(r *comparisonResult) {
+	select {
+	case c.results <- r:
+	default:
+		collectorDropped.Add(1)
+	}
+}
+
+// Close sends the queued results if the collector is reachable and ends the
+// stream. No results may be sent afterwards.
+func (c *collector) Close() {
+	close(c.closing)
+	close(c.results)
+	<-c.done
+}
+
+func (c *collector) run() {
+	defer close(c.done)
+	var pending *comparisonResult
+	backoff := collectorMinBackoff
+	for {
+		start := time.Now()
+		var err error
+		pending, err = c.stream(pending)
+		if err == nil {
+			return
+		}
+		log.Printf("Stream to collector %s failed: %s", c.addr, err)
+		if time.Since(start) > collectorMaxBackoff {
+			backoff = collectorMinBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-c.closing:
+			return
+		}
+		backoff = min(2*backoff, collectorMaxBackoff)
+	}
+}
+
+// stream sends pending, if any, and the queued results over one call until
+// the queue is closed or the call ends. It returns the result it failed to
+// send, to be sent over the next call.
+func (c *collector) stream(pending *comparisonResult) (*comparisonResult, error) {
+	body, messages := io.Pipe()
+	req, err := http.NewRequest("POST", "http://"+c.addr+collectorMethod, body)
+	if err != nil {
+		return pending, err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	ended := make(chan error, 1)
+	go func() {
+		err := c.call(req)
+		body.CloseWithError(errCollectorEnded)
+		ended <- err
+	}()
+
+	for {
+		if pending == nil {
+			var ok bool
+			select {
+			case pending, ok = <-c.results:
+				if !ok {
+					messages.Close()
+					return nil, <-ended
+				}
+			case err := <-ended:
+				if err == nil {
+					err = errCollectorEnded
+				}
+				return nil, err
+			}
+		}
+		if _, err := messages.Write(grpcFrame(pending.marshal())); err != nil {
+			if err = <-ended; err == nil {
+				err = errCollectorEnded
+			}
+			return pending, err
+		}
+		pending = nil
+	}
+}
+
+// call performs the streaming call and returns once it ended, with an error
+// unless the collector answered with an OK status.
+func (c *collector) call(req *http.Request) error {
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// A response without a message carries the status in the headers.
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		return fmt.Errorf("gRPC status %s: %s", status, message)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// unmarshalComparisonResult decodes a ComparisonResult protobuf message.
+func unmarshalComparisonResult(t *testing.T, b []byte) *comparisonResult {
+	t.Helper()
+	r := &comparisonResult{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("Malformed message")
+		}
+		b = b[n:]
+		switch key {
+		case 1<<3 | 2, 2<<3 | 2, 3<<3 | 2, 7<<3 | 2, 8<<3 | 2, 9<<3 | 2:
+			s := string(b[:v])
+			b = b[v:]
+			switch key >> 3 {
+			case 1:
+				r.RequestID = s
+			case 2:
+				r.Method = s
+			case 3:
+				r.Path = s
+			case 7:
+				r.Env = s
+			case 8:
+				r.Instance = s
+			case 9:
+				r.Alternate = s
+			}
+		case 4 << 3:
+			r.Equal = v != 0
+		case 5 << 3:
+			r.ProductionStatus = int(v)
+		case 6 << 3:
+			r.AlternateStatus = int(v)
+		default:
+			t.Fatalf("Unexpected field key %d", key)
+		}
+	}
+	return r
+}
+
+// newCollectorServer starts a gRPC server of the Collector service over
+// HTTP/2 without TLS and reports every received result. It listens on addr,
+// if not empty. When perCall is positive, every call ends after that many
+// results.
+func newCollectorServer(t *testing.T, addr string, perCall int) (*httptest.Server, chan *comparisonResult) {
+	results := make(chan *comparisonResult, 100)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != collectorMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("Unexpected call '%s' of '%s'", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		for n := 0; perCall <= 0 || n < perCall; n++ {
+			var prefix [5]byte
+			if _, err := io.ReadFull(r.Body, prefix[:]); err != nil {
+				break
+			}
+			message := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+			if _, err := io.ReadFull(r.Body, message); err != nil {
+				break
+			}
+			results <- unmarshalComparisonResult(t, message)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(grpcFrame(nil))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	if addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to listen to %s: %s", addr, err)
+		}
+		server.Listener.Close()
+		server.Listener = listener
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, results
+}
+
+func waitResult(t *testing.T, results chan *comparisonResult) *comparisonResult {
+	t.Helper()
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a comparison result, but received none")
+	}
+	return nil
+}
+
+func TestComparisonResultsAreStreamedToCollector(t *testing.T) {
+	captureLog(t)
+	server, results := newCollectorServer(t, "", 0)
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.Collector = newCollector(hostOf(server), 10)
+	defer h.Collector.Close()
+
+	for _, path := range []string{"/first", "/second"} {
+		serve(h, httptest.NewRequest("GET", path, nil))
+		r := waitResult(t, results)
+		if r.Path != path || r.Method != "GET" || !r.Equal || r.ProductionStatus != 200 || r.AlternateStatus != 200 {
+			t.Errorf("Expected an equal result for '%s', but received %+v", path, r)
+		}
+		if r.RequestID == "" {
+			t.Errorf("Expected a request ID, but received none")
+		}
+		if r.Alternate != hostOf(alternate) {
+			t.Errorf("Expected '%s', but received '%s'", hostOf(alternate), r.Alternate)
+		}
+	}
+}
+
+func TestCollectorReconnects(t *testing.T) {
+	logs := captureLog(t)
+	server, results := newCollectorServer(t, "", 1)
+	c := newCollector(hostOf(server), 10)
+	defer c.Close()
+
+	for i, id := range []string{"1", "2", "3"} {
+		c.Send(&comparisonResult{RequestID: id})
+		if r := waitResult(t, results); r.RequestID != id {
+			t.Errorf("Expected '%s', but received '%s'", id, r.RequestID)
+		}
+		waitLog(t, logs, "collector ended the stream", i+1)
+	}
+}
+
+func TestCollectorBuffersWhileUnreachable(t *testing.T) {
+	logs := captureLog(t)
+	dropped := collectorDropped.Value()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	c := newCollector(addr, 2)
+	defer c.Close()
+
+	for _, id := range []string{"1", "2", "3", "4"} {
+		c.Send(&comparisonResult{RequestID: id})
+	}
+	if n := collectorDropped.Value() - dropped; n < 1 {
+		t.Errorf("Expected dropped results, but received '%d'", n)
+	}
+	waitLog(t, logs, "connection refused", 1)
+
+	_, results := newCollectorServer(t, addr, 0)
+	for _, id := range []string{"1", "2"} {
+		if r := waitResult(t, results); r.RequestID != id {
+			t.Errorf("Expected '%s', but received '%s'", id, r.RequestID)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+)
+
+// A comparator compares decoded response bodies of a media type
+// semantically. It returns an error if a body can't be interpreted, in which
+// case compareResp falls back to its default comparison.
+type comparator func(prodBody []byte, prodHeader http.Header, altBody []byte, altHeader http.Header) (bool, error)
+
+// comparators by the media type of the production response. Entries are only
+// added in init functions.
+var comparators = map[string]comparator{}
+
+// comparatorFor returns the comparator for the Content-Type in header, or nil.
+func comparatorFor(header http.Header) comparator {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	return comparators[mediaType]
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "path to a YAML or JSON file setting the main flags, which take precedence when given on the command line")
+
+// Config is the content of a -config file. Every field stands for a flag, and
+// fields left out of the file leave their flag alone.
+type Config struct {
+	Listen                *string  `json:"listen"`                  // -l
+	Production            *string  `json:"production"`              // -a
+	Alternates            []string `json:"alternates"`              // -b
+	ProductionTimeout     *int     `json:"production_timeout"`      // -a.timeout, in milliseconds
+	AlternateTimeout      *int     `json:"alternate_timeout"`       // -b.timeout, in milliseconds
+	Percent               *float64 `json:"percent"`                 // -p
+	TLSCertificate        *string  `json:"tls_certificate"`         // -cert.file
+	TLSPrivateKey         *string  `json:"tls_private_key"`         // -key.file
+	ProductionHostRewrite *bool    `json:"production_host_rewrite"` // -a.rewrite
+	AlternateHostRewrite  *bool    `json:"alternate_host_rewrite"`  // -b.rewrite
+	IgnoreFields          []string `json:"ignore_fields"`           // -ignore-fields
+	// Rules are the per-path rules, like in a -rules file, which takes
+	// precedence.
+	Rules []*rule `json:"rules"`
+}
+
+// LoadConfig reads and validates the config file at path. Files named *.json,
+// or starting with '{', are JSON, the others YAML.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) != ".json" && !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		values, err := parseYAML(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if data, err = json.Marshal(typedYAML(values, reflect.TypeOf(Config{}))); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	c := &Config{}
+	if err := decoder.Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	if c.Production != nil && *c.Production == "" {
+		return errors.New("empty production target")
+	}
+	if c.Alternates != nil && len(c.Alternates) == 0 {
+		return errors.New("no alternate targets")
+	}
+	for _, target := range c.Alternates {
+		if target == "" {
+			return errors.New("empty alternate target")
+		}
+	}
+	if c.Percent != nil && (*c.Percent < 0 || *c.Percent > 100) {
+		return fmt.Errorf("percent %v is not between 0 and 100", *c.Percent)
+	}
+	if c.ProductionTimeout != nil && *c.ProductionTimeout < 0 || c.AlternateTimeout != nil && *c.AlternateTimeout < 0 {
+		return errors.New("negative timeout")
+	}
+	return compileRules(c.Rules)
+}
+
+// apply sets the flags of fs given in the config, except for those already
+// set, so that the command line takes precedence over the file.
+func (c *Config) apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	values := map[string]string{}
+	if c.Listen != nil {
+		values["l"] = *c.Listen
+	}
+	if c.Production != nil {
+		values["a"] = *c.Production
+	}
+	if c.Alternates != nil {
+		values["b"] = strings.Join(c.Alternates, ",")
+	}
+	if c.ProductionTimeout != nil {
+		values["a.timeout"] = strconv.Itoa(*c.ProductionTimeout)
+	}
+	if c.AlternateTimeout != nil {
+		values["b.timeout"] = strconv.Itoa(*c.AlternateTimeout)
+	}
+	if c.Percent != nil {
+		values["p"] = strconv.FormatFloat(*c.Percent, 'g', -1, 64)
+	}
+	if c.TLSCertificate != nil {
+		values["cert.file"] = *c.TLSCertificate
+	}
+	if c.TLSPrivateKey != nil {
+		values["key.file"] = *c.TLSPrivateKey
+	}
+	if c.ProductionHostRewrite != nil {
+		values["a.rewrite"] = strconv.FormatBool(*c.ProductionHostRewrite)
+	}
+	if c.AlternateHostRewrite != nil {
+		values["b.rewrite"] = strconv.FormatBool(*c.AlternateHostRewrite)
+	}
+	if c.IgnoreFields != nil {
+		values["ignore-fields"] = strings.Join(c.IgnoreFields, ",")
+	}
+	for name, value := range values {
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// parseYAML parses the subset of YAML a config needs: a mapping of keys to
+// scalars, or to lists given either inline as [a, b] or as '- ' items on the
+// following lines. List items are scalars, or mappings of keys to scalars
+// continued on the following, further indented lines. Comments start with
+// '#' outside of quotes. Scalars are kept as yamlScalar, typed by typedYAML.
+func parseYAML(data []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	var list string                 // key of the block list being read, if any
+	var item map[string]interface{} // mapping item being read, if any
+	for i, line := range strings.Split(string(data), "\n") {
+		line = stripYAMLComment(line)
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if list == "" {
+				return nil, fmt.Errorf("line %d: list item outside of a list", i+1)
+			}
+			text := strings.TrimSpace(trimmed[1:])
+			item = nil
+			var value interface{}
+			if key, v, ok := parseYAMLPair(text); ok && !strings.HasPrefix(text, `"`) && !strings.HasPrefix(text, "'") {
+				item = map[string]interface{}{key: parseYAMLScalar(v)}
+				value = item
+			} else {
+				value = parseYAMLScalar(text)
+			}
+			values[list] = append(values[list].([]interface{}), value)
+			continue
+		}
+		if line != trimmed {
+			if item == nil {
+				return nil, fmt.Errorf("line %d: unexpected indentation", i+1)
+			}
+			key, value, ok := parseYAMLPair(trimmed)
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected 'key: value'", i+1)
+			}
+			if _, ok := item[key]; ok {
+				return nil, fmt.Errorf("line %d: duplicate key %q", i+1, key)
+			}
+			item[key] = parseYAMLScalar(value)
+			continue
+		}
+		key, value, ok := parseYAMLPair(trimmed)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", i+1)
+		}
+		list, item = "", nil
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", i+1, key)
+		}
+		switch {
+		case value == "":
+			list = key
+			values[key] = []interface{}{}
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			items := []interface{}{}
+			if inner := strings.TrimSpace(value[1 : len(value)-1]); inner != "" {
+				for _, v := range strings.Split(inner, ",") {
+					items = append(items, parseYAMLScalar(strings.TrimSpace(v)))
+				}
+			}
+			values[key] = items
+		default:
+			values[key] = parseYAMLScalar(value)
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLPair splits a 'key: value' line. The value is empty for 'key:'.
+func parseYAMLPair(s string) (key, value string, ok bool) {
+	key, value, ok = strings.Cut(s+" ", ": ")
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return key, strings.TrimSpace(value), true
+}
+
+// stripYAMLComment removes a comment from line: a '#' at its start or after
+// white space, outside of quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return line
+}
+
+// yamlScalar is the text of a YAML scalar, unquoted. Its type is only known
+// from the field it sets, see typedYAML: 'listen: 8888' sets a string, while
+// 'percent: 10' sets a number.
+type yamlScalar struct {
+	text   string
+	quoted bool
+}
+
+// parseYAMLScalar returns the text of a scalar, quoted or not.
+func parseYAMLScalar(s string) yamlScalar {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return yamlScalar{strings.ReplaceAll(s[1:len(s)-1], "''", "'"), true}
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil && strings.HasPrefix(s, `"`) {
+		return yamlScalar{unquoted, true}
+	}
+	return yamlScalar{s, false}
+}
+
+// typedYAML returns the value parsed by parseYAML, to be encoded as JSON for
+// a field of type t. Scalars are strings, unless t is a number or a boolean,
+// in which case their unquoted text is taken as such. Invalid ones are left
+// for the JSON decoder to reject.
+func typedYAML(value interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := value.(type) {
+	case yamlScalar:
+		if t == nil || v.quoted {
+			return v.text
+		}
+		switch t.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+			if raw := json.RawMessage(v.text); json.Valid(raw) {
+				return raw
+			}
+		}
+		return v.text
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			elem = t.Elem()
+		}
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = typedYAML(item, elem)
+		}
+		return items
+	case map[string]interface{}:
+		fields := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			fields[key] = typedYAML(value, yamlFieldType(t, key))
+		}
+		return fields
+	}
+	return value
+}
+
+// yamlFieldType returns the type of the field of struct type t with the JSON
+// name key, or nil if there is none.
+func yamlFieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); name == key {
+			return t.Field(i).Type
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file named name and returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	yaml := writeConfig(t, "teeproxy.yaml", `# teeproxy
+listen: ":9999"
+production: localhost:9000
+alternates:
+  - localhost:9001
+  - 'localhost:9002'
+production_timeout: 500
+percent: 12.5 # of the requests
+alternate_host_rewrite: true
+`)
+	json := writeConfig(t, "teeproxy.json", `{"listen": ":9999", "production": "localhost:9000",
+		"alternates": ["localhost:9001", "localhost:9002"], "production_timeout": 500,
+		"percent": 12.5, "alternate_host_rewrite": true}`)
+	inline := writeConfig(t, "inline.yml", `{"listen": ":9999"}`)
+
+	fromYAML, err := LoadConfig(yaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := LoadConfig(json)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromYAML, fromJSON) {
+		t.Errorf("Expected '%+v', but received '%+v'", fromJSON, fromYAML)
+	}
+	if fromYAML.AlternateTimeout != nil || fromYAML.ProductionHostRewrite != nil {
+		t.Errorf("Expected the fields left out to be unset, but received '%+v'", fromYAML)
+	}
+	if c, err := LoadConfig(inline); err != nil || *c.Listen != ":9999" {
+		t.Errorf("Expected JSON in a .yml file to be read, but received '%v'", err)
+	}
+}
+
+func TestYAMLScalarsTakeTheTypeOfTheirField(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, "c.yaml", `listen: 8888
+production: "prod #1:80" # quoted
+alternates: [10, 'alt #2:80']
+production_timeout: 500
+ignore_fields:
+  - 1
+  - "#id"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *c.Listen != "8888" || *c.Production != "prod #1:80" || *c.ProductionTimeout != 500 {
+		t.Errorf("Expected the scalars as written, but received '%+v'", c)
+	}
+	if expectation := []string{"10", "alt #2:80"}; !reflect.DeepEqual(c.Alternates, expectation) {
+		t.Errorf("Expected '%v', but received '%v'", expectation, c.Alternates)
+	}
+	if expectation := []string{"1", "#id"}; !reflect.DeepEqual(c.IgnoreFields, expectation) {
+		t.Errorf("Expected '%v', but received '%v'", expectation, c.IgnoreFields)
+	}
+	if _, err := LoadConfig(writeConfig(t, "c.yaml", "production_timeout: soon\n")); err == nil {
+		t.Errorf("Expected a timeout that is not a number to be rejected")
+	}
+}
+
+func TestMalformedConfig(t *testing.T) {
+	for _, test := range []struct {
+		name, content, expected string
+	}{
+		{"c.yaml", "listen :9999\n", "line 1: expected 'key: value'"},
+		{"c.yaml", "- localhost:9001\n", "line 1: list item outside of a list"},
+		{"c.yaml", "listen: a\nlisten: b\n", "line 2: duplicate key"},
+		{"c.yaml", "listen: a\n  production: b\n", "line 2: unexpected indentation"},
+		{"c.yaml", "listen: a\ntargets: b\n", "unknown field \"targets\""},
+		{"c.yaml", "production: ''\n", "empty production target"},
+		{"c.yaml", "alternates: []\n", "no alternate targets"},
+		{"c.yaml", "percent: 101\n", "percent 101 is not between 0 and 100"},
+		{"c.json", `{"alternate_timeout": -1}`, "negative timeout"},
+		{"c.json", `{"percent": "all"}`, "cannot unmarshal"},
+		{"c.json", `{"listen": `, "unexpected EOF"},
+	} {
+		_, err := LoadConfig(writeConfig(t, test.name, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected '%s' for %q, but received '%v'", test.expected, test.content, err)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
+
+func TestCommandLineOverridesConfig(t *testing.T) {
+	fs := flag.NewFlagSet("teeproxy", flag.ContinueOnError)
+	listen := fs.String("l", ":8888", "")
+	production := fs.String("a", "localhost:8080", "")
+	alternates := &targetList{targets: []string{"localhost:8081"}}
+	fs.Var(alternates, "b", "")
+	timeout := fs.Int("a.timeout", 2500, "")
+	if err := fs.Parse([]string{"-a", "localhost:7000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConfig(writeConfig(t, "c.yaml", "listen: :9999\nproduction: localhost:9000\nalternates: [b1:80, b2:80]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != ":9999" {
+		t.Errorf("Expected '%s', but received '%s'", ":9999", *listen)
+	}
+	if *production != "localhost:7000" {
+		t.Errorf("Expected '%s', but received '%s'", "localhost:7000", *production)
+	}
+	if alternates.String() != "b1:80,b2:80" {
+		t.Errorf("Expected '%s', but received '%s'", "b1:80,b2:80", alternates.String())
+	}
+	if *timeout != 2500 {
+		t.Errorf("Expected '%d', but received '%d'", 2500, *timeout)
+	}
+}
+
+func TestConfigRules(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, "c.yaml", `percent: 50
+rules:
+  - pattern: ^/api/v2/
+    percent: 100
+  - pattern: ^/api/   # overlaps the one above, which comes first
+    percent: 20
+  - pattern: ^/search
+    percent: 5
+    compare: true
+  - pattern: ^/checkout
+    percent: 0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "p", "50")
+	for _, test := range []struct {
+		path    string
+		percent float64
+	}{
+		{"/api/v2/users", 100},
+		{"/api/v1/users", 20},
+		{"/search?q=x", 5},
+		{"/checkout", 0},
+		{"/other", 50},
+	} {
+		if p := samplingPercent(matchRule(c.Rules, test.path), "GET"); p != test.percent {
+			t.Errorf("Expected '%v' for %s, but received '%v'", test.percent, test.path, p)
+		}
+	}
+
+	for _, invalid := range []string{
+		"rules:\n  - pattern: (\n",
+		"rules:\n  - pattern: ^/\n    percent: 120\n",
+		"rules:\n  - pattern: ^/\n    pattern: ^/x\n",
+		"rules:\n  - pattern: ^/\n    colour: red\n",
+	} {
+		if _, err := LoadConfig(writeConfig(t, "c.yaml", invalid)); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
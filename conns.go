@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+var maxRequestsPerConn = flag.Int64("transport.max-requests-per-conn", 0, "requests a backend connection serves before it is closed, 0 means no limit")
+
+// countedConn is a backend connection counting the requests sent over it.
+type countedConn struct {
+	net.Conn
+	requests int64
+}
+
+// countRequests makes the connections of dial count their requests, see
+// limitRequestsPerConn.
+func countRequests(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+// limitRequestsPerConn returns req counted on the connection it is sent over,
+// and a function to apply to its response. Once a connection has served max
+// requests, it is closed when the body of that response is closed, so that the
+// next requests go over a new connection. A max of 0 means no limit.
+func limitRequestsPerConn(req *http.Request, max int64) (*http.Request, func(*http.Response) *http.Response) {
+	if max <= 0 {
+		return req, func(resp *http.Response) *http.Response { return resp }
+	}
+	// Set by GotConn, which runs before RoundTrip returns.
+	var retired net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn := info.Conn
+			if c, ok := conn.(*tls.Conn); ok {
+				conn = c.NetConn()
+			}
+			if c, ok := conn.(*countedConn); ok && atomic.AddInt64(&c.requests, 1) == max {
+				retired = info.Conn
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return req, func(resp *http.Response) *http.Response {
+		if resp != nil && retired != nil {
+			resp.Body = &retiringBody{resp.Body, retired}
+		}
+		return resp
+	}
+}
+
+// retiringBody closes the connection a response was received on with the body.
+type retiringBody struct {
+	io.ReadCloser
+	conn net.Conn
+}
+
+func (b *retiringBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
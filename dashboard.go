@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The debug listener serves a self-contained page on /dashboard that polls the
+// divergence statistics on /stats.
+func init() {
+	http.HandleFunc("/stats", serveStats)
+	http.HandleFunc("/dashboard", serveDashboard)
+}
+
+const (
+	// statsMaxPaths bounds the paths counted separately on /stats, further
+	// paths are counted under statsOtherPaths.
+	statsMaxPaths   = 1000
+	statsOtherPaths = "(other)"
+	// statsRecentMismatches is the number of mismatches kept for /stats.
+	statsRecentMismatches = 20
+)
+
+var divergences = newDivergenceStats(statsMaxPaths, statsRecentMismatches)
+
+// Latencies of the backend responses, until their headers are received.
+var backendLatency = map[string]*histogram{
+	"production": newHistogram("production_latency_seconds", latencyBuckets),
+	"alternate":  newHistogram("alternate_latency_seconds", latencyBuckets),
+}
+
+type pathStats struct {
+	Equal    int64 `json:"equal"`
+	NotEqual int64 `json:"not_equal"`
+	Flaky    int64 `json:"flaky"`
+}
+
+type recentMismatch struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id"`
+	Method           string    `json:"method"`
+	Path             string    `json:"path"`
+	ProductionStatus int       `json:"production_status"`
+	AlternateStatus  int       `json:"alternate_status"`
+}
+
+// divergenceStats counts the comparison results per path and keeps the most
+// recent mismatches.
+type divergenceStats struct {
+	maxPaths int
+
+	mu     sync.Mutex
+	paths  map[string]*pathStats
+	recent []recentMismatch // ring buffer, next is the oldest once full
+	next   int
+}
+
+func newDivergenceStats(maxPaths, recent int) *divergenceStats {
+	return &divergenceStats{
+		maxPaths: maxPaths,
+		paths:    make(map[string]*pathStats),
+		recent:   make([]recentMismatch, 0, recent),
+	}
+}
+
+// Count adds a comparison result.
+func (s *divergenceStats) Count(r *comparisonResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.Path
+	if _, ok := s.paths[key]; !ok && len(s.paths) >= s.maxPaths {
+		key = statsOtherPaths
+	}
+	p := s.paths[key]
+	if p == nil {
+		p = &pathStats{}
+		s.paths[key] = p
+	}
+	switch {
+	case r.Equal:
+		p.Equal++
+		return
+	case r.Flaky:
+		p.Flaky++
+		return
+	}
+	p.NotEqual++
+	m := recentMismatch{time.Now(), r.RequestID, r.Method, r.Path, r.ProductionStatus, r.AlternateStatus}
+	if len(s.recent) < cap(s.recent) {
+		s.recent = append(s.recent, m)
+		return
+	}
+	s.recent[s.next] = m
+	s.next = (s.next + 1) % len(s.recent)
+}
+
+// snapshot returns a copy of the counts per path and the recent mismatches,
+// newest first.
+func (s *divergenceStats) snapshot() (map[string]pathStats, []recentMismatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make(map[string]pathStats, len(s.paths))
+	for path, p := range s.paths {
+		paths[path] = *p
+	}
+	recent := make([]recentMismatch, 0, len(s.recent))
+	for i := len(s.recent) - 1; i >= 0; i-- {
+		recent = append(recent, s.recent[(s.next+i)%len(s.recent)])
+	}
+	return paths, recent
+}
+
+type latencyStats struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean_seconds"`
+	P50   float64 `json:"p50_seconds"`
+	P99   float64 `json:"p99_seconds"`
+}
+
+type statsResponse struct {
+	Paths            map[string]pathStats    `json:"paths"`
+	RecentMismatches []recentMismatch        `json:"recent_mismatches"`
+	Latency          map[string]latencyStats `json:"latency"`
+}
+
+// serveStats reports the divergence statistics as JSON.
+func serveStats(w http.ResponseWriter, req *http.Request) {
+	var stats statsResponse
+	stats.Paths, stats.RecentMismatches = divergences.snapshot()
+	stats.Latency = make(map[string]latencyStats)
+	for backend, h := range backendLatency {
+		l := latencyStats{Count: h.Count(), P50: h.Quantile(.5), P99: h.Quantile(.99)}
+		if l.Count > 0 {
+			l.Mean = h.Sum() / float64(l.Count)
+		}
+		stats.Latency[backend] = l
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func serveDashboard(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardPage))
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>teeproxy</title>
+<style>
+body { font: 14px sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { padding: 4px 12px; text-align: left; border-bottom: 1px solid #ddd; }
+.bar { display: inline-block; height: 10px; background: #c33; }
+.ok { background: #3a3; }
+</style>
+</head>
+<body>
+<h1>teeproxy</h1>
+<h2>Latency</h2>
+<table id="latency"></table>
+<h2>Comparisons per path</h2>
+<table id="paths"></table>
+<h2>Recent mismatches</h2>
+<table id="recent"></table>
+<script>
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function (c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c];
+  });
+}
+function ms(s) { return (s * 1000).toFixed(1) + " ms"; }
+function table(id, head, rows) {
+  document.getElementById(id).innerHTML = "<tr><th>" + head.join("</th><th>") + "</th></tr>" +
+    rows.map(function (r) { return "<tr><td>" + r.join("</td><td>") + "</td></tr>"; }).join("");
+}
+function render(stats) {
+  table("latency", ["backend", "responses", "mean", "p50", "p99"],
+    Object.keys(stats.latency).sort().map(function (b) {
+      var l = stats.latency[b];
+      return [esc(b), l.count, ms(l.mean_seconds), "&le; " + ms(l.p50_seconds), "&le; " + ms(l.p99_seconds)];
+    }));
+  var paths = Object.keys(stats.paths).sort(function (a, b) {
+    return stats.paths[b].not_equal - stats.paths[a].not_equal;
+  });
+  table("paths", ["path", "equal", "not equal", "flaky", ""], paths.map(function (p) {
+    var s = stats.paths[p], total = s.equal + s.not_equal;
+    var bad = total ? Math.round(200 * s.not_equal / total) : 0;
+    return [esc(p), s.equal, s.not_equal, s.flaky,
+      '<span class="bar" style="width:' + bad + 'px"></span><span class="bar ok" style="width:' + (total ? 200 - bad : 0) + 'px"></span>'];
+  }));
+  table("recent", ["time", "request", "production", "alternate", "request id"],
+    (stats.recent_mismatches || []).map(function (m) {
+      return [esc(new Date(m.time).toLocaleTimeString()), esc(m.method + " " + m.path),
+        m.production_status, m.alternate_status, esc(m.request_id)];
+    }));
+}
+function poll() {
+  fetch("stats").then(function (r) { return r.json(); }).then(render).catch(function () {});
+}
+poll();
+setInterval(poll, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatsReportsDivergences(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	// The stats are global, so earlier runs of the test may have counted.
+	before, _ := divergences.snapshot()
+
+	req, id := newRequest("GET", "/stats-test", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+
+	recorder := serve(http.HandlerFunc(serveStats), httptest.NewRequest("GET", "/stats", nil))
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected '%s', but received '%s'", "application/json", ct)
+	}
+	var stats struct {
+		Paths map[string]struct {
+			Equal    *int64 `json:"equal"`
+			NotEqual *int64 `json:"not_equal"`
+		} `json:"paths"`
+		RecentMismatches []struct {
+			Time             string `json:"time"`
+			RequestID        string `json:"request_id"`
+			Method           string `json:"method"`
+			Path             string `json:"path"`
+			ProductionStatus int    `json:"production_status"`
+			AlternateStatus  int    `json:"alternate_status"`
+		} `json:"recent_mismatches"`
+		Latency map[string]struct {
+			Count *int64   `json:"count"`
+			Mean  *float64 `json:"mean_seconds"`
+			P50   *float64 `json:"p50_seconds"`
+			P99   *float64 `json:"p99_seconds"`
+		} `json:"latency"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := stats.Paths["/stats-test"]
+	if !ok || p.Equal == nil || p.NotEqual == nil || *p.NotEqual-before["/stats-test"].NotEqual != 1 {
+		t.Errorf("Expected one mismatch for '/stats-test', but received '%s'", recorder.Body)
+	}
+	if len(stats.RecentMismatches) == 0 {
+		t.Fatalf("Expected recent mismatches, but received '%s'", recorder.Body)
+	}
+	if m := stats.RecentMismatches[0]; m.Path != "/stats-test" || m.Method != "GET" || m.Time == "" ||
+		m.RequestID == "" || m.ProductionStatus != 200 || m.AlternateStatus != 200 {
+		t.Errorf("Expected the newest mismatch first, but received '%+v'", m)
+	}
+	for _, backend := range []string{"production", "alternate"} {
+		l, ok := stats.Latency[backend]
+		if !ok || l.Count == nil || *l.Count == 0 || l.Mean == nil || l.P50 == nil || l.P99 == nil {
+			t.Errorf("Expected latencies of '%s', but received '%s'", backend, recorder.Body)
+		}
+	}
+}
+
+func TestDivergenceStatsBoundsPaths(t *testing.T) {
+	s := newDivergenceStats(2, 2)
+	for _, path := range []string{"/a", "/b", "/c", "/d", "/a"} {
+		s.Count(&comparisonResult{Path: path})
+	}
+	paths, recent := s.snapshot()
+	if paths["/a"].NotEqual != 2 || paths[statsOtherPaths].NotEqual != 2 || len(paths) != 3 {
+		t.Errorf("Expected '/a', '/b' and the others, but received '%v'", paths)
+	}
+	if len(recent) != 2 || recent[0].Path != "/a" || recent[1].Path != "/d" {
+		t.Errorf("Expected the two newest mismatches, but received '%+v'", recent)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	decisionURL     = flag.String("decision-url", "", "URL of a service deciding whether requests are mirrored and compared, asked in the background with a JSON POST of their method and path instead of sampling with -p; disabled when empty")
+	decisionTimeout = flag.Int("decision-timeout", 20, "milliseconds to wait for the -decision-url in the background, after which it counts as failed")
+	decisionTTL     = flag.Int("decision-ttl", 10, "seconds a verdict of the -decision-url is cached for the method and path template, and a failure for falling back to -p")
+)
+
+var decisionFallbacks = expvar.NewInt("decision_fallbacks")
+
+// maxDecisions bounds the cached verdicts. Once full, the cache starts over.
+const maxDecisions = 10000
+
+// verdict is the answer of the decision service. Compare defaults to true.
+type verdict struct {
+	Mirror  bool `json:"mirror"`
+	Compare bool `json:"compare"`
+}
+
+type cachedVerdict struct {
+	verdict verdict
+	ok      bool // false if the service failed
+	expires time.Time
+}
+
+// decisionService asks an external service whether to mirror and compare a
+// request, for experiments controlled centrally. Its verdicts are cached per
+// method and path template, see pathTemplate, and only asked for in the
+// background, so that the service never delays a request. It fails open:
+// until there is a verdict, and on errors and timeouts, the local sampling
+// decides, and the service is not asked again about the method and template
+// until the cache entry expires.
+type decisionService struct {
+	url    string
+	client *http.Client
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	verdicts map[string]cachedVerdict
+	pending  map[string]bool // keys being asked about
+}
+
+func newDecisionService(url string, timeout, ttl time.Duration, now func() time.Time) *decisionService {
+	return &decisionService{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		ttl:      ttl,
+		now:      now,
+		verdicts: make(map[string]cachedVerdict),
+		pending:  make(map[string]bool),
+	}
+}
+
+// Decide returns the cached verdict about req, and false if there is none,
+// e.g. because the service failed. A missing or expired verdict is asked for
+// in the background, once for concurrent requests; an expired one still
+// answers until then. A nil service has no verdicts.
+func (d *decisionService) Decide(req *http.Request) (verdict, bool) {
+	if d == nil {
+		return verdict{}, false
+	}
+	template := pathTemplate(req.URL.Path)
+	key := req.Method + " " + template
+	d.mu.Lock()
+	cached, found := d.verdicts[key]
+	if (!found || !d.now().Before(cached.expires)) && !d.pending[key] {
+		d.pending[key] = true
+		go d.fill(key, req.Method, req.URL.Path, template)
+	}
+	d.mu.Unlock()
+	if !found || !cached.ok {
+		decisionFallbacks.Add(1)
+		return verdict{}, false
+	}
+	return cached.verdict, true
+}
+
+// fill asks the service about a request and caches its verdict, or its
+// failure, under key.
+func (d *decisionService) fill(key, method, path, template string) {
+	v, err := d.ask(method, path, template)
+	if err != nil {
+		log.Printf("Decision service failed for %s, sampling locally: %s", key, err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, key)
+	if len(d.verdicts) >= maxDecisions {
+		d.verdicts = make(map[string]cachedVerdict)
+	}
+	d.verdicts[key] = cachedVerdict{v, err == nil, d.now().Add(d.ttl)}
+}
+
+// pathTemplate replaces the segments of path that look like identifiers by
+// "{id}", so that the requests for the resources of a REST API share a
+// verdict, e.g. "/users/{id}/orders" for "/users/42/orders".
+func pathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isIdentifier(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// isIdentifier reports whether a path segment is a number, or a UUID or other
+// long hexadecimal string with digits.
+func isIdentifier(segment string) bool {
+	digits, letters := 0, 0
+	for _, c := range segment {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F', c == '-':
+			letters++
+		default:
+			return false
+		}
+	}
+	return digits > 0 && (letters == 0 || len(segment) >= 16)
+}
+
+func (d *decisionService) ask(method, path, template string) (verdict, error) {
+	payload, err := json.Marshal(map[string]string{"method": method, "path": path, "template": template})
+	if err != nil {
+		return verdict{}, err
+	}
+	resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return verdict{}, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return verdict{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	v := verdict{Compare: true}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return verdict{}, err
+	}
+	return v, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitVerdict asks d about a request until the verdict is cached.
+func waitVerdict(t *testing.T, d *decisionService, method, path string) {
+	t.Helper()
+	d.Decide(httptest.NewRequest(method, path, nil))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		d.mu.Lock()
+		_, found := d.verdicts[method+" "+pathTemplate(path)]
+		d.mu.Unlock()
+		if found {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a verdict about '%s %s', but received none", method, path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	for path, expectation := range map[string]string{
+		"/":                "/",
+		"/users":           "/users",
+		"/users/42/orders": "/users/{id}/orders",
+		"/v2/items/7f3c9a1e-5b2d-4e8f-9a6b-1c2d3e4f5a6b": "/v2/items/{id}",
+		"/blobs/0123456789abcdef0":                       "/blobs/{id}",
+		"/feed/cafe":                                     "/feed/cafe",
+	} {
+		if template := pathTemplate(path); template != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, template)
+		}
+	}
+}
+
+func TestDecisionServiceVerdictIsHonored(t *testing.T) {
+	var asked int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&asked, 1)
+		var request struct{ Method, Path string }
+		json.NewDecoder(r.Body).Decode(&request)
+		switch request.Path {
+		case "/off":
+			w.Write([]byte(`{"mirror": false}`))
+		case "/mirror-only":
+			w.Write([]byte(`{"mirror": true, "compare": false}`))
+		default:
+			w.Write([]byte(`{"mirror": true}`))
+		}
+	}))
+	defer service.Close()
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.Decisions = newDecisionService(service.URL, time.Second, time.Minute, time.Now)
+	// The verdicts override the local sampling.
+	setFlag(t, "p", "0")
+	logs := captureLog(t)
+
+	// Until the verdict arrives, the local sampling decides.
+	serve(h, httptest.NewRequest("GET", "/on", nil))
+	expectNoHit(t, altHits)
+	for _, path := range []string{"/on", "/off", "/mirror-only"} {
+		waitVerdict(t, h.Decisions, "GET", path)
+	}
+
+	on, onID := newRequest("GET", "/on", nil)
+	serve(h, on)
+	waitHit(t, altHits)
+	waitComparison(t, logs, onID, "Equal", 1)
+
+	serve(h, httptest.NewRequest("GET", "/off", nil))
+	expectNoHit(t, altHits)
+
+	mirrorOnly, mirrorOnlyID := newRequest("GET", "/mirror-only", nil)
+	serve(h, mirrorOnly)
+	waitHit(t, altHits)
+	time.Sleep(50 * time.Millisecond)
+	if strings.Contains(logs.String(), "(request id "+mirrorOnlyID+")") {
+		t.Errorf("Expected no comparison of /mirror-only, but received '%s'", logs.String())
+	}
+
+	// Verdicts are cached.
+	serve(h, httptest.NewRequest("GET", "/off", nil))
+	expectNoHit(t, altHits)
+	if n := atomic.LoadInt32(&asked); n != 3 {
+		t.Errorf("Expected '%d' calls to the decision service, but received '%d'", 3, n)
+	}
+}
+
+func TestDecisionServiceIsAskedOncePerTemplate(t *testing.T) {
+	var asked int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&asked, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"mirror": true}`))
+	}))
+	defer service.Close()
+	d := newDecisionService(service.URL, time.Second, time.Minute, time.Now)
+	captureLog(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok := d.Decide(httptest.NewRequest("GET", fmt.Sprintf("/users/%d", i), nil)); ok {
+				t.Errorf("Expected no verdict before the service answered")
+			}
+		}(i)
+	}
+	wg.Wait()
+	waitVerdict(t, d, "GET", "/users/1")
+	if v, ok := d.Decide(httptest.NewRequest("GET", "/users/99", nil)); !ok || !v.Mirror {
+		t.Errorf("Expected the verdict for '/users/{id}', but received '%+v'", v)
+	}
+	if n := atomic.LoadInt32(&asked); n != 1 {
+		t.Errorf("Expected '%d' call to the decision service, but received '%d'", 1, n)
+	}
+}
+
+func TestDecisionServiceFailureFallsBackToSampling(t *testing.T) {
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer service.Close()
+	production, _ := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	captureLog(t)
+	fallbacks := decisionFallbacks.Value()
+
+	for _, c := range []struct {
+		url, percent string
+		mirrored     bool
+	}{
+		{service.URL, "100", true},
+		{service.URL + "/slow", "100", true},
+		{service.URL, "0", false},
+		{"http://127.0.0.1:1", "100", true},
+	} {
+		setFlag(t, "p", c.percent)
+		h.Decisions = newDecisionService(c.url, 50*time.Millisecond, time.Minute, time.Now)
+		start := time.Now()
+		recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+		if expectation := "production"; recorder.Body.String() != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+		}
+		if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+			t.Errorf("Expected the decision service to be given up on, but the request took '%s'", elapsed)
+		}
+		if c.mirrored {
+			waitHit(t, altHits)
+		} else {
+			expectNoHit(t, altHits)
+		}
+	}
+	if n := decisionFallbacks.Value() - fallbacks; n != 4 {
+		t.Errorf("Expected '%d' fallbacks, but received '%d'", 4, n)
+	}
+}
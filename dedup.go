@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"flag"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	dedupEnabled = flag.Bool("compare.dedup", false, "log repeated identical mismatches only once per -compare.dedup-window, with a repeat count")
+	dedupSize    = flag.Int("compare.dedup-size", 10000, "distinct mismatches remembered by -compare.dedup")
+	dedupWindow  = flag.Int("compare.dedup-window", 60, "seconds during which repeats of a mismatch are suppressed by -compare.dedup")
+)
+
+// mismatchFingerprint identifies a mismatch by the request (method, path and
+// body) and the divergence (statuses and bodies of both responses).
+func mismatchFingerprint(x *exchange) uint64 {
+	h := fnv.New64a()
+	put := func(b []byte) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(b))))
+		h.Write(b)
+	}
+	put([]byte(x.AlternateTarget))
+	put([]byte(x.Request.Method))
+	put([]byte(x.Request.URL.Path))
+	put(x.RequestBody)
+	r := newComparisonResult(x, false)
+	put(binary.AppendUvarint(nil, uint64(r.ProductionStatus)))
+	put(binary.AppendUvarint(nil, uint64(r.AlternateStatus)))
+	put(x.ProductionBody)
+	put(x.AlternateBody)
+	return h.Sum64()
+}
+
+// dedup is a bounded LRU set of recent mismatches. Repeats of a mismatch
+// within the window after its first occurrence are counted instead of being
+// logged; the count is logged once the window is over.
+type dedup struct {
+	size   int
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // of *dedupEntry, most recently seen first
+	entries map[uint64]*list.Element
+}
+
+type dedupEntry struct {
+	fingerprint uint64
+	line        string // logged for the first occurrence
+	first       time.Time
+	repeats     int
+}
+
+func newDedup(size int, window time.Duration, now func() time.Time) *dedup {
+	return &dedup{
+		size:    size,
+		window:  window,
+		now:     now,
+		order:   list.New(),
+		entries: make(map[uint64]*list.Element),
+	}
+}
+
+// Seen records an occurrence of the mismatch with the given fingerprint,
+// logged as line, and reports whether it is a repeat to be suppressed.
+func (d *dedup) Seen(fingerprint uint64, line string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	if element, ok := d.entries[fingerprint]; ok {
+		e := element.Value.(*dedupEntry)
+		d.order.MoveToFront(element)
+		if now.Sub(e.first) < d.window {
+			e.repeats++
+			return true
+		}
+		e.flush()
+		e.line, e.first, e.repeats = line, now, 0
+		return false
+	}
+	d.entries[fingerprint] = d.order.PushFront(&dedupEntry{fingerprint: fingerprint, line: line, first: now})
+	if d.order.Len() > d.size {
+		d.remove(d.order.Back())
+	}
+	return false
+}
+
+// Flush logs the repeat counts of mismatches whose window is over and forgets
+// them.
+func (d *dedup) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for element := d.order.Front(); element != nil; {
+		next := element.Next()
+		if now.Sub(element.Value.(*dedupEntry).first) >= d.window {
+			d.remove(element)
+		}
+		element = next
+	}
+}
+
+func (d *dedup) remove(element *list.Element) {
+	e := d.order.Remove(element).(*dedupEntry)
+	delete(d.entries, e.fingerprint)
+	e.flush()
+}
+
+// flush logs the repeat count, if any.
+func (e *dedupEntry) flush() {
+	if e.repeats > 0 {
+		log.Printf("Suppressed %d repeats of: %s", e.repeats, e.line)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeatedMismatchesAreReportedOnce(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	now := time.Unix(0, 0)
+	h.Dedup = newDedup(10, time.Minute, func() time.Time { return now })
+	logs := captureLog(t)
+
+	for i := 0; i < 10; i++ {
+		serve(h, httptest.NewRequest("POST", "/same", strings.NewReader("body")))
+	}
+	serve(h, httptest.NewRequest("POST", "/same", strings.NewReader("other body")))
+	deadline := time.Now().Add(2 * time.Second)
+	for comparisonQueueDepth.Value() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := strings.Count(logs.String(), "Not equal: POST /same"); n != 2 {
+		t.Errorf("Expected '%d' reported mismatches, but received '%d': '%s'", 2, n, logs.String())
+	}
+
+	h.Dedup.Flush()
+	if strings.Contains(logs.String(), "Suppressed") {
+		t.Errorf("Expected no repeat count within the window, but received '%s'", logs.String())
+	}
+	now = now.Add(time.Minute)
+	h.Dedup.Flush()
+	if n := strings.Count(logs.String(), "Suppressed 9 repeats of: Not equal: POST /same"); n != 1 {
+		t.Errorf("Expected the repeat count once, but received '%s'", logs.String())
+	}
+}
+
+func TestDedupEvictsLeastRecentlySeen(t *testing.T) {
+	logs := captureLog(t)
+	now := time.Unix(0, 0)
+	d := newDedup(2, time.Minute, func() time.Time { return now })
+
+	// 2 is the least recently seen when 3 arrives.
+	for _, fingerprint := range []uint64{1, 1, 2, 1, 3} {
+		d.Seen(fingerprint, "mismatch")
+	}
+	if !d.Seen(1, "mismatch") {
+		t.Errorf("Expected a recently seen mismatch to be suppressed")
+	}
+	if d.Seen(2, "mismatch") {
+		t.Errorf("Expected the least recently seen mismatch to be evicted")
+	}
+	if logs.String() != "" {
+		t.Errorf("Expected no repeat count within the window, but received '%s'", logs.String())
+	}
+	now = now.Add(time.Minute)
+	if d.Seen(1, "mismatch") {
+		t.Errorf("Expected a mismatch to be reported again after the window")
+	}
+	if n := strings.Count(logs.String(), "Suppressed 3 repeats of: mismatch"); n != 1 {
+		t.Errorf("Expected the repeat count once, but received '%s'", logs.String())
+	}
+}
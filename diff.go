@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	diffLogFile  = flag.String("diff-log", "", "file the diffs of mismatching responses are written to instead of the log")
+	diffMaxBytes = flag.Int("diff.max-bytes", 256, "bytes of bodies that are not JSON shown in a hexdump from where they differ")
+)
+
+// diffContext is the number of unchanged lines around the changes of a hunk.
+const diffContext = 3
+
+// maxDiffCells bounds the table of diffLines, so that large bodies differing
+// throughout take neither quadratic memory nor time. Beyond it, only the sizes
+// of the bodies are shown.
+const maxDiffCells = 1 << 16
+
+// maxDiffSize bounds the size of a logged diff, longer ones are cut off.
+const maxDiffSize = 16 << 10
+
+// mismatchDiff describes how the responses of a mismatching exchange differ:
+// the differing headers, followed by the diff of the comparison if it made
+// one, or else of the decoded bodies if they differ. As diffing bodies is
+// expensive, it is only called for the mismatches logged.
+func mismatchDiff(x *exchange) string {
+	diff := x.Diff
+	if diff == "" && x.BodiesDiffer && x.Alternate != nil {
+		diff = diffResponses(
+			decodedBody(x.ProductionBody, productionHeader(x).Get("Content-Encoding")),
+			decodedBody(x.AlternateBody, x.Alternate.Header.Get("Content-Encoding")))
+	}
+	if x.HeaderDiff != "" {
+		diff = strings.TrimSuffix(x.HeaderDiff+"\n"+diff, "\n")
+	}
+	return capDiff(diff, maxDiffSize)
+}
+
+// capDiff cuts diff off at the end of the last line within limit bytes.
+func capDiff(diff string, limit int) string {
+	if len(diff) <= limit {
+		return diff
+	}
+	cut := strings.LastIndexByte(diff[:limit], '\n')
+	if cut < 0 {
+		cut = limit
+	}
+	return fmt.Sprintf("%s\n... %d more bytes of diff", diff[:cut], len(diff)-cut)
+}
+
+// diffResponses describes how the body b of the alternate response differs
+// from the body a of the production response: as a unified diff of the
+// pretty-printed documents if both are JSON, or else as a hexdump of both
+// from the first differing byte on, up to -diff.max-bytes. Documents too
+// large to diff are only described by their sizes. It returns "" for equal
+// bodies.
+func diffResponses(a, b []byte) string {
+	prettyA, errA := prettyJSON(a)
+	prettyB, errB := prettyJSON(b)
+	if errA == nil && errB == nil {
+		if diff, ok := unifiedDiff(strings.Split(prettyA, "\n"), strings.Split(prettyB, "\n")); ok {
+			return diff
+		}
+		return fmt.Sprintf("bodies differ (%d vs %d bytes)", len(a), len(b))
+	}
+	return byteDiff(a, b, *diffMaxBytes)
+}
+
+// prettyJSON indents a JSON document, with the members of objects sorted.
+func prettyJSON(data []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return "", err
+	}
+	if _, err := decoder.Token(); err == nil {
+		return "", errors.New("data after the JSON document")
+	}
+	pretty, err := json.MarshalIndent(document, "", "  ")
+	return string(pretty), err
+}
+
+// diffLine is a line of a diff: kind is ' ' for an unchanged line, '-' for a
+// removed and '+' for an added one.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// diffLines returns the lines of a and b as an edit script from a to b, or
+// false if the lines between their common prefix and suffix are too many.
+func diffLines(a, b []string) ([]diffLine, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	if (len(a)-prefix-suffix)*(len(b)-prefix-suffix) > maxDiffCells {
+		return nil, false
+	}
+	var lines []diffLine
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{' ', text})
+	}
+	lines = append(lines, lcsDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range common {
+		lines = append(lines, diffLine{' ', text})
+	}
+	return lines, true
+}
+
+// lcsDiff returns an edit script from a to b keeping their longest common
+// subsequence of lines.
+func lcsDiff(a, b []string) []diffLine {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int32, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i, j = i+1, j+1
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{'+', b[j]})
+	}
+	return lines
+}
+
+// unifiedDiff returns the unified diff of the lines a of production and b of
+// the alternate site, or "" if they are equal, and false if they are too large
+// to diff.
+func unifiedDiff(a, b []string) (string, bool) {
+	lines, ok := diffLines(a, b)
+	if !ok {
+		return "", false
+	}
+	// positions[k] holds the lines of a and b before lines[k].
+	positions := make([][2]int, len(lines)+1)
+	for k, line := range lines {
+		positions[k+1] = positions[k]
+		if line.kind != '+' {
+			positions[k+1][0]++
+		}
+		if line.kind != '-' {
+			positions[k+1][1]++
+		}
+	}
+	var out strings.Builder
+	for k := 0; k < len(lines); {
+		first := k
+		for first < len(lines) && lines[first].kind == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		// Changes closer than twice the context share a hunk.
+		end := first + 1
+		for i := end; i < len(lines) && i-end < 2*diffContext; i++ {
+			if lines[i].kind != ' ' {
+				end = i + 1
+			}
+		}
+		from, to := max(first-diffContext, 0), min(end+diffContext, len(lines))
+		if out.Len() == 0 {
+			out.WriteString("--- production\n+++ alternate\n")
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(positions[from][0], positions[to][0]-positions[from][0]),
+			hunkRange(positions[from][1], positions[to][1]-positions[from][1]))
+		for _, line := range lines[from:to] {
+			out.WriteByte(line.kind)
+			out.WriteString(line.text)
+			out.WriteByte('\n')
+		}
+		k = to
+	}
+	return strings.TrimSuffix(out.String(), "\n"), true
+}
+
+// hunkRange formats the range of count lines after the first before lines,
+// as in the header of a hunk.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprint(before + 1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
+
+// byteDiff returns hexdumps of a and b from the line of the first byte where
+// they differ, showing at most limit bytes of each, or "" if they are equal.
+func byteDiff(a, b []byte, limit int) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	if i == len(a) && i == len(b) {
+		return ""
+	}
+	offset := i &^ 15
+	return fmt.Sprintf("bodies differ at byte %d (production %d bytes, alternate %d bytes)\n--- production\n%s+++ alternate\n%s",
+		i, len(a), len(b), hexdump(a, offset, limit), strings.TrimSuffix(hexdump(b, offset, limit), "\n"))
+}
+
+// hexdump dumps at most limit bytes of data from offset on, 16 bytes a line.
+func hexdump(data []byte, offset, limit int) string {
+	var out strings.Builder
+	end := min(len(data), offset+limit)
+	for o := offset; o < end; o += 16 {
+		line := data[o:min(o+16, end)]
+		ascii := append([]byte(nil), line...)
+		for k, c := range ascii {
+			if c < 0x20 || c > 0x7e {
+				ascii[k] = '.'
+			}
+		}
+		fmt.Fprintf(&out, "%08x  %-47s  |%s|\n", o, fmt.Sprintf("% x", line), ascii)
+	}
+	if end < len(data) {
+		fmt.Fprintf(&out, "... %d more bytes\n", len(data)-end)
+	}
+	return out.String()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestDiffResponses(t *testing.T) {
+	setFlag(t, "diff.max-bytes", "32")
+	for _, c := range []struct {
+		a, b, diff string
+	}{
+		{`{"id": 1, "name": "a"}`, `{"name": "a", "id": 1}`, ""},
+		{`{"id": 1, "name": "a", "tags": ["x", "y"]}`, `{"id": 2, "name": "a", "tags": ["x"]}`,
+			`--- production
++++ alternate
+@@ -1,8 +1,7 @@
+ {
+-  "id": 1,
++  "id": 2,
+   "name": "a",
+   "tags": [
+-    "x",
+-    "y"
++    "x"
+   ]
+ }`},
+		// Distant changes get a hunk each.
+		{`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12]`, `[0, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 13]`,
+			`--- production
++++ alternate
+@@ -1,5 +1,5 @@
+ [
+-  1,
++  0,
+   2,
+   3,
+   4,
+@@ -10,5 +10,5 @@
+   9,
+   10,
+   11,
+-  12
++  13
+ ]`},
+		{"same", "same", ""},
+		{"0123456789abcdef-production body, and more", "0123456789abcdef-alternate", `bodies differ at byte 17 (production 42 bytes, alternate 26 bytes)
+--- production
+00000010  2d 70 72 6f 64 75 63 74 69 6f 6e 20 62 6f 64 79  |-production body|
+00000020  2c 20 61 6e 64 20 6d 6f 72 65                    |, and more|
++++ alternate
+00000010  2d 61 6c 74 65 72 6e 61 74 65                    |-alternate|`},
+		{strings.Repeat("a", 100), strings.Repeat("a", 99) + "\x00", `bodies differ at byte 99 (production 100 bytes, alternate 100 bytes)
+--- production
+00000060  61 61 61 61                                      |aaaa|
++++ alternate
+00000060  61 61 61 00                                      |aaa.|`},
+		{"\x01" + strings.Repeat("a", 63), "\x02", `bodies differ at byte 0 (production 64 bytes, alternate 1 bytes)
+--- production
+00000000  01 61 61 61 61 61 61 61 61 61 61 61 61 61 61 61  |.aaaaaaaaaaaaaaa|
+00000010  61 61 61 61 61 61 61 61 61 61 61 61 61 61 61 61  |aaaaaaaaaaaaaaaa|
+... 32 more bytes
++++ alternate
+00000000  02                                               |.|`},
+	} {
+		if diff := diffResponses([]byte(c.a), []byte(c.b)); diff != c.diff {
+			t.Errorf("Expected '%s', but received '%s'", c.diff, diff)
+		}
+	}
+}
+
+func TestLargeDiffsAreSummarizedOrCut(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 300; i++ {
+		a, b = append(a, fmt.Sprint(i)), append(b, fmt.Sprint(1000+i))
+	}
+	prod, alt := "["+strings.Join(a, ",")+"]", "["+strings.Join(b, ",")+"]"
+	expectation := fmt.Sprintf("bodies differ (%d vs %d bytes)", len(prod), len(alt))
+	if diff := diffResponses([]byte(prod), []byte(alt)); diff != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, diff)
+	}
+
+	if diff := capDiff("line 1\nline 2\nline 3", 15); diff != "line 1\nline 2\n... 7 more bytes of diff" {
+		t.Errorf("Expected the diff to be cut after line 2, but received '%s'", diff)
+	}
+	if diff := capDiff("line 1", 15); diff != "line 1" {
+		t.Errorf("Expected '%s', but received '%s'", "line 1", diff)
+	}
+}
+
+func TestDiffIsWrittenToDiffLog(t *testing.T) {
+	production, _ := newBackend(t, `{"id": 1}`)
+	alternate, _ := newBackend(t, `{"id": 2}`)
+	h := newTestHandler(t, production, alternate)
+	diffs := &syncBuffer{}
+	h.DiffLog = log.New(diffs, "", 0)
+	logs := captureLog(t)
+
+	req, id := newRequest("GET", "/item", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+	if strings.Contains(logs.String(), "@@") {
+		t.Errorf("Expected no diff in the log, but received '%s'", logs.String())
+	}
+	if expectation := "-  \"id\": 1\n+  \"id\": 2"; !strings.Contains(diffs.String(), expectation) {
+		t.Errorf("Expected '%s' in the diff log, but received '%s'", expectation, diffs.String())
+	}
+	if !strings.HasPrefix(diffs.String(), "Not equal: GET /item") {
+		t.Errorf("Expected the mismatch before the diff, but received '%s'", diffs.String())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+var dispatchParallel = flag.Bool("dispatch-parallel", false, "hold the production and alternate requests until both are ready and release them together")
+
+var dispatchSkew = newHistogram("dispatch_skew_seconds", []float64{1e-6, 1e-5, 5e-5, 1e-4, 5e-4, .001, .005, .01, .05})
+
+// dispatch measures the skew between the moments the production and the
+// alternate requests of a mirrored request start their round trip, so that
+// latency comparisons are not biased by teeproxy itself. With
+// -dispatch-parallel all requests are held until release.
+type dispatch struct {
+	start chan struct{}
+
+	mu      sync.Mutex
+	first   time.Time
+	started int
+}
+
+func newDispatch() *dispatch {
+	d := &dispatch{}
+	if *dispatchParallel {
+		d.start = make(chan struct{})
+	}
+	return d
+}
+
+// trace returns the request with a trace marking the start of its round trip.
+// Only its first attempt is marked: retries get a connection again, but the
+// request was dispatched then.
+func (d *dispatch) trace(request *http.Request) *http.Request {
+	var once sync.Once
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			once.Do(func() {
+				if d.start != nil {
+					<-d.start
+				}
+				d.mark(time.Now())
+			})
+		},
+	}
+	return request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+}
+
+// release lets held requests start. It must be called once all are
+// dispatched.
+func (d *dispatch) release() {
+	if d.start != nil {
+		close(d.start)
+	}
+}
+
+func (d *dispatch) mark(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started++
+	if d.started == 1 {
+		d.first = t
+		return
+	}
+	dispatchSkew.Observe(t.Sub(d.first).Seconds())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"testing"
+)
+
+func TestDispatchSkewIsSmall(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	for _, parallel := range []string{"false", "true"} {
+		setFlag(t, "dispatch-parallel", parallel)
+		count, sum := dispatchSkew.Count(), dispatchSkew.Sum()
+		const n = 20
+		for i := 0; i < n; i++ {
+			req, id := newRequest("GET", "/", nil)
+			serve(h, req)
+			waitHit(t, prodHits)
+			waitHit(t, altHits)
+			waitComparison(t, logs, id, "Not equal", 1)
+		}
+		if observed := dispatchSkew.Count() - count; observed != n {
+			t.Errorf("Expected '%d' observations, but received '%d'", n, observed)
+		}
+		// The skew of a request may be hit by scheduling, the mean is not.
+		if mean := (dispatchSkew.Sum() - sum) / n; mean > 0.005 {
+			t.Errorf("Expected a mean skew below 5ms with -dispatch-parallel=%s, but received '%f's", parallel, mean)
+		}
+	}
+}
+
+func TestDispatchIsMarkedOncePerRequest(t *testing.T) {
+	d := newDispatch()
+	production := d.trace(httptest.NewRequest("GET", "/", nil))
+	alternate := d.trace(httptest.NewRequest("GET", "/", nil))
+	d.release()
+	count := dispatchSkew.Count()
+
+	// A retry of the production request gets a connection again.
+	for _, req := range []*http.Request{production, alternate, production} {
+		httptrace.ContextClientTrace(req.Context()).GetConn("backend:80")
+	}
+	if d.started != 2 {
+		t.Errorf("Expected '%d' requests dispatched, but received '%d'", 2, d.started)
+	}
+	if n := dispatchSkew.Count() - count; n != 1 {
+		t.Errorf("Expected '%d' skew observed, but received '%d'", 1, n)
+	}
+}
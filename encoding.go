@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+// maxDecodedSize bounds the decoded size of a body when -max-response-size
+// doesn't, so that a small compressed body cannot take all the memory.
+const maxDecodedSize = 64 << 20
+
+// decodedSizeLimit returns the number of bytes a body may be decoded to.
+func decodedSizeLimit() int64 {
+	if *maxResponseSize > 0 {
+		return *maxResponseSize
+	}
+	return maxDecodedSize
+}
+
+// decodeBody returns the identity representation of a body sent with the
+// given Content-Encoding. Multiple codings are undone in reverse order. A body
+// decoding to more than decodedSizeLimit bytes is an error.
+func decodeBody(body []byte, encoding string) ([]byte, error) {
+	limit := decodedSizeLimit()
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		switch coding {
+		case "", "identity":
+			continue
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(bytes.NewReader(body))
+		case "deflate":
+			// "deflate" is zlib-wrapped, but some servers send raw deflate.
+			r, err = zlib.NewReader(bytes.NewReader(body))
+			if err != nil {
+				r, err = flate.NewReader(bytes.NewReader(body)), nil
+			}
+		default:
+			return nil, fmt.Errorf("unsupported content encoding %q", coding)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if body, err = ioutil.ReadAll(io.LimitReader(r, limit+1)); err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > limit {
+			return nil, fmt.Errorf("%s body larger than %d bytes when decoded", coding, limit)
+		}
+	}
+	return body, nil
+}
+
+// decodedBody is like decodeBody, but falls back to the body as is when it
+// cannot be decoded, e.g. when it is too large decoded. It is then compared
+// encoded, unequal to any other body than the same encoded one.
+func decodedBody(body []byte, encoding string) []byte {
+	decoded, err := decodeBody(body, encoding)
+	if err != nil {
+		if *debug {
+			log.Println("Comparing undecoded body:", err)
+		}
+		return body
+	}
+	return decoded
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func compress(t *testing.T, body string, newWriter func(io.Writer) io.WriteCloser) []byte {
+	var b bytes.Buffer
+	w := newWriter(&b)
+	w.Write([]byte(body))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func gzipped(t *testing.T, body string) []byte {
+	return compress(t, body, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := `{"a": 1}`
+	for encoding, encoded := range map[string][]byte{
+		"":         []byte(body),
+		"identity": []byte(body),
+		"gzip":     gzipped(t, body),
+		"deflate":  compress(t, body, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		"Deflate": compress(t, body, func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}),
+		"deflate, gzip": gzipped(t, string(compress(t, body, func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }))),
+	} {
+		decoded, err := decodeBody(encoded, encoding)
+		if err != nil {
+			t.Errorf("Expected no error for '%s', but received '%s'", encoding, err)
+		}
+		if string(decoded) != body {
+			t.Errorf("Expected '%s' for '%s', but received '%s'", body, encoding, decoded)
+		}
+	}
+	if _, err := decodeBody([]byte(body), "compress"); err == nil {
+		t.Errorf("Expected an error for an unsupported encoding")
+	}
+}
+
+func TestDecodedBodySizeIsLimited(t *testing.T) {
+	setFlag(t, "max-response-size", "10")
+	body := "a body longer than ten bytes"
+	if _, err := decodeBody(gzipped(t, body), "gzip"); err == nil {
+		t.Errorf("Expected an error for a body beyond the limit")
+	}
+	if compareResp([]byte(body), nil, alternateResponse(http.Header{"Content-Encoding": {"gzip"}}, gzipped(t, body))) {
+		t.Errorf("Expected a body beyond the limit not to be compared decoded")
+	}
+	if decoded, err := decodeBody(gzipped(t, "short"), "gzip"); err != nil || string(decoded) != "short" {
+		t.Errorf("Expected '%s', but received '%s' (%v)", "short", decoded, err)
+	}
+}
+
+func alternateResponse(header http.Header, body []byte) *http.Response {
+	return &http.Response{StatusCode: 200, Header: header, Body: ioutil.NopCloser(bytes.NewReader(body))}
+}
+
+func TestCompareAcrossContentEncodings(t *testing.T) {
+	if !compareResp([]byte(`{"a": 1}`), nil, alternateResponse(http.Header{"Content-Encoding": {"gzip"}}, gzipped(t, `{"a": 1}`))) {
+		t.Errorf("Expected a gzipped alternate body to equal the plain production body")
+	}
+	if compareResp([]byte(`{"a": 1}`), nil, alternateResponse(http.Header{"Content-Encoding": {"gzip"}}, gzipped(t, `{"a": 2}`))) {
+		t.Errorf("Expected differing bodies to be unequal")
+	}
+	if !compareResp(gzipped(t, "same"), http.Header{"Content-Encoding": {"gzip"}}, alternateResponse(http.Header{}, []byte("same"))) {
+		t.Errorf("Expected a gzipped production body to equal the plain alternate body")
+	}
+}
+
+func TestGzippedProductionIsForwardedAndComparedDecoded(t *testing.T) {
+	body := gzipped(t, `{"id": 1, "tags": ["a", "b"]}`)
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body)
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, `{"tags": ["a", "b"], "id": 1}`)
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	req, id := newRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	recorder := serve(h, req)
+	if !bytes.Equal(recorder.Body.Bytes(), body) {
+		t.Errorf("Expected the gzipped body '%x', but received '%x'", body, recorder.Body.Bytes())
+	}
+	if encoding := recorder.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("Expected '%s', but received '%s'", "gzip", encoding)
+	}
+	waitComparison(t, logs, id, "Equal", 1)
+	if countComparisons(logs, id, "Not equal") != 0 {
+		t.Errorf("Expected the decoded bodies to be equal, but received '%s'", logs.String())
+	}
+}
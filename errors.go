@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+var (
+	maintenancePage       = flag.String("maintenance-page", "", "path to an HTML page served while the production backend is unreachable")
+	maintenanceStatus     = flag.Int("maintenance-status", http.StatusServiceUnavailable, "status code of the -maintenance-page")
+	maintenanceRetryAfter = flag.Int("maintenance-retry-after", 30, "seconds sent in the Retry-After header of the -maintenance-page, 0 omits it")
+	requestIDHeader       = flag.String("request-id-header", "X-Request-Id", "header holding the ID of a request, honored when sent by the client, forwarded to the backends and echoed in the response; empty always generates one and passes none on")
+)
+
+// newRequestID returns a random identifier used to correlate a request with
+// the log lines it produces.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Println("Failed to generate request ID:", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// maxRequestIDLength bounds the incoming request IDs honored by requestID.
+const maxRequestIDLength = 128
+
+// requestID returns the ID of req in the -request-id-header, or a new one if
+// it has none. Incoming IDs that are too long, or hold other characters than
+// printable ASCII, are replaced, as they end up in log lines.
+func requestID(req *http.Request) string {
+	if *requestIDHeader == "" {
+		return newRequestID()
+	}
+	id := req.Header.Get(*requestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		return newRequestID()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// loggedRequestID returns " (request id ...)" with the ID a request forwarded
+// to a backend carries in the -request-id-header, for the log lines about it,
+// or "" if it carries none.
+func loggedRequestID(req *http.Request) string {
+	if *requestIDHeader == "" || req.Header.Get(*requestIDHeader) == "" {
+		return ""
+	}
+	return " (request id " + req.Header.Get(*requestIDHeader) + ")"
+}
+
+// errorResponse is the JSON body of errors returned by teeproxy itself, as
+// opposed to errors returned by the production backend.
+type errorResponse struct {
+	Status    int    `json:"status"`
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// writeError replies to the client with an error originating in teeproxy and
+// logs it under the request ID. The body format follows -error-format.
+func writeError(w http.ResponseWriter, status int, requestID string, reason string) {
+	log.Printf("Request %s failed with %d: %s", requestID, status, reason)
+
+	var body []byte
+	if *errorFormat == "plain" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(fmt.Sprintf("%d %s: %s (request id %s)\n",
+			status, http.StatusText(status), reason, requestID))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ = json.Marshal(errorResponse{Status: status, Error: reason, RequestID: requestID})
+		body = append(body, '\n')
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// serveMaintenancePage replies with the -maintenance-page and reports whether
+// it could be read. The page is read on every use, so it can be changed
+// without a restart.
+func serveMaintenancePage(w http.ResponseWriter, requestID string) bool {
+	page, err := ioutil.ReadFile(*maintenancePage)
+	if err != nil {
+		log.Printf("Request %s: failed to read the maintenance page: %s", requestID, err)
+		return false
+	}
+	log.Printf("Request %s failed with %d: production backend unavailable, serving the maintenance page",
+		requestID, *maintenanceStatus)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if *maintenanceRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(*maintenanceRetryAfter))
+	}
+	w.WriteHeader(*maintenanceStatus)
+	w.Write(page)
+	return true
+}
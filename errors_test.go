@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendDownReturnsErrorWithRequestID(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	production.Close()
+	logs := captureLog(t)
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, recorder.Code)
+	}
+	if expectation := "application/json"; recorder.Header().Get("Content-Type") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Header().Get("Content-Type"))
+	}
+	var body errorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Expected a JSON body, but received '%s'", recorder.Body.String())
+	}
+	if body.RequestID == "" {
+		t.Errorf("Expected a request ID, but received '%s'", recorder.Body.String())
+	}
+	if body.Status != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, body.Status)
+	}
+	if !strings.Contains(logs.String(), body.RequestID) {
+		t.Errorf("Expected the log to contain '%s', but received '%s'", body.RequestID, logs.String())
+	}
+	if recorder.Header().Get("X-Request-Id") != body.RequestID {
+		t.Errorf("Expected '%s', but received '%s'", body.RequestID, recorder.Header().Get("X-Request-Id"))
+	}
+}
+
+func TestRequestIDIsEchoed(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "different")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	generated := recorder.Header().Get("X-Request-Id")
+	if len(generated) != 32 {
+		t.Errorf("Expected a generated request ID, but received '%s'", generated)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "client-42")
+	recorder = serve(h, req)
+	if id := recorder.Header().Get("X-Request-Id"); id != "client-42" {
+		t.Errorf("Expected '%s', but received '%s'", "client-42", id)
+	}
+	waitLog(t, logs, "(request id client-42)", 1)
+
+	for _, invalid := range []string{"with space", strings.Repeat("x", maxRequestIDLength+1)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-Id", invalid)
+		if id := serve(h, req).Header().Get("X-Request-Id"); id == invalid || id == "" {
+			t.Errorf("Expected '%s' to be replaced, but received '%s'", invalid, id)
+		}
+	}
+
+	setFlag(t, "request-id-header", "")
+	if id := serve(h, httptest.NewRequest("GET", "/", nil)).Header().Get("X-Request-Id"); id != "" {
+		t.Errorf("Expected no request ID, but received '%s'", id)
+	}
+}
+
+func TestRequestIDIsForwarded(t *testing.T) {
+	production, prodHits := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "request-id-header", "X-Correlation-Id")
+	logs := captureLog(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Correlation-Id", "client-42")
+	serve(h, req)
+	for name, hits := range map[string]chan *http.Request{"production": prodHits, "alternate": altHits} {
+		if id := waitHit(t, hits).Header.Get("X-Correlation-Id"); id != "client-42" {
+			t.Errorf("Expected '%s' forwarded to %s, but received '%s'", "client-42", name, id)
+		}
+	}
+	waitLog(t, logs, "Equal: alternate "+hostOf(alternate)+" (request id client-42)", 1)
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	generated := recorder.Header().Get("X-Correlation-Id")
+	for name, hits := range map[string]chan *http.Request{"production": prodHits, "alternate": altHits} {
+		if id := waitHit(t, hits).Header.Get("X-Correlation-Id"); id != generated {
+			t.Errorf("Expected '%s' forwarded to %s, but received '%s'", generated, name, id)
+		}
+	}
+	waitLog(t, logs, "(request id "+generated+")", 1)
+}
+
+func TestNoGoroutinesLeakWhenProductionIsDown(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	production.Close()
+	captureLog(t)
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		if code := serve(h, httptest.NewRequest("GET", "/", nil)).Code; code != http.StatusBadGateway {
+			t.Fatalf("Expected '%d', but received '%d'", http.StatusBadGateway, code)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		// Idle keep-alive connections have goroutines of their own.
+		alternateTransport.CloseIdleConnections()
+		n := runtime.NumGoroutine()
+		if n <= baseline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected at most '%d' goroutines, but received '%d'", baseline, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPlainErrorFormat(t *testing.T) {
+	setFlag(t, "error-format", "plain")
+	captureLog(t)
+
+	recorder := httptest.NewRecorder()
+	writeError(recorder, http.StatusServiceUnavailable, "abc123", "overloaded")
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if expectation := "text/plain; charset=utf-8"; recorder.Header().Get("Content-Type") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Header().Get("Content-Type"))
+	}
+	if expectation := "503 Service Unavailable: overloaded (request id abc123)\n"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+}
+
+func TestMaintenancePageWhenProductionIsDown(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	production.Close()
+	captureLog(t)
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	ioutil.WriteFile(page, []byte("<h1>Back soon</h1>"), 0644)
+	setFlag(t, "maintenance-page", page)
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if expectation := "<h1>Back soon</h1>"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	if expectation := "30"; recorder.Header().Get("Retry-After") != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Header().Get("Retry-After"))
+	}
+
+	// An unreadable page falls back to the error response.
+	setFlag(t, "maintenance-page", page+".missing")
+	if recorder := serve(h, httptest.NewRequest("GET", "/", nil)); recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, recorder.Code)
+	}
+}
+
+func TestMaintenancePageWhenProductionIsUnhealthy(t *testing.T) {
+	healthy := int32(0)
+	production, prodHits := newFlappingBackend(t, "production", &healthy)
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	h.Health = newHealthChecker("/healthz", 5*time.Millisecond, time.Second, 1, 1)
+	h.Health.Watch(hostOf(production), "http", http.DefaultTransport)
+	defer h.Health.Close()
+	captureLog(t)
+	page := filepath.Join(t.TempDir(), "maintenance.html")
+	ioutil.WriteFile(page, []byte("<h1>Back soon</h1>"), 0644)
+	setFlag(t, "maintenance-page", page)
+	waitHealth(t, h.Health, hostOf(production), false)
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if expectation := "<h1>Back soon</h1>"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	expectNoHit(t, prodHits)
+	expectNoHit(t, altHits)
+
+	atomic.StoreInt32(&healthy, 1)
+	waitHealth(t, h.Health, hostOf(production), true)
+	if recorder := serve(h, httptest.NewRequest("GET", "/", nil)); recorder.Body.String() != "production" {
+		t.Errorf("Expected '%s', but received '%s'", "production", recorder.Body.String())
+	}
+}
+
+func TestBothBackendsTimingOutReturnsGatewayTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := func() *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	production, alternate := slow(), slow()
+	defer close(release)
+	setFlag(t, "a.timeout", "50")
+	setFlag(t, "b.timeout", "50")
+	h := newTestHandler(t, production, alternate)
+	captureLog(t)
+	timeouts := bothTimeouts.Value()
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusGatewayTimeout, recorder.Code)
+	}
+	var body errorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || body.RequestID == "" {
+		t.Errorf("Expected a JSON body with a request ID, but received '%s'", recorder.Body.String())
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for bothTimeouts.Value() == timeouts && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := bothTimeouts.Value() - timeouts; n != 1 {
+		t.Errorf("Expected '%d' double timeouts, but received '%d'", 1, n)
+	}
+}
+
+func TestOversizedResponse(t *testing.T) {
+	production, _ := newBackend(t, strings.Repeat("x", 100))
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "max-response-size", "10")
+	logs := captureLog(t)
+	oversized := oversizedResponses.Value()
+
+	// The comparisons read -max-response-size too, so they are awaited before
+	// the flag is changed. The 502 leaves nothing to compare.
+	req, id := newRequest("GET", "/", nil)
+	recorder := serve(h, req)
+	if expectation := strings.Repeat("x", 10); recorder.Code != 200 || recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%d %s'", expectation, recorder.Code, recorder.Body.String())
+	}
+	waitComparison(t, logs, id, "Not equal", 1)
+
+	setFlag(t, "max-response-size.action", "error")
+	if recorder := serve(h, httptest.NewRequest("GET", "/", nil)); recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadGateway, recorder.Code)
+	}
+	if n := oversizedResponses.Value() - oversized; n != 2 {
+		t.Errorf("Expected '%d' oversized responses, but received '%d'", 2, n)
+	}
+
+	setFlag(t, "max-response-size", "100")
+	req, id = newRequest("GET", "/", nil)
+	if recorder := serve(h, req); recorder.Body.Len() != 100 {
+		t.Errorf("Expected the full body, but received '%d' bytes", recorder.Body.Len())
+	}
+	waitComparison(t, logs, id, "Not equal", 1)
+}
+
+func TestShortRequestBodyIsRejected(t *testing.T) {
+	production, hits := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "body-read-timeout", "200")
+	captureLog(t)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", hostOf(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 1000\r\n\r\nshort")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusBadRequest, resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected a prompt rejection, but it took '%s'", elapsed)
+	}
+	expectNoHit(t, hits)
+}
+
+func TestServerTimeoutAnswersClientWhileComparisonCompletes(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("production"))
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	h.ServerTimeout = 50 * time.Millisecond
+	setFlag(t, "error-format", "json")
+
+	start := time.Now()
+	req, id := newRequest("GET", "/slow", nil)
+	recorder := serve(h, req)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("Expected the client to be answered after the server timeout, but it took '%s'", elapsed)
+	}
+	var response errorResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected a JSON error, but received '%s'", recorder.Body.String())
+	}
+	if response.RequestID != id || response.Error != "request timed out" {
+		t.Errorf("Expected '%s' for request '%s', but received '%+v'", "request timed out", id, response)
+	}
+	waitComparison(t, logs, id, "Not equal", 1)
+}
+
+func TestResponseHeaderConflict(t *testing.T) {
+	for policy, expectation := range map[string][]string{
+		"backend":  {"backend"},
+		"teeproxy": {"teeproxy"},
+		"append":   {"teeproxy", "backend"},
+	} {
+		setFlag(t, "response-header-conflict", policy)
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"X-Served-By": {"backend"}, "X-Backend-Only": {"1"}},
+			Body:       ioutil.NopCloser(strings.NewReader("body")),
+		}
+		recorder := httptest.NewRecorder()
+		recorder.Header().Set("X-Served-By", "teeproxy")
+		processResponse(resp, nil, recorder, "id")
+		if received := recorder.Header()["X-Served-By"]; strings.Join(received, ",") != strings.Join(expectation, ",") {
+			t.Errorf("Expected '%s' for '%s', but received '%s'", expectation, policy, received)
+		}
+		if received := recorder.Header().Get("X-Backend-Only"); received != "1" {
+			t.Errorf("Expected '%s', but received '%s'", "1", received)
+		}
+	}
+}
+
+func TestHangingProductionBodyTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first chunk"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer production.Close()
+	defer close(release)
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.body-timeout", "100")
+	captureLog(t)
+
+	start := time.Now()
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusGatewayTimeout, recorder.Code)
+	}
+	if !strings.Contains(recorder.Body.String(), "production response body timed out") {
+		t.Errorf("Expected a body timeout error, but received '%s'", recorder.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the body timeout to fire, but the request took '%s'", elapsed)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	compareExec         = flag.String("compare.exec", "", "command comparing the production and alternate bodies, given as file names; exit status 0 means equal, the output describes the difference")
+	compareExecTimeout  = flag.Int("compare.exec-timeout", 5000, "timeout in milliseconds for -compare.exec")
+	compareExecParallel = flag.Int("compare.exec-parallel", 4, "-compare.exec commands running at the same time")
+)
+
+// execComparator compares responses with an external command, running a
+// bounded number of commands at the same time.
+type execComparator struct {
+	command []string
+	timeout time.Duration
+	slots   chan struct{}
+}
+
+// newExecComparator returns a comparator running command, split into the
+// program and its arguments at white space. It fails if there is no program.
+func newExecComparator(command string, timeout time.Duration, parallel int) (*execComparator, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, errors.New("no command given")
+	}
+	return &execComparator{
+		command: fields,
+		timeout: timeout,
+		slots:   make(chan struct{}, max(parallel, 1)),
+	}, nil
+}
+
+// compareExchange compares the responses of the exchange with the external
+// command, or with compareResp if c is nil. The command's output for
+// unequal responses is stored in x.Diff.
+func (c *execComparator) compareExchange(x *exchange) bool {
+	if c == nil || x.Alternate == nil {
+		return compareResp(x.ProductionBody, productionHeader(x), x.Alternate)
+	}
+	altBody, _ := ioutil.ReadAll(x.Alternate.Body)
+	x.Alternate.Body.Close()
+	x.Alternate.Body = ioutil.NopCloser(bytes.NewReader(altBody))
+
+	equal, diff, err := c.run(
+		decodedBody(x.ProductionBody, productionHeader(x).Get("Content-Encoding")),
+		decodedBody(altBody, x.Alternate.Header.Get("Content-Encoding")))
+	if err != nil {
+		log.Printf("Comparison command failed for request %s, falling back to the default comparison: %s", x.RequestID, err)
+		return compareResp(x.ProductionBody, productionHeader(x), x.Alternate)
+	}
+	x.Diff = diff
+	return equal
+}
+
+// run runs the command with the names of temporary files holding the two
+// bodies appended to its arguments. It returns the output of the command if
+// it exits with a non-zero status, and an error if it can't be run or times
+// out.
+func (c *execComparator) run(prodBody, altBody []byte) (equal bool, diff string, err error) {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+
+	args := append([]string(nil), c.command...)
+	for _, body := range [][]byte{prodBody, altBody} {
+		file, err := ioutil.TempFile("", "teeproxy-body-")
+		if err != nil {
+			return false, "", err
+		}
+		defer os.Remove(file.Name())
+		_, err = file.Write(body)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return false, "", err
+		}
+		args = append(args, file.Name())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Don't wait for children of a killed command to close its output.
+	cmd.WaitDelay = 100 * time.Millisecond
+	output, err := cmd.Output()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return false, "", ctx.Err()
+	case errors.As(err, &exitErr):
+		return false, strings.TrimSpace(string(output)), nil
+	case err != nil:
+		return false, "", err
+	}
+	return true, "", nil
+}
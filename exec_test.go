@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeScript writes an executable shell script for the test.
+func writeScript(t *testing.T, script string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "compare.sh")
+	if err := ioutil.WriteFile(name, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestExternalComparisonCommand(t *testing.T) {
+	// Equal when the first lines match.
+	script := writeScript(t, `
+[ "$(head -n 1 "$1")" = "$(head -n 1 "$2")" ] && exit 0
+echo "first lines differ: $(head -n 1 "$1") != $(head -n 1 "$2")"
+exit 1
+`)
+	production, _ := newBackend(t, "same\nproduction")
+	for _, c := range []struct {
+		alternate, result, output string
+	}{
+		{"same\nalternate", "Equal", ""},
+		{"other\nalternate", "Not equal", "\nfirst lines differ: same != other"},
+	} {
+		alternate, _ := newBackend(t, c.alternate)
+		h := newTestHandler(t, production, alternate)
+		var err error
+		if h.Exec, err = newExecComparator(script, time.Second, 1); err != nil {
+			t.Fatal(err)
+		}
+		logs := captureLog(t)
+		req, id := newRequest("GET", "/", nil)
+		serve(h, req)
+		waitComparison(t, logs, id, c.result, 1)
+		if c.output != "" {
+			waitLog(t, logs, c.output, 1)
+		}
+	}
+}
+
+func TestExternalComparisonCommandTimeout(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	var err error
+	if h.Exec, err = newExecComparator(writeScript(t, "sleep 5\n"), 50*time.Millisecond, 1); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitLog(t, logs, "falling back to the default comparison", 1)
+	waitComparison(t, logs, id, "Equal", 1)
+}
+
+func TestExternalComparisonCommandIsRequired(t *testing.T) {
+	for _, command := range []string{"", " \t "} {
+		if _, err := newExecComparator(command, time.Second, 1); err == nil {
+			t.Errorf("Expected an error for '%s'", command)
+		}
+	}
+}
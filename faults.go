@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var alternateFaults faultFlag
+
+var injectedFaults = expvar.NewMap("injected_faults")
+
+func init() {
+	flag.Var(&alternateFaults, "b.fault-inject", "faults injected into alternate responses before comparison, as 'FAULT=PERCENT,...' with the faults truncate, status and drop")
+}
+
+// Faults injected into alternate responses. They only affect the comparison,
+// never the client. Statuses are not compared otherwise, but an injected one
+// makes a mismatch.
+const (
+	faultTruncate = "truncate" // cut the body in half
+	faultStatus   = "status"   // turn a 2xx status into 503 and any other into 200
+	faultDrop     = "drop"     // discard the response, as if the request failed
+)
+
+type fault struct {
+	Name    string
+	Percent float64
+}
+
+// faultFlag is a list of faults, each injected into the given percentage of
+// alternate responses. At most one fault is injected per response.
+type faultFlag []fault
+
+func (f *faultFlag) String() string {
+	var s []string
+	for _, fault := range *f {
+		s = append(s, fault.Name+"="+strconv.FormatFloat(fault.Percent, 'f', -1, 64))
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *faultFlag) Set(value string) error {
+	var parsed faultFlag
+	total := 0.0
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return fmt.Errorf("expected 'FAULT=PERCENT', got %q", pair)
+		}
+		name := strings.TrimSpace(pair[:i])
+		if name != faultTruncate && name != faultStatus && name != faultDrop {
+			return fmt.Errorf("unknown fault %q", name)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(pair[i+1:]), 64)
+		if err != nil {
+			return err
+		}
+		if v < 0 {
+			return fmt.Errorf("percentage %v is negative", v)
+		}
+		total += v
+		parsed = append(parsed, fault{name, v})
+	}
+	if total > 100 {
+		return fmt.Errorf("percentages add up to %v, more than 100", total)
+	}
+	*f = parsed
+	return nil
+}
+
+// choose returns the fault to inject for a uniform random number r in
+// [0, 1), or "" for none.
+func (f faultFlag) choose(r float64) string {
+	for _, fault := range f {
+		if r*100 < fault.Percent {
+			return fault.Name
+		}
+		r -= fault.Percent / 100
+	}
+	return ""
+}
+
+// injectFault applies a fault chosen with the uniform random number r to the
+// alternate response of the exchange, if any, and returns it.
+func injectFault(x *exchange, r float64) string {
+	if x.Alternate == nil {
+		return ""
+	}
+	name := alternateFaults.choose(r)
+	switch name {
+	case faultTruncate:
+		body, _ := ioutil.ReadAll(x.Alternate.Body)
+		x.Alternate.Body.Close()
+		body = body[:len(body)/2]
+		x.Alternate.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if x.AlternateBody != nil {
+			x.AlternateBody = body
+		}
+	case faultStatus:
+		if x.Alternate.StatusCode >= 200 && x.Alternate.StatusCode < 300 {
+			x.Alternate.StatusCode = http.StatusServiceUnavailable
+		} else {
+			x.Alternate.StatusCode = 200
+		}
+	case faultDrop:
+		io.Copy(ioutil.Discard, x.Alternate.Body)
+		x.Alternate.Body.Close()
+		x.Alternate = nil
+	default:
+		return ""
+	}
+	injectedFaults.Add(name, 1)
+	return name
+}
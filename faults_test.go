@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultFlag(t *testing.T) {
+	var f faultFlag
+	if err := f.Set("truncate=10, status=2.5"); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := "truncate=10,status=2.5"; f.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, f.String())
+	}
+	for _, invalid := range []string{"truncate", "corrupt=1", "drop=x", "drop=-1", "drop=60,status=50"} {
+		if err := f.Set(invalid); err == nil {
+			t.Errorf("Expected an error for '%s'", invalid)
+		}
+	}
+	if err := f.Set(""); err != nil || len(f) != 0 {
+		t.Errorf("Expected no faults, but received '%v' (%v)", f, err)
+	}
+}
+
+func TestFaultsAreInjectedAtConfiguredPercentage(t *testing.T) {
+	setFlag(t, "b.fault-inject", "truncate=10,status=20,drop=30")
+	random := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[alternateFaults.choose(random.Float64())]++
+	}
+	for name, expectation := range map[string]float64{faultTruncate: 10, faultStatus: 20, faultDrop: 30, "": 40} {
+		if percent := float64(counts[name]) / 100; math.Abs(percent-expectation) > 1.5 {
+			t.Errorf("Expected '%s' in %v%% of responses, but received %v%%", name, expectation, percent)
+		}
+	}
+}
+
+func TestInjectedFaultsOnlyAffectComparison(t *testing.T) {
+	production, _ := newBackend(t, "same body")
+	alternate, _ := newBackend(t, "same body")
+	h := newTestHandler(t, production, alternate)
+
+	for _, c := range []struct {
+		fault, log string
+	}{
+		{"truncate=100", "alternate " + hostOf(alternate) + " 200"},
+		// The bodies are equal, but the injected status is a mismatch.
+		{"status=100", "alternate " + hostOf(alternate) + " 503"},
+		{"drop=100", ""},
+	} {
+		setFlag(t, "b.fault-inject", c.fault)
+		logs := captureLog(t)
+		injected := injectedFaults.String()
+		req, id := newRequest("GET", "/"+c.fault[:strings.Index(c.fault, "=")], nil)
+		recorder := serve(h, req)
+		if expectation := "same body"; recorder.Body.String() != expectation || recorder.Code != 200 {
+			t.Errorf("Expected '%s', but received '%d %s'", expectation, recorder.Code, recorder.Body.String())
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for injectedFaults.String() == injected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if injectedFaults.String() == injected {
+			t.Errorf("Expected the '%s' fault to be counted", c.fault)
+		}
+		if c.log != "" {
+			waitComparison(t, logs, id, "Not equal", 1)
+			if !strings.Contains(logs.String(), c.log) {
+				t.Errorf("Expected '%s', but received '%s'", c.log, logs.String())
+			}
+			continue
+		}
+		time.Sleep(100 * time.Millisecond)
+		if n := countComparisons(logs, id, "Equal") + countComparisons(logs, id, "Not equal"); n != 0 {
+			t.Errorf("Expected no comparison of a dropped response, but received '%s'", logs.String())
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var (
+	comparedHeaders    headerNames
+	ignoredHeaders     headerNames
+	productionStripped headerNames
+	alternateStripped  headerNames
+	alternateAdded     = make(addedHeaders)
+	shadowHeader       = flag.Bool("b.shadow-header", true, "add 'X-Teeproxy-Shadow: true' to alternate requests, for the alternate sites to tell them apart")
+)
+
+var headerMismatches = expvar.NewInt("header_mismatches")
+
+// defaultIgnoredHeaders are the headers that differ between responses without
+// telling anything about the sites, or that are normalized before comparison.
+const defaultIgnoredHeaders = "Age,Connection,Content-Encoding,Content-Length,Date,Expires,Keep-Alive,Set-Cookie,Transfer-Encoding"
+
+func init() {
+	ignoredHeaders.Set(defaultIgnoredHeaders)
+	flag.Var(&comparedHeaders, "compare-headers", "comma-separated response headers compared besides the body, or * for all; disabled when empty")
+	flag.Var(&ignoredHeaders, "compare-headers.ignore", "comma-separated response headers never compared, even with -compare-headers *")
+	flag.Var(&productionStripped, "a.strip-headers", "comma-separated request headers removed before forwarding to production")
+	flag.Var(&alternateStripped, "b.strip-headers", "comma-separated request headers removed before mirroring to the alternate sites, e.g. 'Authorization,X-Internal-Token'")
+	flag.Var(alternateAdded, "b.add-header", "header added to alternate requests, as 'Name: Value', can be repeated")
+}
+
+// headerNames is a flag value of header names, given comma-separated. The
+// names are canonicalized, and * stands for every header.
+type headerNames map[string]bool
+
+func (n *headerNames) String() string {
+	return strings.Join(sortedKeys(*n), ",")
+}
+
+func (n *headerNames) Set(value string) error {
+	parsed := make(headerNames)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			parsed[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	*n = parsed
+	return nil
+}
+
+// Contains reports whether name is one of the names.
+func (n headerNames) Contains(name string) bool {
+	return n["*"] || n[http.CanonicalHeaderKey(name)]
+}
+
+// addedHeaders is a flag value of headers, given as 'Name: Value' by
+// repeating the flag.
+type addedHeaders http.Header
+
+func (a addedHeaders) String() string {
+	var s []string
+	for _, name := range sortedKeys(a) {
+		for _, value := range a[name] {
+			s = append(s, name+": "+value)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (a addedHeaders) Set(value string) error {
+	name, v, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("expected 'Name: Value', got %q", value)
+	}
+	http.Header(a).Add(name, strings.TrimSpace(v))
+	return nil
+}
+
+// shadowHeaderName marks the alternate requests, see -b.shadow-header.
+const shadowHeaderName = "X-Teeproxy-Shadow"
+
+// addAlternateHeaders adds the -b.add-header headers and the shadow header to
+// the header of an alternate request.
+func addAlternateHeaders(header http.Header) {
+	for name, values := range alternateAdded {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	if *shadowHeader {
+		header.Set(shadowHeaderName, "true")
+	}
+}
+
+// stripHeaders removes the names from header.
+func stripHeaders(header http.Header, names headerNames) {
+	for name := range names {
+		delete(header, name)
+	}
+}
+
+// diffHeaders describes how the compared headers of the alternate response
+// differ from those of the production response, a line per header only one
+// of them has or with differing values, or returns "" if they agree.
+func diffHeaders(prod, alt http.Header) string {
+	if len(comparedHeaders) == 0 {
+		return ""
+	}
+	compared := func(name string) bool {
+		return comparedHeaders.Contains(name) && !ignoredHeaders[http.CanonicalHeaderKey(name)]
+	}
+	var lines []string
+	for _, name := range sortedKeys(alt) {
+		if !compared(name) {
+			continue
+		}
+		if values, ok := prod[name]; !ok {
+			lines = append(lines, fmt.Sprintf("+ header %s: %q", name, strings.Join(alt[name], ", ")))
+		} else if a, b := strings.Join(values, ", "), strings.Join(alt[name], ", "); a != b {
+			lines = append(lines, fmt.Sprintf("~ header %s: %q -> %q", name, a, b))
+		}
+	}
+	for _, name := range sortedKeys(prod) {
+		if _, ok := alt[name]; !ok && compared(name) {
+			lines = append(lines, fmt.Sprintf("- header %s: %q", name, strings.Join(prod[name], ", ")))
+		}
+	}
+	if len(lines) > 0 {
+		headerMismatches.Add(1)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newHeaderBackend(t *testing.T, header http.Header) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Write([]byte(`{"id": 1}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDivergentHeaderIsMismatch(t *testing.T) {
+	production := newHeaderBackend(t, http.Header{
+		"Cache-Control": {"max-age=60"},
+		"Set-Cookie":    {"session=a"},
+		"X-Removed":     {"1"},
+	})
+	alternate := newHeaderBackend(t, http.Header{
+		"Cache-Control": {"no-cache"},
+		"Set-Cookie":    {"session=b"},
+		"X-Added":       {"1"},
+	})
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	mismatches := headerMismatches.Value()
+
+	// Headers are not compared by default.
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+
+	setFlag(t, "compare-headers", "*")
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+	expectation := `~ header Cache-Control: "max-age=60" -> "no-cache"
++ header X-Added: "1"
+- header X-Removed: "1"`
+	if !strings.Contains(logs.String(), expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, logs.String())
+	}
+	if strings.Contains(logs.String(), "Set-Cookie") || strings.Contains(logs.String(), "Date") {
+		t.Errorf("Expected the volatile headers to be ignored, but received '%s'", logs.String())
+	}
+	if n := headerMismatches.Value() - mismatches; n != 1 {
+		t.Errorf("Expected '%d' header mismatches, but received '%d'", 1, n)
+	}
+
+	setFlag(t, "compare-headers", "content-type,x-removed")
+	setFlag(t, "compare-headers.ignore", "X-Removed")
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+}
+
+func TestStripHeaders(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.strip-headers", "X-Debug")
+	setFlag(t, "b.strip-headers", "authorization, X-Internal-Token")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Internal-Token", "token")
+	req.Header.Set("X-Debug", "1")
+	serve(h, req)
+	for _, c := range []struct {
+		hits            chan *http.Request
+		present, absent []string
+	}{
+		{prodHits, []string{"Authorization", "X-Internal-Token"}, []string{"X-Debug"}},
+		{altHits, []string{"X-Debug"}, []string{"Authorization", "X-Internal-Token"}},
+		{nil, []string{"Authorization", "X-Internal-Token", "X-Debug"}, nil},
+	} {
+		header := req.Header
+		if c.hits != nil {
+			header = waitHit(t, c.hits).Header
+		}
+		for _, name := range c.present {
+			if header.Get(name) == "" {
+				t.Errorf("Expected '%s', but received none", name)
+			}
+		}
+		for _, name := range c.absent {
+			if value := header.Get(name); value != "" {
+				t.Errorf("Expected no '%s', but received '%s'", name, value)
+			}
+		}
+	}
+}
+
+func TestAlternateHeadersAreAdded(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	alternateAdded.Set("X-Env: test")
+	alternateAdded.Set("X-Env: shadow")
+	t.Cleanup(func() { delete(alternateAdded, "X-Env") })
+
+	for _, shadow := range []string{"true", "false"} {
+		setFlag(t, "b.shadow-header", shadow)
+		serve(h, httptest.NewRequest("GET", "/", nil))
+		prod, alt := waitHit(t, prodHits).Header, waitHit(t, altHits).Header
+		if values := alt.Values("X-Env"); strings.Join(values, ",") != "test,shadow" {
+			t.Errorf("Expected '%s', but received '%s'", "test,shadow", values)
+		}
+		expected := ""
+		if shadow == "true" {
+			expected = "true"
+		}
+		if value := alt.Get("X-Teeproxy-Shadow"); value != expected {
+			t.Errorf("Expected '%s', but received '%s'", expected, value)
+		}
+		if prod.Get("X-Env") != "" || prod.Get("X-Teeproxy-Shadow") != "" {
+			t.Errorf("Expected no added headers, but received '%v'", prod)
+		}
+	}
+	if err := alternateAdded.Set("no value"); err == nil {
+		t.Error("Expected an error for a header without a value")
+	}
+}
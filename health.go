@@ -0,0 +1,131 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	healthPath      = flag.String("health.path", "", "path GET on every production host, e.g. /healthz, to skip those failing it; disabled when empty")
+	healthInterval  = flag.Int("health.interval", 5000, "milliseconds between two health checks of a host")
+	healthTimeout   = flag.Int("health.timeout", 1000, "timeout in milliseconds of a health check")
+	healthUnhealthy = flag.Int("health.unhealthy", 3, "consecutive failed health checks after which a host is down")
+	healthHealthy   = flag.Int("health.healthy", 2, "consecutive passed health checks after which a down host is up again")
+	healthAlternate = flag.Bool("b.health-check", false, "health check the alternate sites with -health.path too, not mirroring to them while they are down")
+)
+
+var healthChecksFailed = expvar.NewInt("health_checks_failed")
+
+// healthChecker checks the health of backends in the background, a goroutine
+// per backend. A backend is up until it fails the check a number of times in
+// a row, and then down until it passes it a number of times in a row. A
+// check passes with a 2xx response.
+type healthChecker struct {
+	path      string
+	interval  time.Duration
+	timeout   time.Duration
+	unhealthy int
+	healthy   int
+
+	targets map[string]*targetHealth
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// targetHealth is the health of a backend.
+type targetHealth struct {
+	target string
+	url    string
+	client *http.Client
+	up     int32 // 1 if up, read atomically
+
+	// Owned by the checking goroutine.
+	passed, failed int
+}
+
+func newHealthChecker(path string, interval, timeout time.Duration, unhealthy, healthy int) *healthChecker {
+	return &healthChecker{
+		path:      path,
+		interval:  interval,
+		timeout:   timeout,
+		unhealthy: unhealthy,
+		healthy:   healthy,
+		targets:   make(map[string]*targetHealth),
+		done:      make(chan struct{}),
+	}
+}
+
+// Watch starts checking target, reached with scheme over transport. All
+// targets are to be watched before the checker is used.
+func (c *healthChecker) Watch(target, scheme string, transport http.RoundTripper) {
+	t := &targetHealth{
+		target: target,
+		url:    scheme + "://" + target + c.path,
+		client: &http.Client{Transport: transport, Timeout: c.timeout},
+		up:     1,
+	}
+	c.targets[target] = t
+	c.wg.Add(1)
+	go c.run(t)
+}
+
+// Up reports whether target is up. Targets that are not watched, and all
+// targets of a nil checker, are.
+func (c *healthChecker) Up(target string) bool {
+	if c == nil {
+		return true
+	}
+	t, ok := c.targets[target]
+	return !ok || atomic.LoadInt32(&t.up) == 1
+}
+
+// Close stops checking.
+func (c *healthChecker) Close() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+func (c *healthChecker) run(t *targetHealth) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.check(t)
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *healthChecker) check(t *targetHealth) {
+	resp, err := t.client.Get(t.url)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		t.passed, t.failed = t.passed+1, 0
+		if t.passed >= c.healthy && atomic.CompareAndSwapInt32(&t.up, 0, 1) {
+			log.Printf("Backend %s is up again", t.target)
+		}
+		return
+	}
+	healthChecksFailed.Add(1)
+	t.passed, t.failed = 0, t.failed+1
+	if t.failed >= c.unhealthy && atomic.CompareAndSwapInt32(&t.up, 1, 0) {
+		if err == nil {
+			log.Printf("Backend %s is down, its health check answered %d", t.target, resp.StatusCode)
+		} else {
+			log.Printf("Backend %s is down, its health check failed: %s", t.target, err)
+		}
+	}
+}
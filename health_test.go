@@ -0,0 +1,142 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlappingBackend returns a backend whose /healthz passes while healthy is
+// 1.
+func newFlappingBackend(t *testing.T, body string, healthy *int32) (*httptest.Server, chan *http.Request) {
+	hits := make(chan *http.Request, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if atomic.LoadInt32(healthy) == 0 {
+				http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			}
+			return
+		}
+		select {
+		case hits <- r:
+		default:
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, hits
+}
+
+// waitHealth waits for target to be up or down.
+func waitHealth(t *testing.T, c *healthChecker, target string, up bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); c.Up(target) != up; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected '%s' up '%t', but it is not", target, up)
+		}
+	}
+}
+
+func TestFlappingProductionHostIsSkipped(t *testing.T) {
+	healthy := int32(1)
+	flapping, flappingHits := newFlappingBackend(t, "production", &healthy)
+	stable, stableHits := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, stable, alternate)
+	h.Production = []weightedTarget{{hostOf(flapping), 1}, {hostOf(stable), 1}}
+	h.Randomizer = *rand.New(rand.NewSource(1))
+	h.Health = newHealthChecker("/healthz", 5*time.Millisecond, time.Second, 2, 2)
+	h.Health.Watch(hostOf(flapping), "http", productionTransport)
+	defer h.Health.Close()
+	setFlag(t, "p", "0")
+	captureLog(t)
+	failed := healthChecksFailed.Value()
+
+	serveAll := func(n int) {
+		for i := 0; i < n; i++ {
+			serve(h, httptest.NewRequest("GET", "/", nil))
+		}
+	}
+	for round := 0; round < 2; round++ {
+		atomic.StoreInt32(&healthy, 0)
+		waitHealth(t, h.Health, hostOf(flapping), false)
+		serveAll(20)
+		if n := len(flappingHits); n != 0 {
+			t.Errorf("Expected no requests to the host that is down, but received '%d'", n)
+		}
+		if n := len(stableHits); n != 20 {
+			t.Errorf("Expected '%d' requests to the host that is up, but received '%d'", 20, n)
+		}
+		drain(flappingHits, stableHits)
+
+		atomic.StoreInt32(&healthy, 1)
+		waitHealth(t, h.Health, hostOf(flapping), true)
+		serveAll(20)
+		if len(flappingHits) == 0 || len(stableHits) == 0 {
+			t.Errorf("Expected requests to both hosts, but received '%d' and '%d'", len(flappingHits), len(stableHits))
+		}
+		drain(flappingHits, stableHits)
+	}
+	if healthChecksFailed.Value() <= failed {
+		t.Errorf("Expected failed health checks to be counted")
+	}
+}
+
+// drain empties the channels.
+func drain(channels ...chan *http.Request) {
+	for _, c := range channels {
+		for len(c) > 0 {
+			<-c
+		}
+	}
+}
+
+func TestAllProductionHostsDown(t *testing.T) {
+	healthy := int32(0)
+	production, _ := newFlappingBackend(t, "production", &healthy)
+	other, _ := newFlappingBackend(t, "production", &healthy)
+	h := handler{
+		Randomizer: *rand.New(rand.NewSource(1)),
+		Production: []weightedTarget{{hostOf(production), 1}, {hostOf(other), 1}},
+		Health:     newHealthChecker("/healthz", 5*time.Millisecond, time.Second, 1, 1),
+	}
+	h.Health.Watch(hostOf(production), "http", http.DefaultTransport)
+	h.Health.Watch(hostOf(other), "http", http.DefaultTransport)
+	defer h.Health.Close()
+	captureLog(t)
+	waitHealth(t, h.Health, hostOf(production), false)
+	waitHealth(t, h.Health, hostOf(other), false)
+
+	counts := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		counts[h.pickProduction()]++
+	}
+	if counts[hostOf(production)] == 0 || counts[hostOf(other)] == 0 {
+		t.Errorf("Expected requests spread over all hosts, but received '%v'", counts)
+	}
+}
+
+func TestAlternateDownIsNotMirrored(t *testing.T) {
+	healthy := int32(0)
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newFlappingBackend(t, "same", &healthy)
+	h := newTestHandler(t, production, alternate)
+	h.Health = newHealthChecker("/healthz", 5*time.Millisecond, time.Second, 1, 1)
+	h.Health.Watch(hostOf(alternate), "http", alternateTransport)
+	defer h.Health.Close()
+	logs := captureLog(t)
+	waitHealth(t, h.Health, hostOf(alternate), false)
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	expectNoHit(t, altHits)
+
+	atomic.StoreInt32(&healthy, 1)
+	waitHealth(t, h.Health, hostOf(alternate), true)
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitHit(t, altHits)
+	waitComparison(t, logs, id, "Equal", 1)
+}
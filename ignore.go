@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strconv"
+)
+
+var ignoredFields jsonPaths
+
+func init() {
+	flag.Var(&ignoredFields, "ignore-fields", "comma-separated paths of JSON response fields left out of the comparison, e.g. 'timestamp,data.meta.ts,items.*.requestId'")
+}
+
+// removeFields returns body without the fields at paths, so that volatile
+// fields like timestamps do not make responses differ. Bodies other than JSON
+// are returned as is.
+func removeFields(body []byte, paths [][]string) []byte {
+	if len(paths) == 0 {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return body
+	}
+	for _, path := range paths {
+		removeAt(document, path)
+	}
+	removed, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+	return removed
+}
+
+// removeAt removes the fields at path below node. The last element of path
+// names fields of objects; array elements are not removed.
+func removeAt(node interface{}, path []string) {
+	if len(path) == 0 {
+		return
+	}
+	key, rest := path[0], path[1:]
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for k, v := range node {
+			if key != "*" && key != k {
+				continue
+			}
+			if len(rest) == 0 {
+				delete(node, k)
+			} else {
+				removeAt(v, rest)
+			}
+		}
+	case []interface{}:
+		for i, v := range node {
+			if key == "*" || key == strconv.Itoa(i) {
+				removeAt(v, rest)
+			}
+		}
+	}
+}
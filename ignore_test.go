@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIgnoredFieldsAreLeftOutOfTheComparison(t *testing.T) {
+	setFlag(t, "ignore-fields", "timestamp, data.meta.ts,items.*.requestId")
+	prod := []byte(`{"timestamp": 1, "data": {"meta": {"ts": "10:00", "v": 1}}, "items": [{"id": 1, "requestId": "a"}]}`)
+	for alt, expectation := range map[string]bool{
+		`{"timestamp": 2, "data": {"meta": {"ts": "10:01", "v": 1}}, "items": [{"id": 1, "requestId": "b"}]}`: true,
+		// An ignored field may be missing altogether.
+		`{"data": {"meta": {"v": 1}}, "items": [{"id": 1}]}`:                                                  true,
+		`{"timestamp": 2, "data": {"meta": {"ts": "10:01", "v": 2}}, "items": [{"id": 1, "requestId": "b"}]}`: false,
+		`{"timestamp": 2, "data": {"meta": {"ts": "10:01", "v": 1}}, "items": [{"id": 2, "requestId": "b"}]}`: false,
+		`{"timestamp": 2, "data": {"meta": {"ts": "10:01", "v": 1}}, "items": [], "extra": true}`:             false,
+	} {
+		recorder := httptest.NewRecorder()
+		recorder.WriteString(alt)
+		if equal := compareResp(prod, http.Header{}, recorder.Result()); equal != expectation {
+			t.Errorf("Expected '%t' for '%s', but received '%t'", expectation, alt, equal)
+		}
+	}
+}
+
+func TestIgnoreFieldsFromConfig(t *testing.T) {
+	fs := flag.NewFlagSet("teeproxy", flag.ContinueOnError)
+	var paths jsonPaths
+	fs.Var(&paths, "ignore-fields", "")
+	c, err := LoadConfig(writeConfig(t, "c.yaml", "ignore_fields:\n  - timestamp\n  - data.meta.ts\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.apply(fs); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := "timestamp,data.meta.ts"; paths.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, paths.String())
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"sync"
+	"time"
+)
+
+var (
+	compareMaxInFlight = flag.Int("compare.max-inflight", 0, "comparisons running at the same time, further ones are handled as set by -compare.queue-mode; 0 means no limit")
+	compareQueueMode   = flag.String("compare.queue-mode", "drop", "what happens to a comparison beyond -compare.max-inflight: drop, or block to wait up to -compare.queue-wait for a slot before dropping it")
+	compareQueueWait   = flag.Int("compare.queue-wait", 100, "milliseconds a comparison waits for a slot with -compare.queue-mode block")
+	compareWorkers     = flag.Int("compare-workers", 0, "goroutines settling the alternate responses, further ones queue for up to -compare-workers.queue; 0 gives every alternate response a goroutine of its own. It bounds the comparisons in flight too, so it cannot be combined with -compare.max-inflight")
+	compareWorkerQueue = flag.Int("compare-workers.queue", 1000, "alternate responses waiting for one of the -compare-workers, further ones are drained without being compared")
+)
+
+// droppedComparisons counts the dropped comparisons by cause: max_inflight
+// for -compare.max-inflight, worker_queue for -compare-workers.queue.
+var droppedComparisons = expvar.NewMap("comparisons_dropped")
+
+// comparisonLimiter bounds the comparisons in flight. The alternate responses
+// of comparisons beyond the limit are drained without being compared.
+type comparisonLimiter struct {
+	slots chan struct{}
+	wait  time.Duration // for a slot, 0 drops at once
+}
+
+func newComparisonLimiter(max int, mode string, wait time.Duration) *comparisonLimiter {
+	l := &comparisonLimiter{slots: make(chan struct{}, max)}
+	if mode == "block" {
+		l.wait = wait
+	}
+	return l
+}
+
+// Acquire takes a slot for a comparison and reports whether it got one, in
+// which case Release must be called once the comparison is done. A nil
+// limiter always has a slot.
+func (l *comparisonLimiter) Acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait > 0 {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+	droppedComparisons.Add("max_inflight", 1)
+	return false
+}
+
+// Release frees a slot taken by Acquire.
+func (l *comparisonLimiter) Release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// comparisonPool settles the alternate responses on a fixed number of
+// workers, so that a burst of traffic cannot pile up goroutines each holding
+// response bodies. Responses beyond the queue are dropped rather than making
+// the client wait.
+type comparisonPool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+func newComparisonPool(workers, queue int) *comparisonPool {
+	p := &comparisonPool{jobs: make(chan func(), queue)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues job for a worker and reports whether it was queued, or false
+// if the queue is full. A nil pool runs job in a goroutine of its own.
+func (p *comparisonPool) Submit(job func()) bool {
+	if p == nil {
+		go job()
+		return true
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		droppedComparisons.Add("worker_queue", 1)
+		return false
+	}
+}
+
+// Close runs the queued jobs and stops the workers.
+func (p *comparisonPool) Close() {
+	close(p.jobs)
+	p.wg.Wait()
+}
+
+func (p *comparisonPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		job()
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// droppedBy returns the comparisons dropped so far for cause.
+func droppedBy(cause string) int64 {
+	if n, ok := droppedComparisons.Get(cause).(*expvar.Int); ok {
+		return n.Value()
+	}
+	return 0
+}
+
+func TestSaturatedComparisonsAreDropped(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.Comparisons = newComparisonLimiter(1, "drop", time.Second)
+	logs := captureLog(t)
+	dropped := droppedBy("max_inflight")
+
+	// Saturate the limiter.
+	h.Comparisons.Acquire()
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitHit(t, altHits)
+	deadline := time.Now().Add(2 * time.Second)
+	for droppedBy("max_inflight") == dropped && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := droppedBy("max_inflight") - dropped; n != 1 {
+		t.Errorf("Expected '%d' dropped comparison, but received '%d'", 1, n)
+	}
+	if countComparisons(logs, id, "Equal") != 0 {
+		t.Errorf("Expected no comparison, but received '%s'", logs.String())
+	}
+
+	h.Comparisons.Release()
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+}
+
+func TestSaturatedComparisonsWaitForASlot(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.Comparisons = newComparisonLimiter(1, "block", 2*time.Second)
+	logs := captureLog(t)
+	dropped := droppedBy("max_inflight")
+
+	h.Comparisons.Acquire()
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	time.Sleep(100 * time.Millisecond)
+	if countComparisons(logs, id, "Equal") != 0 {
+		t.Errorf("Expected the comparison to wait, but received '%s'", logs.String())
+	}
+	h.Comparisons.Release()
+	waitComparison(t, logs, id, "Equal", 1)
+	if n := droppedBy("max_inflight") - dropped; n != 0 {
+		t.Errorf("Expected no dropped comparison, but received '%d'", n)
+	}
+}
+
+func TestComparisonWaitTimesOut(t *testing.T) {
+	l := newComparisonLimiter(1, "block", 50*time.Millisecond)
+	dropped := droppedBy("max_inflight")
+	l.Acquire()
+	start := time.Now()
+	if l.Acquire() {
+		t.Errorf("Expected no slot")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected to wait for a slot, but it took '%s'", elapsed)
+	}
+	if n := droppedBy("max_inflight") - dropped; n != 1 {
+		t.Errorf("Expected '%d' dropped comparison, but received '%d'", 1, n)
+	}
+}
+
+func TestComparisonPoolCapsConcurrency(t *testing.T) {
+	p := newComparisonPool(2, 10)
+	var running, peak int32
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		if !p.Submit(func() {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+		}) {
+			t.Fatalf("Expected job %d to be queued", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&running); n != 2 {
+		t.Errorf("Expected '%d' jobs running, but received '%d'", 2, n)
+	}
+	close(release)
+	p.Close()
+	if n := atomic.LoadInt32(&peak); n != 2 {
+		t.Errorf("Expected at most '%d' jobs at the same time, but received '%d'", 2, n)
+	}
+}
+
+func TestComparisonPoolOverflowIsDropped(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.Workers = newComparisonPool(1, 0)
+	wal, err := newWALWriter(t.TempDir(), 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	h.Recorder = wal
+	logs := captureLog(t)
+
+	// Occupy the only worker.
+	release := make(chan struct{})
+	for !h.Workers.Submit(func() { <-release }) {
+		time.Sleep(time.Millisecond)
+	}
+	dropped, walDrops := droppedBy("worker_queue"), walDropped.Value()
+	start := time.Now()
+	req, droppedID := newRequest("GET", "/", nil)
+	recorder := serve(h, req)
+	if expectation := "same"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request not to wait for a worker, but it took '%s'", elapsed)
+	}
+	waitHit(t, altHits)
+	if n := droppedBy("worker_queue") - dropped; n != 1 {
+		t.Errorf("Expected '%d' dropped comparison, but received '%d'", 1, n)
+	}
+	// Not recorded either, which is counted.
+	if n := walDropped.Value() - walDrops; n != 1 {
+		t.Errorf("Expected '%d' dropped record, but received '%d'", 1, n)
+	}
+
+	close(release)
+	for !h.Workers.Submit(func() {}) {
+		time.Sleep(time.Millisecond)
+	}
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+	if countComparisons(logs, droppedID, "Equal") != 0 {
+		t.Errorf("Expected only the second request to be compared, but received '%s'", logs.String())
+	}
+	h.Workers.Close()
+}
+
+func TestComparisonPoolOverflowFeedsTheBreaker(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer alternate.Close()
+	h := newTestHandler(t, production, alternate)
+	h.Workers = newComparisonPool(1, 0)
+	h.Breakers = newCircuitBreakers(h.Alternatives, 1, time.Minute)
+	captureLog(t)
+
+	// Occupy the only worker.
+	release := make(chan struct{})
+	defer close(release)
+	for !h.Workers.Submit(func() { <-release }) {
+		time.Sleep(time.Millisecond)
+	}
+	dropped := droppedBy("worker_queue")
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	if n := droppedBy("worker_queue") - dropped; n != 1 {
+		t.Errorf("Expected '%d' dropped comparison, but received '%d'", 1, n)
+	}
+	breaker := h.Breakers[hostOf(alternate)]
+	for deadline := time.Now().Add(2 * time.Second); !breaker.Open(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the failure of the dropped response to open the circuit")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalJSON(t *testing.T) {
+	for _, test := range []struct{ input, expected string }{
+		// From RFC 8785, section 3.2.2.
+		{`{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+		   "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/",
+		   "literals": [null, true, false]}`,
+			`{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`},
+		{`{"\u20ac": 1, "\r": 2, "1": 3, "\ud83d\ude00": 4, "\u0080": 5, "\ufb33": 6, "\u00f6": 7}`,
+			"{\"\\r\":2,\"1\":3,\"\u0080\":5,\"ö\":7,\"€\":1,\"😀\":4,\"\ufb33\":6}"},
+		{`[-0, 0.0, 100, 1e21, 1e20, 123e-9, 0.000001, -1.5e-7]`,
+			`[0,0,100,1e+21,100000000000000000000,1.23e-7,0.000001,-1.5e-7]`},
+	} {
+		canonical, err := canonicalJSON([]byte(test.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(canonical) != test.expected {
+			t.Errorf("Expected '%s', but received '%s'", test.expected, canonical)
+		}
+	}
+	for _, invalid := range []string{`{"a": 1`, `{"a": 1} {}`, `1e400`} {
+		if _, err := canonicalJSON([]byte(invalid)); err == nil {
+			t.Errorf("Expected '%s' to be rejected", invalid)
+		}
+	}
+}
+
+func TestCompareCanonical(t *testing.T) {
+	setFlag(t, "compare.canonical", "true")
+	for _, test := range []struct {
+		prod, alt string
+		equal     bool
+	}{
+		{`{"a": 1.0, "b": [1e2, "x"]}`, `{"b":[100,"x"],"a":1}`, true},
+		{`{"price": 4.50}`, `{"price": 4.5}`, true},
+		{`{"s": "\u00e9"}`, `{"s": "é"}`, true},
+		{`{"a": 1}`, `{"a": 2}`, false},
+		{`not json`, `not json`, true},
+	} {
+		alt := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(test.alt))}
+		if equal := compareResp([]byte(test.prod), http.Header{}, alt); equal != test.equal {
+			t.Errorf("Expected '%t' for %s and %s, but received '%t'", test.equal, test.prod, test.alt, equal)
+		}
+	}
+}
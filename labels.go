@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+var (
+	envLabel   = flag.String("env-label", "", "environment tagging the metrics, log lines and comparison results, e.g. 'staging'")
+	instanceID = flag.String("instance-id", "", "instance tagging the metrics, log lines and comparison results, e.g. the host name")
+)
+
+var metricLabels = expvar.NewMap("labels")
+
+// labels tag everything teeproxy reports, so that the output of several
+// deployments can be aggregated and still told apart. Empty labels are left
+// out.
+type labels struct {
+	Env      string
+	Instance string
+}
+
+// pairs returns the labels as name and value pairs.
+func (l labels) pairs() [][2]string {
+	var pairs [][2]string
+	if l.Env != "" {
+		pairs = append(pairs, [2]string{"env", l.Env})
+	}
+	if l.Instance != "" {
+		pairs = append(pairs, [2]string{"instance", l.Instance})
+	}
+	return pairs
+}
+
+// export exports the labels with the metrics, whatever the -log-format.
+func (l labels) export() {
+	for _, pair := range l.pairs() {
+		s := new(expvar.String)
+		s.Set(pair[1])
+		metricLabels.Set(pair[0], s)
+	}
+}
+
+// prefixLog prefixes every line of the text log with the labels.
+func (l labels) prefixLog() {
+	var prefix []string
+	for _, pair := range l.pairs() {
+		prefix = append(prefix, pair[0]+"="+pair[1])
+	}
+	if len(prefix) > 0 {
+		log.SetPrefix(strings.Join(prefix, " ") + " ")
+		log.SetFlags(log.Flags() | log.Lmsgprefix)
+	}
+}
+
+// useLogFormat sets up the log in format, text or json, writing to w and
+// tagged with the labels, which also tag the metrics.
+func useLogFormat(format string, w io.Writer, tags labels) error {
+	switch format {
+	case "text":
+		log.SetOutput(w)
+		tags.prefixLog()
+	case "json":
+		useJSONLog(w, tags)
+	default:
+		return fmt.Errorf("unknown -log-format %q, expected text or json", format)
+	}
+	tags.export()
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabelsTagMetricsAndLogs(t *testing.T) {
+	logs := captureLog(t)
+	prefix, flags := log.Prefix(), log.Flags()
+	t.Cleanup(func() {
+		log.SetPrefix(prefix)
+		log.SetFlags(flags)
+		metricLabels.Init()
+	})
+
+	if err := useLogFormat("text", logs, labels{Env: "staging", Instance: "i-1"}); err != nil {
+		t.Fatal(err)
+	}
+	log.Println("tagged")
+
+	if expectation := `{"env": "staging", "instance": "i-1"}`; expvar.Get("labels").String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, expvar.Get("labels").String())
+	}
+	if !strings.Contains(logs.String(), "env=staging instance=i-1 tagged") {
+		t.Errorf("Expected a tagged log line, but received '%s'", logs.String())
+	}
+}
+
+func TestLabelsTagMetricsWithJSONLog(t *testing.T) {
+	t.Cleanup(func() {
+		eventLogger.Store(nil)
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+		metricLabels.Init()
+	})
+
+	logs := &syncBuffer{}
+	if err := useLogFormat("json", logs, labels{Env: "staging", Instance: "i-1"}); err != nil {
+		t.Fatal(err)
+	}
+	log.Println("tagged")
+
+	if expectation := `{"env": "staging", "instance": "i-1"}`; expvar.Get("labels").String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, expvar.Get("labels").String())
+	}
+	if !strings.Contains(logs.String(), `"env":"staging","instance":"i-1"`) {
+		t.Errorf("Expected a tagged log record, but received '%s'", logs.String())
+	}
+}
+
+func TestLabelsTagComparisonResults(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	h.Labels = labels{Env: "staging"}
+	captureLog(t)
+	results := comparisonStream.Subscribe(10)
+	defer comparisonStream.Unsubscribe(results)
+
+	serve(h, httptest.NewRequest("GET", "/labeled", nil))
+	for {
+		select {
+		case r := <-results:
+			if r.Path != "/labeled" {
+				continue
+			}
+			if r.Env != "staging" || r.Instance != "" {
+				t.Errorf("Expected the result tagged with '%s', but received '%+v'", "staging", r)
+			}
+			return
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected a comparison result, but received none")
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var logFormat = flag.String("log-format", "text", "format of the log: text, or json for a JSON record per line, with the fields of requests, upstream errors and comparisons")
+
+// eventLogger logs the events with their fields in the json format. In the
+// text format it is nil.
+var eventLogger atomic.Pointer[slog.Logger]
+
+// logEvent logs an event. In the text format only msg is logged, and debug
+// events only with -debug; in the json format, a record with msg and the
+// fields given by args, key-value pairs as for slog.
+func logEvent(level slog.Level, msg string, args ...any) {
+	if l := eventLogger.Load(); l != nil {
+		l.Log(context.Background(), level, msg, args...)
+		return
+	}
+	if level >= slog.LevelInfo || *debug {
+		log.Print(msg)
+	}
+}
+
+// logEnabled reports whether events of level are logged, so that building
+// frequent events can be spared otherwise.
+func logEnabled(level slog.Level) bool {
+	if l := eventLogger.Load(); l != nil {
+		return l.Enabled(context.Background(), level)
+	}
+	return level >= slog.LevelInfo || *debug
+}
+
+// useJSONLog switches the log to JSON records written to w. Besides the
+// events, every line of the log package becomes a record of its own with
+// just the message. The labels are fields of every record.
+func useJSONLog(w io.Writer, tags labels) {
+	level := slog.LevelInfo
+	if *debug {
+		level = slog.LevelDebug
+	}
+	l := slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+	for _, pair := range tags.pairs() {
+		l = l.With(pair[0], pair[1])
+	}
+	eventLogger.Store(l)
+	log.SetPrefix("")
+	log.SetFlags(0)
+	log.SetOutput(logLines{l})
+}
+
+// logLines writes the lines of the log package as records of a logger.
+type logLines struct {
+	logger *slog.Logger
+}
+
+func (w logLines) Write(p []byte) (int, error) {
+	w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// milliseconds returns d in milliseconds, the unit of the latency fields.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// logUpstreamError logs a failed round trip to a backend.
+func logUpstreamError(backend string, request *http.Request, latency time.Duration, err error) {
+	logEvent(slog.LevelError, fmt.Sprint("Request failed: ", err, loggedRequestID(request)),
+		"event", "upstream_error",
+		"request_id", request.Header.Get(*requestIDHeader),
+		"backend", backend,
+		"target", request.URL.Host,
+		"method", request.Method,
+		"path", request.URL.Path,
+		"latency_ms", milliseconds(latency),
+		"error", err.Error())
+}
+
+// comparisonFields returns the fields of a comparison result.
+func comparisonFields(x *exchange, r *comparisonResult) []any {
+	return []any{
+		"event", "comparison",
+		"request_id", r.RequestID,
+		"method", r.Method,
+		"path", r.Path,
+		"equal", r.Equal,
+		"flaky", r.Flaky,
+		"alternate", r.Alternate,
+		"production_status", r.ProductionStatus,
+		"alternate_status", r.AlternateStatus,
+		"production_latency_ms", milliseconds(x.ProductionLatency),
+		"alternate_latency_ms", milliseconds(x.AlternateLatency),
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureJSONLog switches to the json log format, captured in the returned
+// buffer, until the test ends.
+func captureJSONLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	useJSONLog(buf, labels{Env: "test"})
+	t.Cleanup(func() {
+		eventLogger.Store(nil)
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	})
+	return buf
+}
+
+// records parses the captured JSON log, returning the records with the given
+// event.
+func records(t *testing.T, logs *syncBuffer, event string) []map[string]interface{} {
+	t.Helper()
+	var matching []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected a JSON record, but received '%s'", line)
+		}
+		if record["event"] == event || event == "" {
+			matching = append(matching, record)
+		}
+	}
+	return matching
+}
+
+func TestJSONLogComparison(t *testing.T) {
+	production, _ := newBackend(t, `{"id": 1}`)
+	alternate, _ := newBackend(t, `{"id": 2}`)
+	h := newTestHandler(t, production, alternate)
+	logs := captureJSONLog(t)
+
+	req, id := newRequest("GET", "/item", nil)
+	serve(h, req)
+	waitLog(t, logs, `"request_id":"`+id+`"`, 1)
+	var record map[string]interface{}
+	for _, r := range records(t, logs, "comparison") {
+		if r["request_id"] == id {
+			record = r
+		}
+	}
+	for field, expectation := range map[string]interface{}{
+		"level":             "INFO",
+		"method":            "GET",
+		"path":              "/item",
+		"equal":             false,
+		"production_status": 200.0,
+		"alternate_status":  200.0,
+		"alternate":         hostOf(alternate),
+		"env":               "test",
+	} {
+		if record[field] != expectation {
+			t.Errorf("Expected '%v' for '%s', but received '%v'", expectation, field, record[field])
+		}
+	}
+	for _, field := range []string{"time", "msg", "production_latency_ms", "alternate_latency_ms"} {
+		if _, ok := record[field]; !ok {
+			t.Errorf("Expected '%s' in '%v'", field, record)
+		}
+	}
+	if latency, _ := record["production_latency_ms"].(float64); latency <= 0 {
+		t.Errorf("Expected a production latency, but received '%v'", record["production_latency_ms"])
+	}
+}
+
+func TestJSONLogUpstreamErrorAndPlainLines(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	production.Close()
+	setFlag(t, "p", "0")
+	setFlag(t, "debug", "true")
+	logs := captureJSONLog(t)
+
+	serve(h, httptest.NewRequest("POST", "/down", nil))
+	log.Printf("a line of the log package")
+	if requests := records(t, logs, "request"); len(requests) != 1 || requests[0]["level"] != "DEBUG" || requests[0]["path"] != "/down" {
+		t.Errorf("Expected a request record, but received '%v'", requests)
+	}
+	errors := records(t, logs, "upstream_error")
+	if len(errors) != 1 {
+		t.Fatalf("Expected an upstream error record, but received '%s'", logs.String())
+	}
+	for field, expectation := range map[string]interface{}{
+		"level":   "ERROR",
+		"backend": "production",
+		"target":  hostOf(production),
+		"method":  "POST",
+		"path":    "/down",
+	} {
+		if errors[0][field] != expectation {
+			t.Errorf("Expected '%v' for '%s', but received '%v'", expectation, field, errors[0][field])
+		}
+	}
+	if message, _ := errors[0]["error"].(string); !strings.Contains(message, "connection refused") {
+		t.Errorf("Expected the error, but received '%v'", errors[0]["error"])
+	}
+	all := records(t, logs, "")
+	if last := all[len(all)-1]; last["msg"] != "a line of the log package" || last["env"] != "test" {
+		t.Errorf("Expected a record of the log line, but received '%v'", last)
+	}
+}
+
+func TestTextLogIsUnchanged(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitLog(t, logs, "Equal: alternate "+hostOf(alternate)+" (request id "+id+")", 1)
+	if strings.Contains(logs.String(), "{") || strings.Contains(logs.String(), "Request received") {
+		t.Errorf("Expected only the plain message, but received '%s'", logs.String())
+	}
+}
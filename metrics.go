@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics exported on /debug/vars of the debug listener.
+var (
+	alternateQueueTimeouts = expvar.NewInt("alternate_queue_timeouts")
+	duplicationMismatches  = expvar.NewInt("duplication_mismatches")
+	comparisonQueueDepth   = expvar.NewInt("comparison_queue_depth")
+	bothTimeouts           = expvar.NewInt("both_timeouts")
+	oversizedResponses     = expvar.NewInt("oversized_responses")
+	canceledAlternates     = expvar.NewInt("alternate_canceled")
+	clientGoneAlternates   = expvar.NewInt("alternate_canceled_client_gone")
+	streamedBodies         = expvar.NewInt("request_bodies_streamed")
+	comparisonLatency      = newHistogram("comparison_latency_seconds", latencyBuckets)
+)
+
+// latencyBuckets are the upper bounds, in seconds, of latency histograms.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// histogram counts observations in cumulative buckets like a Prometheus
+// histogram.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64 // per bound, the last one for +Inf
+	sum    float64
+}
+
+// newHistogram returns a histogram published under name.
+func newHistogram(name string, bounds []float64) *histogram {
+	h := &histogram{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+	expvar.Publish(name, h)
+	return h
+}
+
+// Observe adds a value to the histogram.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.counts[len(h.bounds)]++
+	h.sum += v
+}
+
+// Count returns the number of observations.
+func (h *histogram) Count() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[len(h.bounds)]
+}
+
+// Sum returns the sum of all observations.
+func (h *histogram) Sum() float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
+
+// Quantile returns the upper bound of the bucket holding the q-quantile, or
+// the largest bound if it lies beyond.
+func (h *histogram) Quantile(q float64) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	total := h.counts[len(h.bounds)]
+	if total == 0 {
+		return 0
+	}
+	for i, bound := range h.bounds {
+		if float64(h.counts[i]) >= q*float64(total) {
+			return bound
+		}
+	}
+	return h.bounds[len(h.bounds)-1]
+}
+
+// String returns the histogram as JSON, as required by expvar.Var.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets := make(map[string]int64)
+	for i, bound := range h.bounds {
+		buckets[strconv.FormatFloat(bound, 'g', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.counts[len(h.bounds)]
+	b, _ := json.Marshal(map[string]interface{}{
+		"count":   h.counts[len(h.bounds)],
+		"sum":     h.sum,
+		"buckets": buckets,
+	})
+	return string(b)
+}
+
+var successCodes = statusCodes{{200, 299}}
+
+// Responses per backend ("production" or "alternate"). Failed requests count
+// as responses without success.
+var (
+	backendResponses = expvar.NewMap("backend_responses")
+	backendSuccesses = expvar.NewMap("backend_successes")
+)
+
+func init() {
+	flag.Var(&successCodes, "success-codes", "comma-separated status codes or classes like '2xx' counting as success in the metrics")
+	expvar.Publish("backend_success_rate", expvar.Func(successRates))
+}
+
+// recordStatus counts the response of a backend; resp is nil if the request
+// failed.
+func recordStatus(backend string, resp *http.Response) {
+	backendResponses.Add(backend, 1)
+	if resp != nil && successCodes.Contains(resp.StatusCode) {
+		backendSuccesses.Add(backend, 1)
+	} else {
+		// Make sure the backend is exported with zero successes.
+		backendSuccesses.Add(backend, 0)
+	}
+}
+
+// successRates returns the share of successful responses per backend.
+func successRates() interface{} {
+	rates := make(map[string]float64)
+	backendResponses.Do(func(kv expvar.KeyValue) {
+		total := kv.Value.(*expvar.Int).Value()
+		if successes, ok := backendSuccesses.Get(kv.Key).(*expvar.Int); ok && total > 0 {
+			rates[kv.Key] = float64(successes.Value()) / float64(total)
+		}
+	})
+	return rates
+}
+
+// statusCodes is a flag value holding status codes, given individually or as
+// classes like '2xx'. Each entry is an inclusive range.
+type statusCodes [][2]int
+
+func (c *statusCodes) String() string {
+	var s []string
+	for _, r := range *c {
+		if r[0] == r[1] {
+			s = append(s, strconv.Itoa(r[0]))
+		} else if r[0]%100 == 0 && r[1] == r[0]+99 {
+			s = append(s, strconv.Itoa(r[0]/100)+"xx")
+		} else {
+			s = append(s, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *statusCodes) Set(value string) error {
+	var codes statusCodes
+	for _, v := range strings.Split(value, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if len(v) == 3 && strings.HasSuffix(v, "xx") && v[0] >= '1' && v[0] <= '9' {
+			class := int(v[0]-'0') * 100
+			codes = append(codes, [2]int{class, class + 99})
+			continue
+		}
+		code, err := strconv.Atoi(v)
+		if err != nil || code < 100 || code > 999 {
+			return fmt.Errorf("invalid status code %q", v)
+		}
+		codes = append(codes, [2]int{code, code})
+	}
+	*c = codes
+	return nil
+}
+
+// Contains reports whether code is one of the status codes.
+func (c statusCodes) Contains(code int) bool {
+	for _, r := range c {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := &histogram{bounds: []float64{1, 2}, counts: make([]int64, 3)}
+	for _, v := range []float64{0.5, 1.5, 1.5, 3} {
+		h.Observe(v)
+	}
+	var exported struct {
+		Count   int64
+		Sum     float64
+		Buckets map[string]int64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported.Count != 4 || exported.Sum != 6.5 {
+		t.Errorf("Expected count 4 and sum 6.5, but received '%s'", h.String())
+	}
+	for bound, expectation := range map[string]int64{"1": 1, "2": 3, "+Inf": 4} {
+		if exported.Buckets[bound] != expectation {
+			t.Errorf("Expected '%d' in bucket '%s', but received '%d'", expectation, bound, exported.Buckets[bound])
+		}
+	}
+}
+
+func TestComparisonLatencyIsRecorded(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	count := comparisonLatency.Count()
+
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+	deadline := time.Now().Add(2 * time.Second)
+	for comparisonLatency.Count() == count && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := comparisonLatency.Count() - count; n != 1 {
+		t.Errorf("Expected '%d' observation, but received '%d'", 1, n)
+	}
+	if depth := comparisonQueueDepth.Value(); depth != 0 {
+		t.Errorf("Expected an empty comparison queue, but received '%d'", depth)
+	}
+}
+
+func TestSuccessCodes(t *testing.T) {
+	var codes statusCodes
+	if err := codes.Set("2xx, 301,404"); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := "2xx,301,404"; codes.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, codes.String())
+	}
+	for _, invalid := range []string{"abc", "0xx", "42"} {
+		if err := codes.Set(invalid); err == nil {
+			t.Errorf("Expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestRedirectCountsAsSuccessWhenConfigured(t *testing.T) {
+	for _, c := range []struct {
+		codes string
+		rate  float64
+	}{{"2xx", 0.5}, {"2xx,301", 1}} {
+		setFlag(t, "success-codes", c.codes)
+		backend := "test-" + c.codes
+		recordStatus(backend, &http.Response{StatusCode: 200})
+		recordStatus(backend, &http.Response{StatusCode: 301})
+		if rate := successRates().(map[string]float64)[backend]; rate != c.rate {
+			t.Errorf("Expected a success rate of '%f' with '%s', but received '%f'", c.rate, c.codes, rate)
+		}
+	}
+	recordStatus("test-failed", nil)
+	if rate, ok := successRates().(map[string]float64)["test-failed"]; !ok || rate != 0 {
+		t.Errorf("Expected a success rate of '0' for failed requests, but received '%f'", rate)
+	}
+}
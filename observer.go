@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+var (
+	observerURL    = flag.String("b.observer-url", "", "URL receiving every alternate response as a JSON POST, disabled when empty")
+	observerBuffer = flag.Int("b.observer-buffer", 256, "alternate responses queued for the -b.observer-url before new ones are dropped")
+)
+
+var observerDropped = expvar.NewInt("observer_dropped")
+
+// observerTimeout bounds every POST to the observer.
+const observerTimeout = 5 * time.Second
+
+// observer posts alternate responses, which are otherwise discarded, to an
+// external URL in the background. Like the response capture, it queues them
+// in a bounded buffer and drops them when it is full.
+type observer struct {
+	url       string
+	client    *http.Client
+	responses chan *capturedResponse
+	done      chan struct{}
+}
+
+func newObserver(url string, buffer int) *observer {
+	o := &observer{
+		url:       url,
+		client:    &http.Client{Timeout: observerTimeout},
+		responses: make(chan *capturedResponse, buffer),
+		done:      make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// Observe queues the alternate response of the exchange. Its body must have
+// been read into x.AlternateBody.
+func (o *observer) Observe(x *exchange) {
+	if x.Alternate == nil {
+		return
+	}
+	select {
+	case o.responses <- newCapturedResponse(x, x.Alternate, x.AlternateBody):
+	default:
+		observerDropped.Add(1)
+	}
+}
+
+// Close posts the queued responses.
+func (o *observer) Close() {
+	close(o.responses)
+	<-o.done
+}
+
+func (o *observer) run() {
+	defer close(o.done)
+	for r := range o.responses {
+		if err := o.post(r); err != nil {
+			log.Printf("Failed to post the alternate response of request %s to the observer: %s", r.RequestID, err)
+		}
+	}
+}
+
+func (o *observer) post(r *capturedResponse) error {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Post(o.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestObserverReceivesAlternateResponse(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Alternate", "1")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("alternate"))
+	}))
+	defer alternate.Close()
+	received := make(chan *capturedResponse, 10)
+	observed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &capturedResponse{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			t.Errorf("Failed to decode the observed response: %s", err)
+		}
+		received <- payload
+	}))
+	defer observed.Close()
+	h := newTestHandler(t, production, alternate)
+	h.Observer = newObserver(observed.URL, 10)
+	defer h.Observer.Close()
+
+	recorder := serve(h, httptest.NewRequest("GET", "/observed?q=1", nil))
+	if expectation := "production"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	select {
+	case r := <-received:
+		if r.URI != "/observed?q=1" || r.Status != http.StatusAccepted || string(r.Body) != "alternate" {
+			t.Errorf("Expected the alternate response, but received '%+v'", r)
+		}
+		if r.Header.Get("X-Alternate") != "1" || r.RequestID == "" {
+			t.Errorf("Expected the alternate header and a request ID, but received '%+v'", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an observed response, but received none")
+	}
+}
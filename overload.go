@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"runtime"
+	"sync/atomic"
+)
+
+var maxGoroutines = flag.Int("max-goroutines", 0, "reject requests with 503 while more goroutines are running, 0 means no limit")
+
+// goroutineLimitEngaged is 1 while requests are rejected because of
+// -max-goroutines.
+var goroutineLimitEngaged int32
+
+// overGoroutineLimit reports whether new requests must be rejected because of
+// -max-goroutines. It logs when the limiter engages and disengages.
+func overGoroutineLimit() bool {
+	if *maxGoroutines <= 0 {
+		return false
+	}
+	n := runtime.NumGoroutine()
+	over := n > *maxGoroutines
+	if over && atomic.CompareAndSwapInt32(&goroutineLimitEngaged, 0, 1) {
+		log.Printf("Rejecting requests: %d goroutines exceed the limit of %d", n, *maxGoroutines)
+	} else if !over && atomic.CompareAndSwapInt32(&goroutineLimitEngaged, 1, 0) {
+		log.Printf("Accepting requests again: %d goroutines are within the limit of %d", n, *maxGoroutines)
+	}
+	return over
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGoroutineLimitRejectsRequests(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	limit := runtime.NumGoroutine() + 20
+	setFlag(t, "max-goroutines", strconv.Itoa(limit))
+
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-release
+		}()
+	}
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusServiceUnavailable, recorder.Code)
+	}
+	waitLog(t, logs, "Rejecting requests", 1)
+
+	close(release)
+	wg.Wait()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > limit && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	recorder = serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusOK, recorder.Code)
+	}
+	waitLog(t, logs, "Accepting requests again", 1)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+var pprofAddr = flag.String("pprof-addr", "", "address of a separate listener serving the profiles of net/http/pprof on /debug/pprof/, e.g. 'localhost:6061'; empty disables it")
+
+// newPprofServer returns the server of the profiles, on a mux of its own so
+// that they are only reachable when enabled.
+func newPprofServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// debugHandler returns the handler of the debug listener: the default mux,
+// without the profiles net/http/pprof registers on it when imported.
+func debugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/debug/pprof/") {
+			http.NotFound(w, req)
+			return
+		}
+		http.DefaultServeMux.ServeHTTP(w, req)
+	})
+}
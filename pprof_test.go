@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPprofIsOnlyOnItsListener(t *testing.T) {
+	w := httptest.NewRecorder()
+	debugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusNotFound, w.Code)
+	}
+	w = httptest.NewRecorder()
+	debugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	newPprofServer("").Handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusOK, w.Code)
+	}
+}
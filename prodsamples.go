@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+)
+
+var productionSamples = flag.Int("compare.prod-samples", 1, "production responses to GET, HEAD and OPTIONS requests compared with each other before a mismatch is blamed on the alternate site")
+
+var productionFlakes = expvar.NewInt("prod_flaky")
+
+// productionFlaky sends the production request of x again, up to samples-1
+// times, and reports whether a response differs from the first one in its
+// status, body or compared headers. A mismatch with the alternate site then
+// says nothing about the alternate. Failed samples are ignored.
+func productionFlaky(x *exchange, samples int) bool {
+	timeout := backendTimeout(productionTimeout)
+	for i := 1; i < samples; i++ {
+		req := x.ProductionRequest.Clone(context.Background())
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+		var err error
+		resp := <-handleAsyncRequest(req, timeout, &err, nil)
+		if resp == nil {
+			continue
+		}
+		equal := compareResp(x.ProductionBody, x.Production.Header, resp)
+		if !equal || resp.StatusCode != x.Production.StatusCode || diffHeaders(x.Production.Header, resp.Header) != "" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlakyProductionIsNotBlamedOnAlternate(t *testing.T) {
+	var requests int64
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/flaky" {
+			fmt.Fprintf(w, "response %d", atomic.AddInt64(&requests, 1))
+			return
+		}
+		w.Write([]byte("stable"))
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	h.ProdSamples = 2
+	logs := captureLog(t)
+	flakes := productionFlakes.Value()
+	before, _ := divergences.snapshot()
+
+	req, flakyID := newRequest("GET", "/flaky", nil)
+	serve(h, req)
+	waitLog(t, logs, "Production not deterministic, not comparing: GET /flaky (request id "+flakyID+")", 1)
+	req, id := newRequest("GET", "/stable", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+
+	if n := countComparisons(logs, flakyID, "Not equal"); n != 0 {
+		t.Errorf("Expected no mismatch for '/flaky', but received '%s'", logs.String())
+	}
+	paths, _ := divergences.snapshot()
+	if after, expected := paths["/flaky"], before["/flaky"]; after != (pathStats{Flaky: expected.Flaky + 1}) {
+		t.Errorf("Expected '%v', but received '%v'", pathStats{Flaky: expected.Flaky + 1}, after)
+	}
+	if n := productionFlakes.Value() - flakes; n != 1 {
+		t.Errorf("Expected '%d' flaky production response, but received '%d'", 1, n)
+	}
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("Expected '%d' production requests to '/flaky', but received '%d'", 2, n)
+	}
+}
+
+func TestFlakyProductionHeaderIsNotBlamedOnAlternate(t *testing.T) {
+	var requests int64
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", fmt.Sprint(atomic.AddInt64(&requests, 1)))
+		w.Write([]byte("same"))
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.ProdSamples = 2
+	setFlag(t, "compare-headers", "X-Version")
+	logs := captureLog(t)
+
+	req, id := newRequest("GET", "/flaky-header", nil)
+	serve(h, req)
+	waitLog(t, logs, "Production not deterministic, not comparing: GET /flaky-header (request id "+id+")", 1)
+	if n := countComparisons(logs, id, "Not equal"); n != 0 {
+		t.Errorf("Expected no mismatch, but received '%s'", logs.String())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// weightedTarget is a production host of the pool with its share of the
+// requests.
+type weightedTarget struct {
+	Host   string
+	Weight int
+}
+
+// parseProductionPool parses the -a value: comma-separated hosts, each
+// optionally followed by '=' and a weight, which defaults to 1, e.g.
+// 'prod1:8080=3,prod2:8080'.
+func parseProductionPool(value string) ([]weightedTarget, error) {
+	var pool []weightedTarget
+	total := 0
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		target := weightedTarget{Host: v, Weight: 1}
+		if i := strings.LastIndex(v, "="); i >= 0 {
+			weight, err := strconv.Atoi(strings.TrimSpace(v[i+1:]))
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight of %q, expected a number of at least 0", v)
+			}
+			target = weightedTarget{Host: strings.TrimSpace(v[:i]), Weight: weight}
+		}
+		pool = append(pool, target)
+		total += target.Weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("no production host with a weight in %q", value)
+	}
+	return pool, nil
+}
+
+// productionHosts returns the hosts of the pool.
+func productionHosts(pool []weightedTarget) []string {
+	hosts := make([]string, len(pool))
+	for i, target := range pool {
+		hosts[i] = target.Host
+	}
+	return hosts
+}
+
+// lockedSource is a random source safe for concurrent use. The handler and
+// its copies share one, as every request draws from it.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+// newRandomizer returns a generator seeded with seed, safe for concurrent
+// use.
+func newRandomizer(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed)})
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// productionDown reports whether the health checker found every production
+// host down.
+func (h handler) productionDown() bool {
+	if h.Health == nil {
+		return false
+	}
+	if len(h.Production) == 0 {
+		return !h.Health.Up(*targetProduction)
+	}
+	for _, target := range h.Production {
+		if h.Health.Up(target.Host) {
+			return false
+		}
+	}
+	return true
+}
+
+// pickProduction returns the production host a request is sent to, picked
+// from the pool at random in proportion to the weights. Hosts that are down
+// are skipped, unless all of them are. Without a pool, it is the -a flag.
+func (h handler) pickProduction() string {
+	if len(h.Production) == 0 {
+		return *targetProduction
+	}
+	if len(h.Production) == 1 {
+		return h.Production[0].Host
+	}
+	up := func(target weightedTarget) bool { return h.Health.Up(target.Host) }
+	total := 0
+	for _, target := range h.Production {
+		if up(target) {
+			total += target.Weight
+		}
+	}
+	if total == 0 {
+		up = func(weightedTarget) bool { return true }
+		for _, target := range h.Production {
+			total += target.Weight
+		}
+	}
+	n := h.Randomizer.Intn(total)
+	for _, target := range h.Production {
+		if !up(target) {
+			continue
+		}
+		if n < target.Weight {
+			return target.Host
+		}
+		n -= target.Weight
+	}
+	return h.Production[len(h.Production)-1].Host
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestParseProductionPool(t *testing.T) {
+	pool, err := parseProductionPool("prod1:8080=3, prod2:8080 ,prod3:8080/base=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectation := []weightedTarget{{"prod1:8080", 3}, {"prod2:8080", 1}, {"prod3:8080/base", 0}}
+	if !reflect.DeepEqual(pool, expectation) {
+		t.Errorf("Expected '%v', but received '%v'", expectation, pool)
+	}
+	for _, invalid := range []string{"", "prod1:8080=x", "prod1:8080=-1", "prod1:8080=0"} {
+		if _, err := parseProductionPool(invalid); err == nil {
+			t.Errorf("Expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestProductionPicksByWeight(t *testing.T) {
+	h := handler{
+		Randomizer: *rand.New(rand.NewSource(1)),
+		Production: []weightedTarget{{"a", 6}, {"b", 3}, {"c", 1}, {"drained", 0}},
+	}
+	const n = 100000
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[h.pickProduction()]++
+	}
+	for host, share := range map[string]float64{"a": 0.6, "b": 0.3, "c": 0.1, "drained": 0} {
+		if got := float64(counts[host]) / n; got < share-0.01 || got > share+0.01 {
+			t.Errorf("Expected a share of %v for '%s', but received '%v'", share, host, got)
+		}
+	}
+}
+
+func TestConcurrentRequestsPickProduction(t *testing.T) {
+	h := handler{
+		Randomizer: *newRandomizer(1),
+		Production: []weightedTarget{{"a", 1}, {"b", 1}},
+	}
+	// Requests are served by copies of the handler sharing its randomizer,
+	// which the race detector checks.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(h handler) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if host := h.pickProduction(); host != "a" && host != "b" {
+					t.Errorf("Expected '%s' or '%s', but received '%s'", "a", "b", host)
+				}
+			}
+		}(h)
+	}
+	wg.Wait()
+}
+
+func TestRequestsAreSpreadOverProduction(t *testing.T) {
+	first, firstHits := newBackend(t, "production")
+	second, secondHits := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, first, alternate)
+	h.Production = []weightedTarget{{hostOf(first), 1}, {hostOf(second), 1}}
+	setFlag(t, "p", "0")
+
+	for i := 0; i < 40; i++ {
+		if recorder := serve(h, httptest.NewRequest("GET", "/", nil)); recorder.Body.String() != "production" {
+			t.Fatalf("Expected '%s', but received '%s'", "production", recorder.Body.String())
+		}
+	}
+	if len(firstHits) == 0 || len(secondHits) == 0 || len(firstHits)+len(secondHits) != 40 {
+		t.Errorf("Expected the requests spread over both hosts, but received '%d' and '%d'", len(firstHits), len(secondHits))
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var metricsAddr = flag.String("metrics-addr", "", "address of a separate listener exposing Prometheus metrics on /metrics, e.g. ':9090'; empty disables it")
+
+// Prometheus metrics, labeled by backend ("production" or "alternate") and
+// target address. The labels of -env-label and -instance-id are added to
+// every series.
+var (
+	promRequests = newPromCounter("teeproxy_backend_requests_total",
+		"Requests sent to the backends.")
+	promErrors = newPromCounter("teeproxy_backend_errors_total",
+		"Backend requests failed, by kind: timeout or error.")
+	promComparisons = newPromCounter("teeproxy_comparisons_total",
+		"Comparison results, by result: equal, not_equal or flaky.")
+	promLatency = newPromHistogram("teeproxy_backend_latency_seconds",
+		"Latency of the backend responses, until their headers are received.", latencyBuckets)
+)
+
+// promMetrics are written on /metrics in this order.
+var promMetrics = []promMetric{promRequests, promErrors, promComparisons, promLatency}
+
+type promMetric interface {
+	write(w io.Writer, constLabels string)
+}
+
+// promLabels formats label name and value pairs, e.g. `backend="production"`.
+func promLabels(pairs ...string) string {
+	var s []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		s = append(s, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(s, ",")
+}
+
+// joinLabels joins formatted labels into a series selector, e.g.
+// `{a="1",b="2"}`, leaving out empty ones.
+func joinLabels(labels ...string) string {
+	var s []string
+	for _, l := range labels {
+		if l != "" {
+			s = append(s, l)
+		}
+	}
+	if len(s) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
+
+// promCounter is a counter with a series per set of labels.
+type promCounter struct {
+	name, help string
+
+	mu     sync.Mutex
+	series map[string]int64
+}
+
+func newPromCounter(name, help string) *promCounter {
+	return &promCounter{name: name, help: help, series: make(map[string]int64)}
+}
+
+// Inc adds one to the series with the given label name and value pairs.
+func (c *promCounter) Inc(pairs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[promLabels(pairs...)]++
+}
+
+// Value returns the series with the given label name and value pairs.
+func (c *promCounter) Value(pairs ...string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.series[promLabels(pairs...)]
+}
+
+func (c *promCounter) write(w io.Writer, constLabels string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labels := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, joinLabels(labels, constLabels), c.series[labels])
+	}
+}
+
+// promHistogram is a histogram with a series per set of labels.
+type promHistogram struct {
+	name, help string
+	bounds     []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+func newPromHistogram(name, help string, bounds []float64) *promHistogram {
+	return &promHistogram{name: name, help: help, bounds: bounds, series: make(map[string]*histogram)}
+}
+
+// Observe adds a value to the series with the given label name and value
+// pairs.
+func (h *promHistogram) Observe(v float64, pairs ...string) {
+	labels := promLabels(pairs...)
+	h.mu.Lock()
+	series := h.series[labels]
+	if series == nil {
+		// Not published with expvar, unlike the ones of newHistogram.
+		series = &histogram{bounds: h.bounds, counts: make([]int64, len(h.bounds)+1)}
+		h.series[labels] = series
+	}
+	h.mu.Unlock()
+	series.Observe(v)
+}
+
+func (h *promHistogram) write(w io.Writer, constLabels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, labels := range sortedKeys(h.series) {
+		series := h.series[labels]
+		series.mu.Lock()
+		for i, bound := range series.bounds {
+			le := promLabels("le", strconv.FormatFloat(bound, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, joinLabels(labels, constLabels, le), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, joinLabels(labels, constLabels, `le="+Inf"`), series.counts[len(series.bounds)])
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, joinLabels(labels, constLabels), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, joinLabels(labels, constLabels), series.counts[len(series.bounds)])
+		series.mu.Unlock()
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// observeBackend records a backend request to target in the Prometheus
+// metrics: its latency if it succeeded, or else the kind of error.
+func observeBackend(backend, target string, seconds float64, err error) {
+	promRequests.Inc("backend", backend, "target", target)
+	if err == nil {
+		promLatency.Observe(seconds, "backend", backend, "target", target)
+	} else {
+		observeBackendError(backend, target, err)
+	}
+}
+
+// observeBackendError counts a failed backend request.
+func observeBackendError(backend, target string, err error) {
+	kind := "error"
+	if isTimeout(err) {
+		kind = "timeout"
+	}
+	promErrors.Inc("backend", backend, "target", target, "kind", kind)
+}
+
+// servePrometheus writes the metrics in the Prometheus text format.
+func servePrometheus(w http.ResponseWriter, req *http.Request) {
+	var constLabels []string
+	metricLabels.Do(func(kv expvar.KeyValue) {
+		constLabels = append(constLabels, kv.Key, kv.Value.(*expvar.String).Value())
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range promMetrics {
+		m.write(w, promLabels(constLabels...))
+	}
+}
+
+// newMetricsServer returns the server of -metrics-addr. It has a mux of its
+// own, so that nothing registered for the debug listener is exposed.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", servePrometheus)
+	return &http.Server{Addr: addr, Handler: mux}
+}
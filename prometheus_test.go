@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, _ := newBackend(t, "different")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	metrics := httptest.NewServer(newMetricsServer("").Handler)
+	defer metrics.Close()
+
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+
+	resp, err := http.Get(metrics.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, expected := range []string{
+		"# TYPE teeproxy_backend_requests_total counter",
+		fmt.Sprintf(`teeproxy_backend_requests_total{backend="production",target=%q} `, hostOf(production)),
+		fmt.Sprintf(`teeproxy_backend_requests_total{backend="alternate",target=%q} `, hostOf(alternate)),
+		fmt.Sprintf(`teeproxy_comparisons_total{result="not_equal",target=%q} `, hostOf(alternate)),
+		"# TYPE teeproxy_backend_latency_seconds histogram",
+		fmt.Sprintf(`teeproxy_backend_latency_seconds_bucket{backend="alternate",target=%q,le="+Inf"} `, hostOf(alternate)),
+		fmt.Sprintf(`teeproxy_backend_latency_seconds_count{backend="production",target=%q} `, hostOf(production)),
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected '%s' in the metrics, but received '%s'", expected, body)
+		}
+	}
+
+	// Only /metrics is exposed, not the debug endpoints.
+	resp, err = http.Get(metrics.URL + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestPrometheusCountsBackendTimeouts(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.timeout", "50")
+	captureLog(t)
+	timeouts := promErrors.Value("backend", "production", "target", hostOf(production), "kind", "timeout")
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	if n := promErrors.Value("backend", "production", "target", hostOf(production), "kind", "timeout") - timeouts; n != 1 {
+		t.Errorf("Expected '%d' timeouts, but received '%d'", 1, n)
+	}
+}
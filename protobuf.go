@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	protoDescriptor    = flag.String("compare.proto-descriptor", "", "path to a FileDescriptorSet describing protobuf response bodies, compared semantically when set")
+	protoMessage       = flag.String("compare.proto-message", "", "full name of the protobuf message of response bodies without a -compare.proto-type-header")
+	protoTypeHeader    = flag.String("compare.proto-type-header", "X-Protobuf-Type", "production response header naming the protobuf message of the body")
+	protoIgnoreUnknown = flag.Bool("compare.proto-ignore-unknown", false, "ignore protobuf fields missing from the descriptor when comparing")
+)
+
+// protoTypes holds the messages of the -compare.proto-descriptor, once loaded.
+var protoTypes atomic.Pointer[protoRegistry]
+
+func init() {
+	comparators["application/protobuf"] = compareProtobuf
+	comparators["application/x-protobuf"] = compareProtobuf
+}
+
+// Field types and labels of google.protobuf.FieldDescriptorProto.
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+
+	protoLabelRepeated = 3
+)
+
+// Wire types of the protobuf encoding.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type protoField struct {
+	Name     string
+	Type     uint64
+	Repeated bool
+	TypeName string // full name of message and enum types, without leading dot
+}
+
+type protoMessageType struct {
+	Fields   map[uint64]*protoField
+	MapEntry bool
+}
+
+// protoRegistry maps full message names to their types.
+type protoRegistry map[string]*protoMessageType
+
+// protoFields calls fn for every field of the encoded message b, in order. v
+// is the value of varint and fixed fields, data the one of length-delimited
+// fields.
+func protoFields(b []byte, fn func(number uint64, wireType int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		b = b[n:]
+		var v uint64
+		var data []byte
+		switch wireType := int(key & 7); wireType {
+		case protoVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("malformed varint")
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || length > uint64(len(b)-n) {
+				return errors.New("malformed length-delimited field")
+			}
+			data, b = b[n:n+int(length)], b[n+int(length):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if err := fn(key>>3, int(key&7), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadProtoDescriptors reads the messages of a binary FileDescriptorSet, as
+// written by protoc --descriptor_set_out.
+func loadProtoDescriptors(name string) (protoRegistry, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	registry := make(protoRegistry)
+	err = protoFields(data, func(number uint64, wireType int, _ uint64, file []byte) error {
+		if number != 1 || wireType != protoBytes {
+			return nil
+		}
+		var pkg string
+		var messages [][]byte
+		err := protoFields(file, func(number uint64, _ int, _ uint64, data []byte) error {
+			switch number {
+			case 2:
+				pkg = string(data)
+			case 4:
+				messages = append(messages, data)
+			}
+			return nil
+		})
+		for _, message := range messages {
+			if err == nil {
+				err = registry.add(pkg, message)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return registry, nil
+}
+
+// add registers the encoded DescriptorProto, and its nested types, in scope.
+func (r protoRegistry) add(scope string, descriptor []byte) error {
+	var name string
+	var nested [][]byte
+	t := &protoMessageType{Fields: make(map[uint64]*protoField)}
+	err := protoFields(descriptor, func(number uint64, _ int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			name = string(data)
+		case 2:
+			f := &protoField{}
+			var fieldNumber uint64
+			err := protoFields(data, func(number uint64, _ int, v uint64, data []byte) error {
+				switch number {
+				case 1:
+					f.Name = string(data)
+				case 3:
+					fieldNumber = v
+				case 4:
+					f.Repeated = v == protoLabelRepeated
+				case 5:
+					f.Type = v
+				case 6:
+					f.TypeName = strings.TrimPrefix(string(data), ".")
+				}
+				return nil
+			})
+			t.Fields[fieldNumber] = f
+			return err
+		case 3:
+			nested = append(nested, data)
+		case 7:
+			// MessageOptions.map_entry
+			return protoFields(data, func(number uint64, _ int, v uint64, _ []byte) error {
+				if number == 7 {
+					t.MapEntry = v != 0
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if scope != "" {
+		name = scope + "." + name
+	}
+	r[name] = t
+	for _, descriptor := range nested {
+		if err := r.add(name, descriptor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode returns the message b of type name in a form which is deeply equal
+// for semantically equal messages: a map from field numbers to values, with
+// repeated fields as slices and map fields as maps. Unknown fields are kept
+// by their wire value unless ignoreUnknown is set.
+func (r protoRegistry) decode(name string, b []byte, ignoreUnknown bool) (map[uint64]interface{}, error) {
+	t, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown message %q", name)
+	}
+	m := make(map[uint64]interface{})
+	err := protoFields(b, func(number uint64, wireType int, v uint64, data []byte) error {
+		f, ok := t.Fields[number]
+		if !ok {
+			if !ignoreUnknown {
+				unknown, _ := m[number].([]interface{})
+				if wireType == protoBytes {
+					m[number] = append(unknown, string(data))
+				} else {
+					m[number] = append(unknown, v)
+				}
+			}
+			return nil
+		}
+		var values []interface{}
+		if wireType == protoBytes && protoScalarWireType(f.Type) >= 0 {
+			// Packed repeated scalars.
+			packed := protoScalarWireType(f.Type)
+			for len(data) > 0 {
+				var n int
+				switch packed {
+				case protoVarint:
+					v, n = binary.Uvarint(data)
+				case protoFixed64:
+					if n = 8; len(data) >= 8 {
+						v = binary.LittleEndian.Uint64(data)
+					}
+				case protoFixed32:
+					if n = 4; len(data) >= 4 {
+						v = uint64(binary.LittleEndian.Uint32(data))
+					}
+				}
+				if n <= 0 || n > len(data) {
+					return fmt.Errorf("malformed packed field %s", f.Name)
+				}
+				values = append(values, protoScalar(f.Type, v))
+				data = data[n:]
+			}
+		} else {
+			value, err := r.decodeValue(f, v, data, ignoreUnknown)
+			if err != nil {
+				return err
+			}
+			values = []interface{}{value}
+		}
+
+		switch {
+		case f.Type == protoTypeMessage && r[f.TypeName] != nil && r[f.TypeName].MapEntry:
+			entries, _ := m[number].(map[interface{}]interface{})
+			if entries == nil {
+				entries = make(map[interface{}]interface{})
+				m[number] = entries
+			}
+			for _, entry := range values {
+				entry := entry.(map[uint64]interface{})
+				entries[entry[1]] = entry[2]
+			}
+		case f.Repeated:
+			repeated, _ := m[number].([]interface{})
+			m[number] = append(repeated, values...)
+		default:
+			// The last value of a singular field wins.
+			m[number] = values[len(values)-1]
+		}
+		return nil
+	})
+	return m, err
+}
+
+func (r protoRegistry) decodeValue(f *protoField, v uint64, data []byte, ignoreUnknown bool) (interface{}, error) {
+	switch f.Type {
+	case protoTypeString, protoTypeBytes:
+		return string(data), nil
+	case protoTypeMessage:
+		return r.decode(f.TypeName, data, ignoreUnknown)
+	case protoTypeGroup:
+		return nil, fmt.Errorf("unsupported group field %s", f.Name)
+	}
+	return protoScalar(f.Type, v), nil
+}
+
+// protoScalarWireType returns the wire type of a scalar field type, or -1
+// for other types.
+func protoScalarWireType(fieldType uint64) int {
+	switch fieldType {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return protoFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return protoFixed32
+	case protoTypeInt64, protoTypeUint64, protoTypeInt32, protoTypeBool,
+		protoTypeUint32, protoTypeEnum, protoTypeSint32, protoTypeSint64:
+		return protoVarint
+	}
+	return -1
+}
+
+// protoScalar normalizes the wire value of a scalar field, so that different
+// encodings of the same value are equal.
+func protoScalar(fieldType uint64, v uint64) interface{} {
+	switch fieldType {
+	case protoTypeDouble:
+		return math.Float64frombits(v)
+	case protoTypeFloat:
+		return float64(math.Float32frombits(uint32(v)))
+	case protoTypeBool:
+		return v != 0
+	case protoTypeInt32, protoTypeEnum, protoTypeSfixed32:
+		return int64(int32(v))
+	case protoTypeUint32, protoTypeFixed32:
+		return uint64(uint32(v))
+	case protoTypeSint32, protoTypeSint64:
+		return int64(v>>1) ^ -int64(v&1)
+	case protoTypeInt64, protoTypeSfixed64:
+		return int64(v)
+	}
+	return v
+}
+
+// compareProtobuf compares protobuf bodies as messages of the type named by
+// the -compare.proto-type-header of the production response, or else by
+// -compare.proto-message.
+func compareProtobuf(prodBody []byte, prodHeader http.Header, altBody []byte, altHeader http.Header) (bool, error) {
+	registry := protoTypes.Load()
+	if registry == nil {
+		return false, errors.New("no -compare.proto-descriptor loaded")
+	}
+	name := prodHeader.Get(*protoTypeHeader)
+	if name == "" {
+		name = *protoMessage
+	}
+	if name == "" {
+		return false, errors.New("protobuf message type unknown")
+	}
+	prod, err := registry.decode(name, prodBody, *protoIgnoreUnknown)
+	if err != nil {
+		return false, fmt.Errorf("production body: %s", err)
+	}
+	alt, err := registry.decode(name, altBody, *protoIgnoreUnknown)
+	if err != nil {
+		return false, fmt.Errorf("alternate body: %s", err)
+	}
+	return reflect.DeepEqual(prod, alt), nil
+}
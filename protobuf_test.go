@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDescriptorSet describes
+//
+//	package test;
+//	message Item {
+//	  string name = 1;
+//	  sint32 count = 2;
+//	  repeated int32 ids = 3;
+//	  map<string, Item> children = 4;
+//	}
+func testDescriptorSet() []byte {
+	field := func(name string, number, label, fieldType uint64, typeName string) string {
+		var b []byte
+		b = appendProtoString(b, 1, name)
+		b = appendProtoVarint(b, 3, number)
+		b = appendProtoVarint(b, 4, label)
+		b = appendProtoVarint(b, 5, fieldType)
+		b = appendProtoString(b, 6, typeName)
+		return string(b)
+	}
+	var entry []byte
+	entry = appendProtoString(entry, 1, "ChildrenEntry")
+	entry = appendProtoString(entry, 2, field("key", 1, 1, protoTypeString, ""))
+	entry = appendProtoString(entry, 2, field("value", 2, 1, protoTypeMessage, ".test.Item"))
+	entry = appendProtoString(entry, 7, string(appendProtoVarint(nil, 7, 1)))
+
+	var item []byte
+	item = appendProtoString(item, 1, "Item")
+	item = appendProtoString(item, 2, field("name", 1, 1, protoTypeString, ""))
+	item = appendProtoString(item, 2, field("count", 2, 1, protoTypeSint32, ""))
+	item = appendProtoString(item, 2, field("ids", 3, protoLabelRepeated, protoTypeInt32, ""))
+	item = appendProtoString(item, 2, field("children", 4, protoLabelRepeated, protoTypeMessage, ".test.Item.ChildrenEntry"))
+	item = appendProtoString(item, 3, string(entry))
+
+	var file []byte
+	file = appendProtoString(file, 1, "test.proto")
+	file = appendProtoString(file, 2, "test")
+	file = appendProtoString(file, 4, string(item))
+	return appendProtoString(nil, 1, string(file))
+}
+
+// useTestDescriptors loads testDescriptorSet for the duration of the test.
+func useTestDescriptors(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.pb")
+	if err := ioutil.WriteFile(name, testDescriptorSet(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry, err := loadProtoDescriptors(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoTypes.Store(&registry)
+	t.Cleanup(func() { protoTypes.Store(nil) })
+}
+
+func childEntry(key, name string) string {
+	child := appendProtoString(nil, 1, name)
+	return string(appendProtoString(appendProtoString(nil, 1, key), 2, string(child)))
+}
+
+func TestProtobufComparisonIgnoresEncodingOrder(t *testing.T) {
+	useTestDescriptors(t)
+	setFlag(t, "compare.proto-message", "test.Item")
+	logs := captureLog(t)
+
+	// name, count -2, ids 1 2 unpacked, children a and b
+	var prod []byte
+	prod = appendProtoString(prod, 1, "item")
+	prod = appendProtoVarint(prod, 2, 3)
+	prod = appendProtoVarint(prod, 3, 1)
+	prod = appendProtoVarint(prod, 3, 2)
+	prod = appendProtoString(prod, 4, childEntry("a", "first"))
+	prod = appendProtoString(prod, 4, childEntry("b", "second"))
+
+	// The same in reverse order, with packed ids.
+	var alt []byte
+	alt = appendProtoString(alt, 4, childEntry("b", "second"))
+	alt = appendProtoString(alt, 4, childEntry("a", "first"))
+	alt = appendProtoString(alt, 3, string([]byte{1, 2}))
+	alt = appendProtoVarint(alt, 2, 3)
+	alt = appendProtoString(alt, 1, "item")
+
+	header := http.Header{"Content-Type": {"application/protobuf"}}
+	if !compareResp(prod, header, alternateResponse(header, alt)) {
+		t.Errorf("Expected equal messages, but received '%s'", logs.String())
+	}
+
+	changed := appendProtoString(alt, 4, childEntry("a", "changed"))
+	if compareResp(prod, header, alternateResponse(header, changed)) {
+		t.Errorf("Expected a changed map value to differ")
+	}
+
+	reordered := appendProtoString(appendProtoVarint(nil, 3, 2), 3, string([]byte{1}))
+	if compareResp(appendProtoString(nil, 3, string([]byte{1, 2})), header, alternateResponse(header, reordered)) {
+		t.Errorf("Expected reordered repeated values to differ")
+	}
+	if strings.Contains(logs.String(), "Falling back") {
+		t.Errorf("Expected protobuf comparisons, but received '%s'", logs.String())
+	}
+}
+
+func TestProtobufComparisonOfUnknownFields(t *testing.T) {
+	useTestDescriptors(t)
+	captureLog(t)
+	header := http.Header{"Content-Type": {"application/x-protobuf"}, "X-Protobuf-Type": {"test.Item"}}
+	prod := appendProtoString(nil, 1, "item")
+	alt := appendProtoVarint(appendProtoString(nil, 1, "item"), 9, 1)
+
+	if compareResp(prod, header, alternateResponse(header, alt)) {
+		t.Errorf("Expected an unknown field to differ")
+	}
+	setFlag(t, "compare.proto-ignore-unknown", "true")
+	if !compareResp(prod, header, alternateResponse(header, alt)) {
+		t.Errorf("Expected unknown fields to be ignored")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocol = flag.Bool("proxy-protocol", false, "expect a PROXY protocol v1 or v2 header on every connection, as sent by L4 load balancers, and take the client address from it; connections without one are rejected")
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts a version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener accepts connections starting with a PROXY protocol
+// header. The header is read on the first Read or RemoteAddr of a connection,
+// in the goroutine serving it rather than in the accepting one.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// proxyProtocolConn is a connection whose remote address is the client's, as
+// given by its PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr // nil if the header gives none, e.g. for health checks of the load balancer
+	err    error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Printf("Rejected connection from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol header of version 1 or 2 and returns
+// the source address it gives, or nil for a header without one.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("no PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	}
+	return nil, errors.New("no PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2
+// 56324 443\r\n", at most 107 bytes long.
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("incomplete PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[1] != "TCP4" && fields[1] != "TCP6" {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid source in PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header: the signature, the version and
+// command, the address family and protocol, the length of the addresses and
+// then the addresses, followed by optional TLVs.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("incomplete PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, fmt.Errorf("incomplete PROXY protocol header: %w", err)
+	}
+	if header[12]&0xf == 0 {
+		// A LOCAL connection, e.g. a health check of the load balancer.
+		return nil, nil
+	}
+	var size int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		size = net.IPv4len
+	case 2: // AF_INET6
+		size = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(addresses) < 2*size+4 {
+		return nil, errors.New("PROXY protocol header too short for its addresses")
+	}
+	ip := net.IP(addresses[:size])
+	port := binary.BigEndian.Uint16(addresses[2*size:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// proxyHeaderV2 returns a version 2 PROXY header for a TCP connection from
+// src to dst.
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	family, ip, dstIP := byte(0x11), src.IP.To4(), dst.IP.To4()
+	if ip == nil {
+		family, ip, dstIP = 0x21, src.IP.To16(), dst.IP.To16()
+	}
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, family, 0, 0)
+	header = append(header, ip...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(src.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(header)-16))
+	return header
+}
+
+func TestProxyProtocolClientIsForwarded(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	proxy := httptest.NewUnstartedServer(newTestHandler(t, production, alternate))
+	proxy.Listener = proxyProtocolListener{proxy.Listener}
+	proxy.Start()
+	defer proxy.Close()
+	setFlag(t, "forward-client-ip", "true")
+	logs := captureLog(t)
+
+	lb := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	for _, test := range []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 56324 443\r\n"), "203.0.113.7"},
+		{[]byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"), "2001:db8::7"},
+		{proxyHeaderV2(&net.TCPAddr{IP: net.ParseIP("198.51.100.9"), Port: 40000}, lb), "198.51.100.9"},
+		{proxyHeaderV2(&net.TCPAddr{IP: net.ParseIP("2001:db8::9"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}), "2001:db8::9"},
+		// The load balancer checking its own health gives no client.
+		{[]byte("PROXY UNKNOWN\r\n"), "127.0.0.1"},
+	} {
+		conn, err := net.Dial("tcp", hostOf(proxy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conn.Write(append(test.header, "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n"...))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if xff := waitHit(t, prodHits).Header.Get("X-Forwarded-For"); xff != test.expected {
+			t.Errorf("Expected '%s', but received '%s'", test.expected, xff)
+		}
+	}
+
+	// Connections without a header are rejected.
+	conn, err := net.Dial("tcp", hostOf(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: proxy\r\n\r\n"))
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		t.Error("Expected the connection without a PROXY header to be closed")
+	}
+	expectNoHit(t, prodHits)
+	waitLog(t, logs, "no PROXY protocol header", 1)
+}
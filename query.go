@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var canonicalQueries jsonPaths
+
+func init() {
+	flag.Var(&canonicalQueries, "compare.canonical-query", "comma-separated paths of JSON response values holding URLs or query strings whose parameter order is ignored, e.g. 'links.*.href,request.query'")
+}
+
+// jsonPaths is a flag value of comma-separated, dot-separated JSON paths.
+// Numeric path elements index arrays, and '*' matches every element of an
+// array or object. It can be read by comparisons while being set.
+type jsonPaths struct {
+	v atomic.Pointer[jsonPathsValue]
+}
+
+type jsonPathsValue struct {
+	raw   string
+	paths [][]string
+}
+
+func (p *jsonPaths) String() string {
+	if v := p.v.Load(); v != nil {
+		return v.raw
+	}
+	return ""
+}
+
+func (p *jsonPaths) Set(value string) error {
+	v := &jsonPathsValue{raw: value}
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			v.paths = append(v.paths, strings.Split(path, "."))
+		}
+	}
+	p.v.Store(v)
+	return nil
+}
+
+// Paths returns the parsed paths.
+func (p *jsonPaths) Paths() [][]string {
+	if v := p.v.Load(); v != nil {
+		return v.paths
+	}
+	return nil
+}
+
+// canonicalizeQueries returns body with the query parameters of the string
+// values at paths sorted by name, so that responses echoing the same query in
+// a different order compare equal. Bodies other than JSON are returned as is.
+func canonicalizeQueries(body []byte, paths [][]string) []byte {
+	if len(paths) == 0 {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return body
+	}
+	for _, path := range paths {
+		document = canonicalizeAt(document, path)
+	}
+	canonical, err := json.Marshal(document)
+	if err != nil {
+		return body
+	}
+	return canonical
+}
+
+// canonicalizeAt canonicalizes the query strings at path below node and
+// returns the resulting node.
+func canonicalizeAt(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		if s, ok := node.(string); ok {
+			return canonicalQuery(s)
+		}
+		return node
+	}
+	key, rest := path[0], path[1:]
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for k, v := range node {
+			if key == "*" || key == k {
+				node[k] = canonicalizeAt(v, rest)
+			}
+		}
+	case []interface{}:
+		for i, v := range node {
+			if key == "*" || key == strconv.Itoa(i) {
+				node[i] = canonicalizeAt(v, rest)
+			}
+		}
+	}
+	return node
+}
+
+// canonicalQuery sorts the parameters of the query in a URL, or of a bare
+// query string, by name. Repeated parameters keep their relative order, as it
+// may be significant. The fragment, if any, stays in place.
+func canonicalQuery(s string) string {
+	prefix, query, fragment := "", s, ""
+	if i := strings.Index(query, "#"); i >= 0 {
+		query, fragment = query[:i], query[i:]
+	}
+	if i := strings.Index(query, "?"); i >= 0 {
+		prefix, query = query[:i+1], query[i+1:]
+	} else if !strings.Contains(query, "=") {
+		return s
+	}
+	params := strings.Split(query, "&")
+	name := func(param string) string {
+		if i := strings.Index(param, "="); i >= 0 {
+			return param[:i]
+		}
+		return param
+	}
+	sort.SliceStable(params, func(i, j int) bool { return name(params[i]) < name(params[j]) })
+	return prefix + strings.Join(params, "&") + fragment
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalQuery(t *testing.T) {
+	for value, expectation := range map[string]string{
+		"/search?q=go&b=2&a=1":      "/search?a=1&b=2&q=go",
+		"https://host/?b=1&a=2#top": "https://host/?a=2&b=1#top",
+		"b=2&a=1":                   "a=1&b=2",
+		"tag=y&id=1&tag=x":          "id=1&tag=y&tag=x",
+		"plain text":                "plain text",
+		"/path-without-query#a=1&b": "/path-without-query#a=1&b",
+	} {
+		if canonical := canonicalQuery(value); canonical != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, canonical)
+		}
+	}
+}
+
+func TestQueryOrderIsIgnoredAtConfiguredPaths(t *testing.T) {
+	setFlag(t, "compare.canonical-query", "self,links.*.href")
+	prod := []byte(`{"self": "/items?page=2&size=10", "links": [{"href": "/items?page=3&size=10"}], "other": "b=1&a=2"}`)
+	for alt, expectation := range map[string]bool{
+		`{"self": "/items?size=10&page=2", "links": [{"href": "/items?size=10&page=3"}], "other": "b=1&a=2"}`: true,
+		`{"self": "/items?size=10&page=2", "links": [{"href": "/items?size=10&page=3"}], "other": "a=2&b=1"}`: false,
+		`{"self": "/items?size=20&page=2", "links": [{"href": "/items?size=10&page=3"}], "other": "b=1&a=2"}`: false,
+	} {
+		recorder := httptest.NewRecorder()
+		recorder.WriteString(alt)
+		if equal := compareResp(prod, http.Header{}, recorder.Result()); equal != expectation {
+			t.Errorf("Expected '%t' for '%s', but received '%t'", expectation, alt, equal)
+		}
+	}
+}
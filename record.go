@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	recordFile      = flag.String("record", "", "file the requests are appended to with their production responses, one JSON object per line, for the replay command; disabled when empty")
+	recordMaxBody   = flag.Int("record.max-body", 64<<10, "bytes of each request and response body recorded, longer bodies are truncated")
+	recordKeepCreds = flag.Bool("record.keep-credentials", false, "record the credential headers like Authorization and Cookie as they are, instead of redacted")
+)
+
+var recordDropped = expvar.NewInt("record_dropped")
+
+// recordBuffer is the number of exchanges queued for the recording.
+const recordBuffer = 256
+
+// credentialHeaders are redacted in the recording, unless
+// -record.keep-credentials is set.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redacted replaces the values of the credential headers.
+const redacted = "REDACTED"
+
+// recordedExchange is a request with its production response as written to
+// the -record file. The bodies are base64 encoded by encoding/json. A response
+// with a zero Status was not received.
+type recordedExchange struct {
+	Time          time.Time        `json:"time"`
+	RequestID     string           `json:"request_id"`
+	Method        string           `json:"method"`
+	URI           string           `json:"uri"`
+	Host          string           `json:"host"`
+	Header        http.Header      `json:"header"`
+	Body          []byte           `json:"body"`
+	BodyTruncated bool             `json:"body_truncated,omitempty"`
+	Response      recordedResponse `json:"response"`
+}
+
+type recordedResponse struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// trafficRecorder appends the requests with their production responses to a
+// file in the background. Like the response capture, it queues them in a
+// bounded buffer and drops them when it is full.
+type trafficRecorder struct {
+	file      io.WriteCloser
+	maxBody   int
+	keepCreds bool
+	exchanges chan *recordedExchange
+	done      chan struct{}
+}
+
+// newTrafficRecorder appends to the file at path, created readable by its
+// owner only since it holds the requests of the clients. Their credential
+// headers are redacted unless keepCreds is set.
+func newTrafficRecorder(path string, maxBody int, keepCreds bool) (*trafficRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &trafficRecorder{
+		file:      file,
+		maxBody:   maxBody,
+		keepCreds: keepCreds,
+		exchanges: make(chan *recordedExchange, recordBuffer),
+		done:      make(chan struct{}),
+	}
+	go r.run()
+	return r, nil
+}
+
+// Record queues the request of the exchange with its production response.
+// The body of a streamed request is not kept, so it is recorded as empty.
+func (r *trafficRecorder) Record(x *exchange) {
+	e := &recordedExchange{
+		Time:      time.Now(),
+		RequestID: x.RequestID,
+		Method:    x.Request.Method,
+		URI:       x.Request.URL.RequestURI(),
+		Host:      x.Request.Host,
+		Header:    x.Request.Header.Clone(),
+	}
+	e.Body, e.BodyTruncated = r.truncate(x.RequestBody)
+	if x.Production != nil {
+		e.Response.Status, e.Response.Header = x.Production.StatusCode, x.Production.Header.Clone()
+		e.Response.Body, e.Response.Truncated = r.truncate(x.ProductionBody)
+	}
+	if !r.keepCreds {
+		redactCredentials(e.Header)
+		redactCredentials(e.Response.Header)
+	}
+	select {
+	case r.exchanges <- e:
+	default:
+		recordDropped.Add(1)
+	}
+}
+
+// redactCredentials replaces the values of the credential headers in h.
+func redactCredentials(h http.Header) {
+	for _, name := range credentialHeaders {
+		if _, ok := h[name]; ok {
+			h[name] = []string{redacted}
+		}
+	}
+}
+
+// redactedHeader returns h, or a copy of it with the credential headers
+// redacted if it has any, leaving h as it is.
+func redactedHeader(h http.Header) http.Header {
+	for _, name := range credentialHeaders {
+		if _, ok := h[name]; ok {
+			h = h.Clone()
+			redactCredentials(h)
+			return h
+		}
+	}
+	return h
+}
+
+// truncate returns a copy of at most maxBody bytes of body, so that the whole
+// body is not held on to while queued, and whether it was truncated.
+func (r *trafficRecorder) truncate(body []byte) ([]byte, bool) {
+	if len(body) > r.maxBody {
+		return append([]byte(nil), body[:r.maxBody]...), true
+	}
+	return body, false
+}
+
+// Close writes the queued exchanges and closes the file.
+func (r *trafficRecorder) Close() error {
+	close(r.exchanges)
+	<-r.done
+	return r.file.Close()
+}
+
+func (r *trafficRecorder) run() {
+	defer close(r.done)
+	encoder := json.NewEncoder(r.file)
+	for e := range r.exchanges {
+		if err := encoder.Encode(e); err != nil {
+			log.Println("Failed to write to the recording:", err)
+		}
+	}
+}
+
+// replayCommand runs 'teeproxy replay [flags] FILE', which sends the requests
+// recorded in FILE to a target one after the other, and reports on out the
+// ones whose status differs from the recorded one. It returns the exit code.
+func replayCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(out)
+	target := flags.String("target", "localhost:8080", "where the recorded requests are sent to")
+	scheme := flags.String("scheme", "http", "scheme of the target: http or https")
+	timeout := flags.Int("timeout", 2500, "timeout in milliseconds of each request")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(out, "Usage: teeproxy replay [flags] FILE")
+		flags.PrintDefaults()
+		return 2
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	defer file.Close()
+	client := &http.Client{
+		Timeout: time.Duration(*timeout) * time.Millisecond,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	n, differing, err := replayRecording(file, *scheme, *target, client, out)
+	fmt.Fprintf(out, "Replayed %d requests, %d with a different status\n", n, differing)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	return 0
+}
+
+// replayRecording sends the requests recorded in r to target, and reports on
+// out the ones whose status differs from the recorded one, or that fail. It
+// returns the number of requests sent and of those differing.
+func replayRecording(r io.Reader, scheme, target string, client *http.Client, out io.Writer) (n, differing int, err error) {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var e recordedExchange
+		if err := decoder.Decode(&e); err == io.EOF {
+			return n, differing, nil
+		} else if err != nil {
+			return n, differing, fmt.Errorf("invalid recording after %d requests: %s", n, err)
+		}
+		req, err := http.NewRequest(e.Method, scheme+"://"+target+e.URI, bytes.NewReader(e.Body))
+		if err != nil {
+			return n, differing, err
+		}
+		for name, values := range e.Header {
+			req.Header[name] = values
+		}
+		req.Host = e.Host
+		n++
+		resp, err := client.Do(req)
+		if err != nil {
+			differing++
+			fmt.Fprintf(out, "%s %s: %s\n", e.Method, e.URI, err)
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != e.Response.Status {
+			differing++
+			fmt.Fprintf(out, "%s %s: status %d, recorded %d\n", e.Method, e.URI, resp.StatusCode, e.Response.Status)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordingIsReplayed(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	name := filepath.Join(t.TempDir(), "recording.jsonl")
+	recording, err := newTrafficRecorder(name, 8, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Recording = recording
+
+	req := httptest.NewRequest("POST", "/orders?id=1", strings.NewReader("order=1"))
+	req.Header.Set("X-Client", "test")
+	serve(h, req)
+	serve(h, httptest.NewRequest("DELETE", "/orders?id=%2F2", strings.NewReader(strings.Repeat("x", 100))))
+	if err := recording.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	type replayed struct{ method, uri, client, body string }
+	var received []replayed
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, replayed{r.Method, r.RequestURI, r.Header.Get("X-Client"), string(body)})
+		if r.Method == "DELETE" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer target.Close()
+	out := new(bytes.Buffer)
+	if code := replayCommand([]string{"-target", hostOf(target), name}, out); code != 0 {
+		t.Fatalf("Expected '%d', but received '%d': %s", 0, code, out)
+	}
+
+	// The body of the DELETE is truncated to -record.max-body.
+	expected := []replayed{
+		{"POST", "/orders?id=1", "test", "order=1"},
+		{"DELETE", "/orders?id=%2F2", "", "xxxxxxxx"},
+	}
+	if len(received) != len(expected) {
+		t.Fatalf("Expected '%v', but received '%v'", expected, received)
+	}
+	for i := range expected {
+		if received[i] != expected[i] {
+			t.Errorf("Expected '%v', but received '%v'", expected[i], received[i])
+		}
+	}
+	report := "DELETE /orders?id=%2F2: status 404, recorded 200\nReplayed 2 requests, 1 with a different status\n"
+	if out.String() != report {
+		t.Errorf("Expected '%s', but received '%s'", report, out)
+	}
+}
+
+func TestRecordingRedactsCredentials(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "production-secret"})
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+
+	for _, keep := range []bool{false, true} {
+		name := filepath.Join(t.TempDir(), "recording.jsonl")
+		recording, err := newTrafficRecorder(name, 8, keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Recording = recording
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer client-secret")
+		req.Header.Set("Cookie", "session=client-secret")
+		req.Header.Set("X-Client", "test")
+		serve(h, req)
+		if err := recording.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("Expected '%v', but received '%v'", os.FileMode(0600), mode)
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e recordedExchange
+		if err := json.Unmarshal(data, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Header.Get("X-Client") != "test" {
+			t.Errorf("Expected '%s', but received '%s'", "test", e.Header.Get("X-Client"))
+		}
+		if secrets := strings.Contains(string(data), "secret"); secrets != keep {
+			t.Errorf("Expected credentials recorded: '%v', but received '%s'", keep, data)
+		}
+		if !keep {
+			for _, value := range []string{e.Header.Get("Authorization"), e.Header.Get("Cookie"), e.Response.Header.Get("Set-Cookie")} {
+				if value != redacted {
+					t.Errorf("Expected '%s', but received '%s'", redacted, value)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	productionRetries      = flag.Int("a.retries", 0, "times a production request is retried under the -a.retry-on conditions")
+	productionRetryBackoff = flag.Int("a.retry-backoff", 100, "milliseconds before the first production retry, doubling with every further one")
+	productionRetryOn      = retryConditions{codes: statusCodes{{502, 502}, {503, 503}, {504, 504}}, connect: true}
+)
+
+var retriedRequests = expvar.NewInt("production_retries")
+
+func init() {
+	flag.Var(&productionRetryOn, "a.retry-on", "comma-separated status codes or classes like '5xx' and the errors 'connect' and 'timeout' on which production requests are retried")
+}
+
+// retryConditions is a flag value holding the status codes and error classes
+// triggering a retry. Responses and timeouts are only retried for idempotent
+// methods, as the backend may have acted on the request; connection failures
+// always are.
+type retryConditions struct {
+	codes   statusCodes
+	connect bool // the connection could not be established
+	timeout bool
+}
+
+func (c *retryConditions) String() string {
+	s := []string{}
+	if codes := c.codes.String(); codes != "" {
+		s = append(s, codes)
+	}
+	if c.connect {
+		s = append(s, "connect")
+	}
+	if c.timeout {
+		s = append(s, "timeout")
+	}
+	return strings.Join(s, ",")
+}
+
+func (c *retryConditions) Set(value string) error {
+	var conditions retryConditions
+	var codes []string
+	for _, v := range strings.Split(value, ",") {
+		switch v = strings.ToLower(strings.TrimSpace(v)); v {
+		case "connect":
+			conditions.connect = true
+		case "timeout":
+			conditions.timeout = true
+		default:
+			codes = append(codes, v)
+		}
+	}
+	if err := conditions.codes.Set(strings.Join(codes, ",")); err != nil {
+		return fmt.Errorf("%s, or 'connect' or 'timeout'", err)
+	}
+	*c = conditions
+	return nil
+}
+
+// Retry reports whether the outcome of a request calls for a retry.
+func (c *retryConditions) Retry(req *http.Request, resp *http.Response, err error) bool {
+	var opErr *net.OpError
+	if err != nil && c.connect && errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	if !idempotent(req.Method) {
+		return false
+	}
+	if err != nil {
+		return c.timeout && isTimeout(err)
+	}
+	return c.codes.Contains(resp.StatusCode)
+}
+
+// idempotent reports whether requests of method can be repeated safely.
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryPolicy retries requests a number of times, with exponential backoff.
+type retryPolicy struct {
+	retries int
+	backoff time.Duration
+	on      retryConditions
+}
+
+// productionRetryPolicy returns the retry policy configured for production.
+func productionRetryPolicy() retryPolicy {
+	return retryPolicy{
+		retries: *productionRetries,
+		backoff: time.Duration(*productionRetryBackoff) * time.Millisecond,
+		on:      productionRetryOn,
+	}
+}
+
+// RoundTrip sends req over transport, retrying it as long as the policy
+// allows. Requests whose body cannot be rewound with GetBody are sent once.
+func (p retryPolicy) RoundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := transport.RoundTrip(req)
+		if attempt >= p.retries || !p.on.Retry(req, resp, err) {
+			return resp, err
+		}
+		next := req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			next.Body = body
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			log.Printf("Retrying %s %s%s after a %d from production", req.Method, req.URL.Path, loggedRequestID(req), resp.StatusCode)
+		} else {
+			log.Printf("Retrying %s %s%s after production failed: %s", req.Method, req.URL.Path, loggedRequestID(req), err)
+		}
+		retriedRequests.Add(1)
+		time.Sleep(p.backoff << uint(attempt))
+		req = next
+	}
+}
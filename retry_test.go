@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRetryOnConfiguredStatusCodes(t *testing.T) {
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts[r.Method+" "+r.URL.Path]++
+		first := attempts[r.Method+" "+r.URL.Path] == 1
+		mu.Unlock()
+		if first {
+			switch r.URL.Path {
+			case "/503":
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			case "/500":
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Write([]byte("production"))
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.retries", "2")
+	setFlag(t, "a.retry-backoff", "1")
+	setFlag(t, "a.retry-on", "503")
+	captureLog(t)
+
+	for _, test := range []struct {
+		method, path string
+		status       int
+		attempts     int
+	}{
+		{"GET", "/503", http.StatusOK, 2},
+		{"GET", "/500", http.StatusInternalServerError, 1},
+		{"POST", "/503", http.StatusServiceUnavailable, 1},
+	} {
+		recorder := serve(h, httptest.NewRequest(test.method, test.path, strings.NewReader("body")))
+		if recorder.Code != test.status {
+			t.Errorf("Expected '%d' for %s %s, but received '%d'", test.status, test.method, test.path, recorder.Code)
+		}
+		mu.Lock()
+		if n := attempts[test.method+" "+test.path]; n != test.attempts {
+			t.Errorf("Expected '%d' attempts for %s %s, but received '%d'", test.attempts, test.method, test.path, n)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestRetryConditions(t *testing.T) {
+	var c retryConditions
+	if err := c.Set("5xx, timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := "5xx,timeout"; c.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, c.String())
+	}
+	if err := c.Set("503,reset"); err == nil {
+		t.Errorf("Expected an error for an unknown condition")
+	}
+}
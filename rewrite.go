@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var productionHeaderRewrites, alternateHeaderRewrites headerRewrites
+
+func init() {
+	flag.Var(&productionHeaderRewrites, "a.response-header-rewrite", "rules rewriting the production response headers before they reach the client: 'set:Name=value', 'remove:Name' or 'rename:Old=New', separated by ';' or given by repeating the flag")
+	flag.Var(&alternateHeaderRewrites, "b.response-header-rewrite", "rules rewriting the alternate response headers before the comparison, like -a.response-header-rewrite")
+}
+
+// headerRewrite is a rule rewriting a header: "set" replaces its values with
+// value, "remove" deletes it, and "rename" moves its values to the header
+// named value.
+type headerRewrite struct {
+	action string
+	name   string
+	value  string
+}
+
+func (r headerRewrite) String() string {
+	if r.action == "remove" {
+		return r.action + ":" + r.name
+	}
+	return r.action + ":" + r.name + "=" + r.value
+}
+
+// headerRewrites is a flag value of header rewrites, applied in order.
+type headerRewrites []headerRewrite
+
+func (r *headerRewrites) String() string {
+	var s []string
+	for _, rule := range *r {
+		s = append(s, rule.String())
+	}
+	return strings.Join(s, ";")
+}
+
+func (r *headerRewrites) Set(value string) error {
+	for _, v := range strings.Split(value, ";") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		action, rule, ok := strings.Cut(v, ":")
+		if !ok {
+			return fmt.Errorf("rule %q is not 'action:header'", v)
+		}
+		name, value, hasValue := strings.Cut(rule, "=")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			return fmt.Errorf("rule %q has no header", v)
+		}
+		switch action {
+		case "set":
+			value = strings.TrimSpace(value)
+		case "rename":
+			value = http.CanonicalHeaderKey(strings.TrimSpace(value))
+			if value == "" {
+				return fmt.Errorf("rule %q has no new name", v)
+			}
+		case "remove":
+			if hasValue {
+				return fmt.Errorf("rule %q takes no value", v)
+			}
+		default:
+			return fmt.Errorf("unknown action %q, expected set, remove or rename", action)
+		}
+		if !hasValue && action != "remove" {
+			return fmt.Errorf("rule %q is not '%s:header=value'", v, action)
+		}
+		*r = append(*r, headerRewrite{action, name, value})
+	}
+	return nil
+}
+
+// Apply rewrites header in place.
+func (r headerRewrites) Apply(header http.Header) {
+	for _, rule := range r {
+		switch rule.action {
+		case "set":
+			header.Set(rule.name, rule.value)
+		case "remove":
+			header.Del(rule.name)
+		case "rename":
+			if values, ok := header[rule.name]; ok {
+				header.Del(rule.name)
+				header[rule.value] = values
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProductionResponseHeadersAreRewritten(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend/1.2")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Old", "value")
+		w.Write([]byte("same"))
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	if err := productionHeaderRewrites.Set("set:Server=teeproxy; remove:X-Internal; rename:x-old=X-New"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { productionHeaderRewrites = nil })
+
+	req, id := newRequest("GET", "/", nil)
+	header := serve(h, req).Header()
+	if header.Get("Server") != "teeproxy" || header.Get("X-Internal") != "" ||
+		header.Get("X-Old") != "" || header.Get("X-New") != "value" {
+		t.Errorf("Expected the headers to be rewritten, but received '%v'", header)
+	}
+	// Wait for the comparison, which must not be logged during other tests.
+	waitComparison(t, logs, id, "Equal", 1)
+}
+
+func TestAlternateResponseHeadersAreRewrittenBeforeComparison(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is only equal once decoded, which takes the header.
+		w.Header().Set("X-Encoding", "gzip")
+		w.Write(gzipped(t, "same"))
+	}))
+	defer alternate.Close()
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+
+	if err := h.AltRewrites.Set("rename:X-Encoding=Content-Encoding"); err != nil {
+		t.Fatal(err)
+	}
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+}
+
+func TestHeaderRewritesFlag(t *testing.T) {
+	var rewrites headerRewrites
+	for _, value := range []string{"set:server=a=b", "remove:X-A;rename:X-B=x-c"} {
+		if err := rewrites.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "set:Server=a=b;remove:X-A;rename:X-B=X-C"; rewrites.String() != expected {
+		t.Errorf("Expected '%s', but received '%s'", expected, rewrites.String())
+	}
+	for _, invalid := range []string{"Server", "set:Server", "remove:X-A=b", "rename:X-A=", "move:X-A=X-B", "set:=x"} {
+		if err := rewrites.Set(invalid); err == nil {
+			t.Errorf("Expected '%s' to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+)
+
+var rulesFile = flag.String("rules", "", "path to a JSON file with per-path mirroring rules")
+
+// rule configures mirroring for the requests whose path matches Pattern.
+// Unset fields fall back to the global behavior.
+type rule struct {
+	Pattern string   `json:"pattern"`
+	Percent *float64 `json:"percent,omitempty"` // overrides -p, see samplingPercent
+	Compare *bool    `json:"compare,omitempty"` // false only sends the alternate request for load
+	Weight  *float64 `json:"weight,omitempty"`  // scales the -compare.target-rate sampling, see adaptiveSampler
+
+	re *regexp.Regexp
+}
+
+// compare reports whether alternate responses of matching requests are
+// compared. A nil rule compares.
+func (r *rule) compare() bool {
+	return r == nil || r.Compare == nil || *r.Compare
+}
+
+// weight returns the weight of matching requests for the adaptive sampler. A
+// nil rule weighs 1.
+func (r *rule) weight() float64 {
+	if r == nil || r.Weight == nil {
+		return 1
+	}
+	return *r.Weight
+}
+
+// loadRules reads an ordered JSON list of rules from path and compiles their
+// patterns.
+func loadRules(path string) ([]*rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return rules, compileRules(rules)
+}
+
+func compileRules(rules []*rule) error {
+	for _, r := range rules {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %q: %s", r.Pattern, err)
+		}
+		r.re = re
+		if r.Weight != nil && *r.Weight < 0 {
+			return fmt.Errorf("rule %q: negative weight", r.Pattern)
+		}
+		if r.Percent != nil && (*r.Percent < 0 || *r.Percent > 100) {
+			return fmt.Errorf("rule %q: percent %v is not between 0 and 100", r.Pattern, *r.Percent)
+		}
+	}
+	return nil
+}
+
+// matchRule returns the first rule matching path, or nil.
+func matchRule(rules []*rule, path string) *rule {
+	for _, r := range rules {
+		if r.re.MatchString(path) {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRules writes a rules file and loads it.
+func writeRules(t *testing.T, content string) []*rule {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rules
+}
+
+func TestLoadRules(t *testing.T) {
+	rules := writeRules(t, `[
+		{"pattern": "^/load/", "percent": 10, "compare": false},
+		{"pattern": "^/"}
+	]`)
+	if r := matchRule(rules, "/load/x"); r != rules[0] || r.compare() || samplingPercent(r, "GET") != 10 {
+		t.Errorf("Expected the load rule, but received '%+v'", r)
+	}
+	if r := matchRule(rules, "/other"); r != rules[1] || !r.compare() || samplingPercent(r, "GET") != percent.Load().Default {
+		t.Errorf("Expected the catch-all rule, but received '%+v'", r)
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	ioutil.WriteFile(path, []byte(`[{"pattern": "("}]`), 0644)
+	if _, err := loadRules(path); err == nil {
+		t.Errorf("Expected an error for an invalid pattern")
+	}
+}
+
+func TestCompareOnlyForRulesRequestingIt(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	h.Rules = writeRules(t, `[
+		{"pattern": "^/load", "compare": false},
+		{"pattern": "^/correctness", "compare": true}
+	]`)
+	logs := captureLog(t)
+
+	load, loadID := newRequest("GET", "/load", nil)
+	serve(h, load)
+	waitHit(t, altHits)
+	correctness, correctnessID := newRequest("GET", "/correctness", nil)
+	serve(h, correctness)
+	waitHit(t, altHits)
+
+	waitComparison(t, logs, correctnessID, "Equal", 1)
+	time.Sleep(100 * time.Millisecond)
+	if strings.Contains(logs.String(), "(request id "+loadID+")") {
+		t.Errorf("Expected no comparison of /load, but received '%s'", logs.String())
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// percent is the -p percentage. It can be changed at runtime on /percent of
+// the debug listener.
+var percent = newRuntimePercent(percentFlag{Default: 100.0})
+
+var mirroredMethods methodSet
+
+func init() {
+	flag.Var(percent, "p", "float64 percentage of traffic to send to testing, optionally per method, e.g. 'GET=100,POST=1,default=10'")
+	flag.Var(&mirroredMethods, "b.methods", "comma-separated methods mirrored to the alternate sites, e.g. 'GET,HEAD', to keep requests with side effects away from them; empty mirrors all methods")
+}
+
+// methodSet is a flag value of HTTP methods. An empty set holds every method.
+type methodSet map[string]bool
+
+func (m *methodSet) String() string {
+	var s []string
+	for method := range *m {
+		s = append(s, method)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func (m *methodSet) Set(value string) error {
+	parsed := make(methodSet)
+	for _, method := range strings.Split(value, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			parsed[method] = true
+		}
+	}
+	*m = parsed
+	return nil
+}
+
+// Contains reports whether the set holds method.
+func (m methodSet) Contains(method string) bool {
+	return len(m) == 0 || m[method]
+}
+
+// percentFlag is the mirroring percentage, either one value for all requests
+// or a value per method with a default for the other methods.
+type percentFlag struct {
+	Default float64            `json:"default"`
+	Methods map[string]float64 `json:"methods,omitempty"`
+}
+
+func (p *percentFlag) String() string {
+	if len(p.Methods) == 0 {
+		return strconv.FormatFloat(p.Default, 'f', -1, 64)
+	}
+	var s []string
+	for method, v := range p.Methods {
+		s = append(s, method+"="+strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	sort.Strings(s)
+	return strings.Join(append(s, "default="+strconv.FormatFloat(p.Default, 'f', -1, 64)), ",")
+}
+
+func (p *percentFlag) Set(value string) error {
+	parsed := percentFlag{Default: 100.0}
+	if v, err := strconv.ParseFloat(value, 64); err == nil {
+		parsed.Default = v
+	} else {
+		parsed.Methods = make(map[string]float64)
+		for _, pair := range strings.Split(value, ",") {
+			i := strings.Index(pair, "=")
+			if i <= 0 {
+				return fmt.Errorf("expected 'METHOD=PERCENT', got %q", pair)
+			}
+			method := strings.TrimSpace(pair[:i])
+			v, err := strconv.ParseFloat(strings.TrimSpace(pair[i+1:]), 64)
+			if err != nil {
+				return err
+			}
+			if method == "default" {
+				parsed.Default = v
+			} else {
+				parsed.Methods[strings.ToUpper(method)] = v
+			}
+		}
+	}
+	all := []float64{parsed.Default}
+	for _, v := range parsed.Methods {
+		all = append(all, v)
+	}
+	for _, v := range all {
+		if v < 0 || v > 100 {
+			return fmt.Errorf("percentage %v is not between 0 and 100", v)
+		}
+	}
+	*p = parsed
+	return nil
+}
+
+// For returns the mirroring percentage of requests with the given method.
+func (p *percentFlag) For(method string) float64 {
+	if v, ok := p.Methods[method]; ok {
+		return v
+	}
+	return p.Default
+}
+
+// runtimePercent is a percentFlag that can be replaced while requests read
+// it. A replaced percentFlag is never modified, so that readers need no lock.
+type runtimePercent struct {
+	p atomic.Pointer[percentFlag]
+}
+
+func newRuntimePercent(p percentFlag) *runtimePercent {
+	r := &runtimePercent{}
+	r.p.Store(&p)
+	return r
+}
+
+// Load returns the current percentage.
+func (r *runtimePercent) Load() *percentFlag {
+	return r.p.Load()
+}
+
+func (r *runtimePercent) String() string {
+	if r == nil || r.Load() == nil {
+		return ""
+	}
+	return r.Load().String()
+}
+
+func (r *runtimePercent) Set(value string) error {
+	var p percentFlag
+	if err := p.Set(value); err != nil {
+		return err
+	}
+	r.p.Store(&p)
+	return nil
+}
+
+// samplingPercent returns the mirroring percentage of a request. Within a
+// matched rule with a percentage, a percentage given for the method scales
+// the rule's one; otherwise the method's percentage applies.
+func samplingPercent(matched *rule, method string) float64 {
+	p := percent.Load()
+	if matched == nil || matched.Percent == nil {
+		return p.For(method)
+	}
+	if v, ok := p.Methods[method]; ok {
+		return *matched.Percent * v / 100
+	}
+	return *matched.Percent
+}
+
+var (
+	bucketHeader  = flag.String("p.bucket-header", "", "header hashed into a bucket to mirror stable cohorts instead of random requests")
+	bucketCount   = flag.Int("p.buckets", 100, "number of buckets for -p.bucket-header, at least 1")
+	activeBuckets = flag.Int64("p.active-buckets", 0, "number of mirrored buckets for -p.bucket-header, adjustable at runtime on /buckets of the debug listener")
+)
+
+func init() {
+	http.HandleFunc("/buckets", serveBuckets)
+	http.HandleFunc("/percent", servePercent)
+}
+
+// bucket returns the bucket a -p.bucket-header value falls into.
+func bucket(value string) int {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % uint32(*bucketCount))
+}
+
+// inActiveBucket reports whether a request with the given -p.bucket-header
+// value belongs to the mirrored cohort, i.e. one of the first active buckets.
+func inActiveBucket(value string) bool {
+	return int64(bucket(value)) < atomic.LoadInt64(activeBuckets)
+}
+
+// serveBuckets reports the bucket configuration and lets POST or PUT change
+// the number of active buckets with the 'active' parameter.
+func serveBuckets(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" || req.Method == "PUT" {
+		active, err := strconv.ParseInt(req.FormValue("active"), 10, 64)
+		if err != nil || active < 0 || active > int64(*bucketCount) {
+			http.Error(w, fmt.Sprintf("active must be between 0 and %d", *bucketCount), http.StatusBadRequest)
+			return
+		}
+		atomic.StoreInt64(activeBuckets, active)
+		log.Printf("Mirroring %d of %d buckets", active, *bucketCount)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{
+		"buckets": int64(*bucketCount),
+		"active":  atomic.LoadInt64(activeBuckets),
+	})
+}
+
+// servePercent reports the -p percentage and lets POST or PUT replace it with
+// the 'p' parameter, in the syntax of -p.
+func servePercent(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" || req.Method == "PUT" {
+		if err := percent.Set(req.FormValue("p")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Mirroring percentage set to %s", percent)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(percent.Load())
+}
+
+var targetRate = flag.Float64("compare.target-rate", 0, "requests per second to mirror and compare, adjusting the sampling probability to the request rate instead of following -p; 0 disables")
+
+// adaptiveWindow is the period over which adaptive sampling measures the
+// request rate and counts sampled requests.
+const adaptiveWindow = time.Second
+
+// adaptiveSampler samples requests with a probability adjusted to the
+// observed request rate, so that target requests per second are sampled
+// regardless of the traffic volume. Until the rate adapts to a spike, no more
+// than the target are sampled per window.
+//
+// Requests are sampled in proportion to their weight: the rate is measured in
+// weight per second, and a request of weight w is sampled with w times the
+// probability of a request of weight 1, within the same total.
+type adaptiveSampler struct {
+	target float64
+	now    func() time.Time
+
+	mu      sync.Mutex
+	start   time.Time // of the current window
+	weight  float64   // of the requests in the current window
+	sampled int       // in the current window
+	perUnit float64   // sampling probability per unit of weight, may exceed 1
+}
+
+func newAdaptiveSampler(target float64, now func() time.Time) *adaptiveSampler {
+	return &adaptiveSampler{target: target, now: now, start: now(), perUnit: math.Inf(1)}
+}
+
+// Sample counts a request of the given weight and reports whether it is
+// sampled. r is a uniform random number in [0, 1).
+func (s *adaptiveSampler) Sample(r, weight float64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if elapsed := now.Sub(s.start); elapsed >= adaptiveWindow {
+		// Sample the next window at the rate of the last one.
+		s.perUnit = s.target / (s.weight / elapsed.Seconds())
+		s.start, s.weight, s.sampled = now, 0, 0
+	}
+	s.weight += weight
+	if weight == 0 || r >= weight*s.perUnit || float64(s.sampled) >= s.target*adaptiveWindow.Seconds() {
+		return false
+	}
+	s.sampled++
+	return true
+}
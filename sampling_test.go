@@ -0,0 +1,251 @@
+package main
+
+import (
+	"math/rand"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPercentFlag(t *testing.T) {
+	var p percentFlag
+	if err := p.Set("42.5"); err != nil || p.Default != 42.5 || p.Methods != nil {
+		t.Errorf("Expected a single percentage, but received '%+v' (%v)", p, err)
+	}
+	if err := p.Set("get=100,POST=1,default=10"); err != nil {
+		t.Fatal(err)
+	}
+	if expectation := "GET=100,POST=1,default=10"; p.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, p.String())
+	}
+	for _, invalid := range []string{"GET", "GET=x", "101", "POST=-1"} {
+		if err := p.Set(invalid); err == nil {
+			t.Errorf("Expected an error for '%s'", invalid)
+		}
+	}
+}
+
+// mirrored counts how many of n requests are mirrored.
+func mirrored(h handler, method, path string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if h.mirror(httptest.NewRequest(method, path, nil), matchRule(h.Rules, path)) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestPerMethodPercentage(t *testing.T) {
+	setFlag(t, "p", "GET=100,POST=1,default=10")
+	h := handler{Randomizer: *rand.New(rand.NewSource(1))}
+	h.Rules = writeRules(t, `[{"pattern": "^/rule", "percent": 50}]`)
+
+	const n = 10000
+	for _, c := range []struct {
+		method, path string
+		min, max     int
+	}{
+		{"GET", "/", n, n},
+		{"POST", "/", 50, 150},
+		{"PUT", "/", 800, 1200},
+		// A method percentage scales the percentage of a matched rule.
+		{"GET", "/rule", 4700, 5300},
+		{"POST", "/rule", 20, 80},
+		{"PUT", "/rule", 4700, 5300},
+	} {
+		if count := mirrored(h, c.method, c.path, n); count < c.min || count > c.max {
+			t.Errorf("Expected %d to %d mirrored %s %s requests, but received '%d'", c.min, c.max, c.method, c.path, count)
+		}
+	}
+}
+
+func TestBucketCohorts(t *testing.T) {
+	setFlag(t, "p.bucket-header", "X-User")
+	setFlag(t, "p.buckets", "100")
+	setFlag(t, "p.active-buckets", "0")
+	setFlag(t, "p", "0")
+	captureLog(t)
+	h := handler{Randomizer: *rand.New(rand.NewSource(1))}
+
+	b := bucket("user-42")
+	for i := 0; i < 10; i++ {
+		if bucket("user-42") != b {
+			t.Fatalf("Expected a stable bucket")
+		}
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", "user-42")
+
+	for _, c := range []struct {
+		active   int
+		mirrored bool
+	}{{0, false}, {b, false}, {b + 1, true}, {100, true}} {
+		recorder := httptest.NewRecorder()
+		serveBuckets(recorder, httptest.NewRequest("PUT", "/buckets?active="+strconv.Itoa(c.active), nil))
+		if recorder.Code != 200 {
+			t.Fatalf("Expected '%d', but received '%d'", 200, recorder.Code)
+		}
+		if h.mirror(req, nil) != c.mirrored {
+			t.Errorf("Expected mirrored '%t' with %d active buckets for bucket %d", c.mirrored, c.active, b)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	serveBuckets(recorder, httptest.NewRequest("POST", "/buckets?active=101", nil))
+	if recorder.Code != 400 {
+		t.Errorf("Expected '%d', but received '%d'", 400, recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	serveBuckets(recorder, httptest.NewRequest("GET", "/buckets", nil))
+	if expectation := `{"active":100,"buckets":100}` + "\n"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+
+	// Requests without the header fall back to the percentage.
+	if h.mirror(httptest.NewRequest("GET", "/", nil), nil) {
+		t.Errorf("Expected a request without the header to follow -p")
+	}
+}
+
+func TestPercentAdjustableAtRuntime(t *testing.T) {
+	setFlag(t, "p", "100")
+	h := handler{Randomizer: *rand.New(rand.NewSource(1))}
+
+	for _, c := range []struct {
+		method, p string
+		code      int
+		body      string
+	}{
+		{"GET", "", 200, `{"default":100}`},
+		{"POST", "0", 200, `{"default":0}`},
+		{"PUT", "GET=50,default=0", 200, `{"default":0,"methods":{"GET":50}}`},
+		{"POST", "101", 400, "percentage 101 is not between 0 and 100"},
+		{"POST", "", 400, `expected 'METHOD=PERCENT', got ""`},
+		{"GET", "", 200, `{"default":0,"methods":{"GET":50}}`},
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, "/percent", strings.NewReader("p="+c.p))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		servePercent(recorder, req)
+		if recorder.Code != c.code {
+			t.Errorf("Expected '%d', but received '%d'", c.code, recorder.Code)
+		}
+		if body := strings.TrimSpace(recorder.Body.String()); !strings.HasPrefix(body, c.body) {
+			t.Errorf("Expected '%s', but received '%s'", c.body, body)
+		}
+	}
+	if count := mirrored(h, "POST", "/", 1000); count != 0 {
+		t.Errorf("Expected no mirrored POST requests, but received '%d'", count)
+	}
+
+	// Requests read the percentage while it is replaced, sharing the
+	// randomizer of the handler like the requests served by copies of it.
+	var wg sync.WaitGroup
+	shared := handler{Randomizer: *newRandomizer(1)}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(h handler) {
+			defer wg.Done()
+			mirrored(h, "GET", "/", 1000)
+		}(shared)
+	}
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("PUT", "/percent?p="+strconv.Itoa(i), nil)
+		servePercent(httptest.NewRecorder(), req)
+	}
+	wg.Wait()
+	if p := samplingPercent(nil, "GET"); p != 99 {
+		t.Errorf("Expected '%v', but received '%v'", 99, p)
+	}
+}
+
+func TestAdaptiveSamplerTargetsRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newAdaptiveSampler(20, func() time.Time { return now })
+	random := rand.New(rand.NewSource(1))
+
+	second := 0
+	for _, phase := range []struct{ requestsPerSecond, seconds, min, max int }{
+		{100, 5, 10, 20},
+		{2000, 5, 10, 20},
+		{10, 5, 10, 10},
+	} {
+		for i := 0; i < phase.seconds; i++ {
+			sampled := 0
+			for j := 0; j < phase.requestsPerSecond; j++ {
+				now = time.Unix(int64(second), int64(j)*int64(time.Second)/int64(phase.requestsPerSecond))
+				if s.Sample(random.Float64(), 1) {
+					sampled++
+				}
+			}
+			if sampled > 20 {
+				t.Errorf("Expected at most '%d' sampled in second %d, but received '%d'", 20, second, sampled)
+			}
+			// The first second of a phase adapts to the new rate.
+			if i > 0 && (sampled < phase.min || sampled > phase.max) {
+				t.Errorf("Expected between '%d' and '%d' sampled at %d requests per second, but received '%d'",
+					phase.min, phase.max, phase.requestsPerSecond, sampled)
+			}
+			second++
+		}
+	}
+}
+
+func TestAdaptiveSamplerFavoursWeightedRequests(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newAdaptiveSampler(20, func() time.Time { return now })
+	random := rand.New(rand.NewSource(1))
+
+	// Two endpoints with the same traffic, one of them three times as critical.
+	critical, normal := 0, 0
+	for second := 0; second < 20; second++ {
+		for j := 0; j < 1000; j++ {
+			now = time.Unix(int64(second), int64(j)*int64(time.Millisecond))
+			weight := 1.0
+			if j%2 == 0 {
+				weight = 3
+			}
+			if s.Sample(random.Float64(), weight) && second > 0 {
+				if weight == 3 {
+					critical++
+				} else {
+					normal++
+				}
+			}
+		}
+	}
+	if total := critical + normal; total < 19*15 || total > 19*20 {
+		t.Errorf("Expected between '%d' and '%d' sampled, but received '%d'", 19*15, 19*20, total)
+	}
+	if critical < 2*normal {
+		t.Errorf("Expected the critical endpoint to be sampled about three times as often, but received '%d' and '%d'", critical, normal)
+	}
+}
+
+func TestMirroredMethods(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "b.methods", "GET, head")
+	captureLog(t)
+
+	serve(h, httptest.NewRequest("HEAD", "/", nil))
+	waitHit(t, prodHits)
+	if r := waitHit(t, altHits); r.Method != "HEAD" {
+		t.Errorf("Expected '%s', but received '%s'", "HEAD", r.Method)
+	}
+
+	// Production still receives the other methods.
+	recorder := serve(h, httptest.NewRequest("POST", "/orders", strings.NewReader("order")))
+	if expectation := "production"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	if r := waitHit(t, prodHits); r.Method != "POST" {
+		t.Errorf("Expected '%s', but received '%s'", "POST", r.Method)
+	}
+	expectNoHit(t, altHits)
+}
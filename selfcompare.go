@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"flag"
+	"log"
+)
+
+var alternateSelfCompare = flag.Bool("b.self-compare", false, "send compared GET, HEAD and OPTIONS requests to the alternate site twice and compare the two responses, to reveal non-deterministic or caching bugs")
+
+var selfCompareMismatches = expvar.NewInt("self_compare_mismatches")
+
+// selfComparable reports whether a request of method may be sent to the
+// alternate site twice.
+func selfComparable(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// selfCompare sends the alternate request of x again, after the first one
+// completed, and logs whether the second response differs from the first.
+// The first alternate body must have been read into x.AlternateBody.
+func selfCompare(x *exchange) {
+	req := x.AlternateRequest.Clone(context.Background())
+	if req.GetBody != nil {
+		req.Body, _ = req.GetBody()
+	}
+	var err error
+	resp := <-handleAlternateRequest(req, &err, nil)
+	if resp == nil {
+		log.Printf("Self-comparison of %s %s (request id %s) failed: %s", req.Method, x.Request.URL.Path, x.RequestID, err)
+		return
+	}
+	status := resp.StatusCode
+	if status == x.Alternate.StatusCode && compareResp(x.AlternateBody, x.Alternate.Header, resp) {
+		if *debug {
+			log.Printf("Alternate deterministic: %s %s (request id %s)", req.Method, x.Request.URL.Path, x.RequestID)
+		}
+		return
+	}
+	selfCompareMismatches.Add(1)
+	log.Printf("Alternate not deterministic: %s %s (request id %s), first %d, second %d",
+		req.Method, x.Request.URL.Path, x.RequestID, x.Alternate.StatusCode, status)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSelfCompareReportsNonDeterministicAlternate(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	var requests int64
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/random" {
+			fmt.Fprintf(w, "response %d", atomic.AddInt64(&requests, 1))
+			return
+		}
+		w.Write([]byte("stable"))
+	}))
+	defer alternate.Close()
+	h := newTestHandler(t, production, alternate)
+	h.SelfCompare = true
+	logs := captureLog(t)
+	mismatches := selfCompareMismatches.Value()
+
+	for _, c := range []struct{ method, target, body string }{
+		{"GET", "/random", ""},
+		{"GET", "/stable", ""},
+		{"POST", "/random", "body"},
+	} {
+		req, id := newRequest(c.method, c.target, strings.NewReader(c.body))
+		serve(h, req)
+		waitComparison(t, logs, id, "Not equal", 1)
+	}
+	waitLog(t, logs, "Alternate not deterministic: GET /random", 1)
+
+	if n := selfCompareMismatches.Value() - mismatches; n != 1 {
+		t.Errorf("Expected '%d' self-comparison mismatch, but received '%d'", 1, n)
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("Expected '%d' requests to '/random', but received '%d'", 3, n)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	liveness        = flag.String("health-path", "/teeproxy-health", "path answered with 200 by teeproxy itself, without contacting a backend, for load balancer health checks; disabled when empty")
+	readiness       = flag.String("ready-path", "/teeproxy-ready", "path answered like -health-path, but with 503 once teeproxy shuts down; disabled when empty")
+	shutdownDelay   = flag.Int("shutdown.delay", 0, "milliseconds between failing -ready-path and closing the listener on SIGTERM or SIGINT, for load balancers to take teeproxy out")
+	shutdownTimeout = flag.Int("shutdown.timeout", 10000, "milliseconds to wait for the requests in flight on shutdown")
+)
+
+// shuttingDown is set once the shutdown begins.
+var shuttingDown atomic.Bool
+
+// serveHealth answers the health and readiness checks of teeproxy itself and
+// reports whether the request was one.
+func serveHealth(w http.ResponseWriter, req *http.Request) bool {
+	status := http.StatusOK
+	switch req.URL.Path {
+	case "":
+		return false
+	case *liveness:
+	case *readiness:
+		if shuttingDown.Load() {
+			status = http.StatusServiceUnavailable
+		}
+	default:
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	if req.Method != "HEAD" {
+		w.Write([]byte(http.StatusText(status) + "\n"))
+	}
+	return true
+}
+
+// shutdownOnSignal shuts server down on SIGTERM or SIGINT, and exits.
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	if err := shutdown(server, time.Duration(*shutdownDelay)*time.Millisecond,
+		time.Duration(*shutdownTimeout)*time.Millisecond); err != nil {
+		log.Fatalf("Failed to shut down gracefully: %s", err)
+	}
+	os.Exit(0)
+}
+
+// shutdown fails the readiness checks, and after delay stops accepting
+// requests and waits up to timeout for those in flight.
+func shutdown(server *http.Server, delay, timeout time.Duration) error {
+	shuttingDown.Store(true)
+	log.Println("Shutting down")
+	time.Sleep(delay)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
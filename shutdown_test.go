@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthPathIsNotProxied(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+
+	for _, path := range []string{"/teeproxy-health", "/teeproxy-ready"} {
+		w := serve(h, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != "OK\n" {
+			t.Errorf("Expected '%d OK', but received '%d %s'", http.StatusOK, w.Code, w.Body.String())
+		}
+	}
+	expectNoHit(t, prodHits)
+	expectNoHit(t, altHits)
+
+	setFlag(t, "health-path", "")
+	serve(h, httptest.NewRequest("GET", "/teeproxy-health", nil))
+	if r := waitHit(t, prodHits); r.URL.Path != "/teeproxy-health" {
+		t.Errorf("Expected '%s', but received '%s'", "/teeproxy-health", r.URL.Path)
+	}
+}
+
+func TestReadinessFailsOnShutdown(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	proxy := httptest.NewServer(newTestHandler(t, production, alternate))
+	defer proxy.Close()
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	captureLog(t)
+	ready := func() int {
+		t.Helper()
+		resp, err := http.Get(proxy.URL + "/teeproxy-ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := ready(); status != http.StatusOK {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusOK, status)
+	}
+	done := make(chan error)
+	go func() { done <- shutdown(proxy.Config, 300*time.Millisecond, time.Second) }()
+	// The listener stays open during the delay, for the checks to fail.
+	deadline := time.Now().Add(250 * time.Millisecond)
+	for ready() != http.StatusServiceUnavailable {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the readiness check to fail once shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a graceful shutdown, but received '%s'", err)
+	}
+	if _, err := http.Get(proxy.URL + "/teeproxy-ready"); err == nil {
+		t.Error("Expected the listener to be closed after the shutdown")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var staticResponses = make(staticResponseFlag)
+
+func init() {
+	flag.Var(staticResponses, "static-response", "answer a path without contacting a backend, as 'PATH=STATUS[:BODY]', can be repeated")
+}
+
+// staticResponse is an answer served by teeproxy itself.
+type staticResponse struct {
+	Status int
+	Body   string
+}
+
+// staticResponseFlag maps request paths to the responses served for them.
+type staticResponseFlag map[string]staticResponse
+
+func (f staticResponseFlag) String() string {
+	var s []string
+	for path, r := range f {
+		s = append(s, fmt.Sprintf("%s=%d:%s", path, r.Status, r.Body))
+	}
+	sort.Strings(s)
+	return strings.Join(s, " ")
+}
+
+func (f staticResponseFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected 'PATH=STATUS[:BODY]', got %q", value)
+	}
+	status, body := value[i+1:], ""
+	if j := strings.Index(status, ":"); j >= 0 {
+		status, body = status[:j], status[j+1:]
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 100 || code > 999 {
+		return fmt.Errorf("invalid status %q", status)
+	}
+	f[value[:i]] = staticResponse{Status: code, Body: body}
+	return nil
+}
+
+// serveStatic answers the request if a static response is configured for its
+// path and reports whether it did.
+func serveStatic(w http.ResponseWriter, req *http.Request) bool {
+	r, ok := staticResponses[req.URL.Path]
+	if !ok {
+		return false
+	}
+	w.WriteHeader(r.Status)
+	if req.Method != "HEAD" {
+		w.Write([]byte(r.Body))
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaticResponseSkipsBackends(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	for _, value := range []string{"/ready=200:ready: yes", "/favicon.ico=204"} {
+		if err := staticResponses.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		delete(staticResponses, "/ready")
+		delete(staticResponses, "/favicon.ico")
+	}()
+
+	recorder := serve(h, httptest.NewRequest("GET", "/ready", nil))
+	if recorder.Code != 200 {
+		t.Errorf("Expected '%d', but received '%d'", 200, recorder.Code)
+	}
+	if expectation := "ready: yes"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	recorder = serve(h, httptest.NewRequest("GET", "/favicon.ico", nil))
+	if recorder.Code != 204 || recorder.Body.Len() != 0 {
+		t.Errorf("Expected an empty '%d', but received '%d' '%s'", 204, recorder.Code, recorder.Body.String())
+	}
+	expectNoHit(t, prodHits)
+	expectNoHit(t, altHits)
+
+	if err := staticResponses.Set("/bad=ok"); err == nil {
+		t.Errorf("Expected an error for an invalid status")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+var streamBuffer = flag.Int("compare.stream-buffer", 64, "comparison results queued per /compare/stream subscriber before new ones are dropped")
+
+var streamDropped = expvar.NewInt("stream_dropped")
+
+// The debug listener streams the comparison results on /compare/stream as
+// server-sent events.
+func init() {
+	http.HandleFunc("/compare/stream", serveComparisonStream)
+}
+
+var comparisonStream = newBroadcaster()
+
+// broadcaster hands comparison results to its subscribers. Each has a bounded
+// buffer, and results are dropped for subscribers too slow to keep up, so that
+// they never hold up the comparisons.
+type broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan *comparisonResult]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subscribers: make(map[chan *comparisonResult]struct{})}
+}
+
+func (b *broadcaster) Subscribe(buffer int) chan *comparisonResult {
+	ch := make(chan *comparisonResult, buffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *broadcaster) Unsubscribe(ch chan *comparisonResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, ch)
+}
+
+// Publish queues r for every subscriber with room for it.
+func (b *broadcaster) Publish(r *comparisonResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- r:
+		default:
+			streamDropped.Add(1)
+		}
+	}
+}
+
+// serveComparisonStream sends every comparison result as a 'comparison' event
+// with the result as JSON, until the client goes away.
+func serveComparisonStream(w http.ResponseWriter, req *http.Request) {
+	rc := http.NewResponseController(w)
+	results := comparisonStream.Subscribe(*streamBuffer)
+	defer comparisonStream.Unsubscribe(results)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case r := <-results:
+			data, _ := json.Marshal(r)
+			fmt.Fprintf(w, "event: comparison\ndata: %s\n\n", data)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribers returns the number of subscribers of the comparison stream.
+func subscribers() int {
+	comparisonStream.mu.Lock()
+	defer comparisonStream.mu.Unlock()
+	return len(comparisonStream.subscribers)
+}
+
+func TestComparisonStreamSendsEvents(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	captureLog(t)
+	stream := httptest.NewServer(http.HandlerFunc(serveComparisonStream))
+	defer stream.Close()
+
+	resp, err := http.Get(stream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected '%s', but received '%s'", "text/event-stream", ct)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for subscribers() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serve(h, httptest.NewRequest("GET", "/streamed", nil))
+
+	events := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				events <- event
+				return
+			}
+			event += line + "\n"
+		}
+	}()
+	var event string
+	select {
+	case event = <-events:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an event, but received none")
+	}
+	if !strings.HasPrefix(event, "event: comparison\ndata: ") {
+		t.Fatalf("Expected a comparison event, but received '%s'", event)
+	}
+	var r comparisonResult
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "event: comparison\ndata: ")), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Path != "/streamed" || r.Equal || r.RequestID == "" || r.ProductionStatus != 200 {
+		t.Errorf("Expected the mismatch of '/streamed', but received '%+v'", r)
+	}
+}
+
+func TestComparisonStreamDropsForSlowSubscribers(t *testing.T) {
+	b := newBroadcaster()
+	slow := b.Subscribe(1)
+	dropped := streamDropped.Value()
+	for i := 0; i < 3; i++ {
+		b.Publish(&comparisonResult{Path: "/"})
+	}
+	if n := streamDropped.Value() - dropped; n != 2 {
+		t.Errorf("Expected '%d' dropped results, but received '%d'", 2, n)
+	}
+	if len(slow) != 1 {
+		t.Errorf("Expected '%d' queued result, but received '%d'", 1, len(slow))
+	}
+	b.Unsubscribe(slow)
+	b.Publish(&comparisonResult{Path: "/"})
+	if n := streamDropped.Value() - dropped; n != 2 {
+		t.Errorf("Expected no drops without subscribers, but received '%d'", n-2)
+	}
+}
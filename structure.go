@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var compareStructureOnly = flag.Bool("compare.structure-only", false, "compare only the structure of JSON bodies, their field paths and types, with a baseline recorded per path from the first production response, ignoring values")
+
+var structureDrifts = expvar.NewInt("structure_drifts")
+
+// maxStructureBaselines bounds the paths with a baseline. Responses to further
+// paths are compared with the structure of their production response.
+const maxStructureBaselines = 10000
+
+// structure maps the field paths of a JSON document to their types, e.g.
+// "$.items[].id" to "number". A field with several types, like in the items
+// of an array, has them all, e.g. "null|string".
+type structure map[string]string
+
+// structureOf returns the structure of a JSON document.
+func structureOf(data []byte) (structure, error) {
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	s := make(structure)
+	s.add("$", document)
+	return s, nil
+}
+
+func (s structure) add(path string, v interface{}) {
+	var kind string
+	switch v := v.(type) {
+	case nil:
+		kind = "null"
+	case bool:
+		kind = "boolean"
+	case float64:
+		kind = "number"
+	case string:
+		kind = "string"
+	case []interface{}:
+		kind = "array"
+		for _, e := range v {
+			s.add(path+"[]", e)
+		}
+	case map[string]interface{}:
+		kind = "object"
+		for name, e := range v {
+			s.add(path+"."+name, e)
+		}
+	}
+	if existing, ok := s[path]; ok && !strings.Contains("|"+existing+"|", "|"+kind+"|") {
+		kinds := append(strings.Split(existing, "|"), kind)
+		sort.Strings(kinds)
+		kind = strings.Join(kinds, "|")
+	}
+	s[path] = kind
+}
+
+// Diff describes how other differs from s, a line per added, removed or
+// changed field, or returns "" if they have the same structure.
+func (s structure) Diff(other structure) string {
+	var lines []string
+	for _, path := range sortedKeys(other) {
+		if kind, ok := s[path]; !ok {
+			lines = append(lines, fmt.Sprintf("+ %s (%s)", path, other[path]))
+		} else if kind != other[path] {
+			lines = append(lines, fmt.Sprintf("~ %s: %s -> %s", path, kind, other[path]))
+		}
+	}
+	for _, path := range sortedKeys(s) {
+		if _, ok := other[path]; !ok {
+			lines = append(lines, fmt.Sprintf("- %s (%s)", path, s[path]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// structureBaselines holds the baseline structure of the responses per path,
+// for -compare.structure-only.
+type structureBaselines struct {
+	mu        sync.Mutex
+	baselines map[string]structure
+}
+
+func newStructureBaselines() *structureBaselines {
+	return &structureBaselines{baselines: make(map[string]structure)}
+}
+
+// baseline returns the baseline of path, recording prod as such on first
+// sight.
+func (b *structureBaselines) baseline(path string, prod structure) structure {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.baselines[path]; ok {
+		return s
+	}
+	if len(b.baselines) < maxStructureBaselines {
+		b.baselines[path] = prod
+	}
+	return prod
+}
+
+// compareExchange compares the structure of the alternate response of the
+// exchange with the baseline of its path, storing the drift in x.Diff. Bodies
+// that are not JSON are compared with compareResp.
+func (b *structureBaselines) compareExchange(x *exchange) bool {
+	if x.Alternate == nil {
+		return false
+	}
+	altBody, _ := ioutil.ReadAll(x.Alternate.Body)
+	x.Alternate.Body.Close()
+	x.Alternate.Body = ioutil.NopCloser(bytes.NewReader(altBody))
+
+	prod, prodErr := structureOf(decodedBody(x.ProductionBody, productionHeader(x).Get("Content-Encoding")))
+	alt, altErr := structureOf(decodedBody(altBody, x.Alternate.Header.Get("Content-Encoding")))
+	if prodErr != nil || altErr != nil {
+		return compareResp(x.ProductionBody, productionHeader(x), x.Alternate)
+	}
+	if x.Diff = b.baseline(x.Request.URL.Path, prod).Diff(alt); x.Diff != "" {
+		structureDrifts.Add(1)
+		return false
+	}
+	return true
+}
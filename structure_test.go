@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStructureDiff(t *testing.T) {
+	baseline, _ := structureOf([]byte(`{"id": 1, "tags": ["a"], "owner": {"name": "x", "age": 3}}`))
+	for _, c := range []struct {
+		body, diff string
+	}{
+		{`{"id": 2, "tags": [], "owner": {"name": "y", "age": 4}}`, "- $.tags[] (string)"},
+		{`{"id": 2, "tags": ["b", "c"], "owner": {"name": "y", "age": 4}}`, ""},
+		{`{"id": "2", "tags": ["b", null], "owner": {"name": "y"}}`,
+			"~ $.id: number -> string\n~ $.tags[]: string -> null|string\n- $.owner.age (number)"},
+		{`{"id": 2, "tags": ["b"], "owner": {"name": "y", "age": 4, "email": ""}}`, "+ $.owner.email (string)"},
+	} {
+		s, err := structureOf([]byte(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := baseline.Diff(s); diff != c.diff {
+			t.Errorf("Expected '%s', but received '%s'", c.diff, diff)
+		}
+	}
+}
+
+func TestStructureDriftIsReported(t *testing.T) {
+	production, _ := newBackend(t, `{"id": 1, "name": "production"}`)
+	var drifted int32
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&drifted) == 1 {
+			w.Write([]byte(`{"id": 2, "name": "alternate", "debug": true}`))
+		} else {
+			w.Write([]byte(`{"id": 2, "name": "alternate"}`))
+		}
+	}))
+	defer alternate.Close()
+	h := newTestHandler(t, production, alternate)
+	h.Structures = newStructureBaselines()
+	logs := captureLog(t)
+	drifts := structureDrifts.Value()
+
+	// Values are ignored.
+	req, id := newRequest("GET", "/users/1", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+
+	atomic.StoreInt32(&drifted, 1)
+	req, id = newRequest("GET", "/users/1", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Not equal", 1)
+	if expectation := "+ $.debug (boolean)"; !strings.Contains(logs.String(), expectation) {
+		t.Errorf("Expected '%s' in the log, but received '%s'", expectation, logs.String())
+	}
+	if n := structureDrifts.Value() - drifts; n != 1 {
+		t.Errorf("Expected '%d' structure drift, but received '%d'", 1, n)
+	}
+}
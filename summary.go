@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	compareLogRate  = flag.Float64("compare.log-rate", 0, "mismatch log lines per second, excess mismatches are only counted in the summary; 0 is unlimited")
+	warmup          = flag.Duration("compare.warmup", 0, "time after startup during which traffic is mirrored but comparisons are not reported, e.g. 90s or 5m")
+	summaryInterval = flag.Int("compare.summary", 0, "seconds between logged summaries of the comparisons, 0 disables them unless -compare.log-rate is set, which defaults them to 60")
+)
+
+// comparisonSummary counts comparisons for the periodic summary and limits
+// the rate of mismatch log lines with a token bucket holding up to one
+// second's worth of lines.
+type comparisonSummary struct {
+	rate float64 // lines per second, 0 for no limit
+	now  func() time.Time
+
+	mu         sync.Mutex
+	tokens     float64
+	last       time.Time // when tokens were last added
+	equal      int
+	notEqual   int
+	flaky      int
+	suppressed int
+}
+
+func newComparisonSummary(rate float64, now func() time.Time) *comparisonSummary {
+	return &comparisonSummary{rate: rate, now: now, tokens: max(rate, 1), last: now()}
+}
+
+// Count counts a comparison for the summary by its result: equal, not_equal
+// or flaky.
+func (s *comparisonSummary) Count(result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch result {
+	case "equal":
+		s.equal++
+	case "flaky":
+		s.flaky++
+	default:
+		s.notEqual++
+	}
+}
+
+// Allow reports whether a mismatch line may be logged, and counts it as
+// suppressed otherwise.
+func (s *comparisonSummary) Allow() bool {
+	if s.rate <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.tokens = min(s.tokens+now.Sub(s.last).Seconds()*s.rate, max(s.rate, 1))
+	s.last = now
+	if s.tokens < 1 {
+		s.suppressed++
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Log logs the counts since the last summary and resets them.
+func (s *comparisonSummary) Log() {
+	s.mu.Lock()
+	equal, notEqual, flaky, suppressed := s.equal, s.notEqual, s.flaky, s.suppressed
+	s.equal, s.notEqual, s.flaky, s.suppressed = 0, 0, 0, 0
+	s.mu.Unlock()
+	log.Printf("Comparisons: %d equal, %d not equal, %d flaky, %d mismatches not logged", equal, notEqual, flaky, suppressed)
+}
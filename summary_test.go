@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMismatchLogRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newComparisonSummary(5, func() time.Time { return now })
+
+	allowed := 0
+	for i := 0; i < 1000; i++ {
+		// 100 mismatches per second over 10 seconds.
+		now = time.Unix(0, int64(i)*int64(10*time.Millisecond))
+		if s.Allow() {
+			allowed++
+		}
+	}
+	// 5 per second plus the initial burst of 5.
+	if allowed < 50 || allowed > 55 {
+		t.Errorf("Expected between '%d' and '%d' logged mismatches, but received '%d'", 50, 55, allowed)
+	}
+	if s.suppressed != 1000-allowed {
+		t.Errorf("Expected '%d' suppressed mismatches, but received '%d'", 1000-allowed, s.suppressed)
+	}
+}
+
+func TestSuppressedMismatchesAreSummarized(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	now := time.Unix(0, 0)
+	h.Summary = newComparisonSummary(3, func() time.Time { return now })
+	logs := captureLog(t)
+
+	for i := 0; i < 20; i++ {
+		serve(h, httptest.NewRequest("GET", "/flood", nil))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for comparisonQueueDepth.Value() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := strings.Count(logs.String(), "Not equal: GET /flood"); n != 3 {
+		t.Errorf("Expected '%d' logged mismatches, but received '%d'", 3, n)
+	}
+	h.Summary.Log()
+	if expectation := "Comparisons: 0 equal, 20 not equal, 0 flaky, 17 mismatches not logged"; !strings.Contains(logs.String(), expectation) {
+		t.Errorf("Expected '%s', but received '%s'", expectation, logs.String())
+	}
+}
+
+func TestComparisonsAreNotReportedDuringWarmup(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	h.WarmupUntil = time.Now().Add(time.Hour)
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitHit(t, altHits)
+	deadline := time.Now().Add(2 * time.Second)
+	for comparisonQueueDepth.Value() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if countComparisons(logs, id, "Equal") != 0 {
+		t.Errorf("Expected no reported comparison during the warmup, but received '%s'", logs.String())
+	}
+
+	h.WarmupUntil = time.Now()
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitComparison(t, logs, id, "Equal", 1)
+}
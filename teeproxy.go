@@ -2,66 +2,222 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
-	"net/url"
+	"net/http/httptrace"
+	"os"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Console flags
 var (
-	listen                = flag.String("l", ":8888", "port to accept requests")
-	targetProduction      = flag.String("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production")
-	altTarget             = flag.String("b", "localhost:8081", "where testing traffic goes. response are skipped. http://localhost:8081/test")
-	debug                 = flag.Bool("debug", false, "more logging, showing ignored output")
-	productionTimeout     = flag.Int("a.timeout", 2500, "timeout in milliseconds for production traffic")
-	alternateTimeout      = flag.Int("b.timeout", 1000, "timeout in milliseconds for alternate site traffic")
-	productionHostRewrite = flag.Bool("a.rewrite", false, "rewrite the host header when proxying production traffic")
-	alternateHostRewrite  = flag.Bool("b.rewrite", false, "rewrite the host header when proxying alternate site traffic")
-	percent               = flag.Float64("p", 100.0, "float64 percentage of traffic to send to testing")
-	tlsPrivateKey         = flag.String("key.file", "", "path to the TLS private key file")
-	tlsCertificate        = flag.String("cert.file", "", "path to the TLS certificate file")
-	forwardClientIP       = flag.Bool("forward-client-ip", false, "enable forwarding of the client IP to the backend using the 'X-Forwarded-For' and 'Forwarded' headers")
-	closeConnections      = flag.Bool("close-connections", false, "close connections to the clients and backends")
+	listen                   = flag.String("l", ":8888", "port to accept requests")
+	targetProduction         = flag.String("a", "localhost:8080", "where production traffic goes. http://localhost:8080/production; several comma-separated hosts, optionally weighted with '=', share it, e.g. 'prod1:8080=3,prod2:8080'")
+	debug                    = flag.Bool("debug", false, "more logging, showing ignored output")
+	productionTimeout        = flag.Int64("a.timeout", 2500, "timeout in milliseconds for production traffic, adjustable at runtime on /config/timeout/a of the debug listener")
+	alternateTimeout         = flag.Int64("b.timeout", 1000, "timeout in milliseconds for alternate site traffic, adjustable at runtime on /config/timeout/b of the debug listener")
+	productionHostRewrite    = flag.Bool("a.rewrite", false, "rewrite the host header when proxying production traffic")
+	alternateHostRewrite     = flag.Bool("b.rewrite", false, "rewrite the host header when proxying alternate site traffic")
+	productionBodyTimeout    = flag.Int("a.body-timeout", 0, "milliseconds to receive the production response body after its headers, 0 means no limit")
+	productionHost           = flag.String("a.host", "", "Host header of production traffic, also presented as the TLS server name unless -a.tls-servername is set")
+	alternateHost            = flag.String("b.host", "", "Host header of alternate site traffic, also presented as the TLS server name unless -b.tls-servername is set")
+	productionScheme         = flag.String("a.scheme", "http", "scheme of production traffic: http or https")
+	alternateScheme          = flag.String("b.scheme", "http", "scheme of alternate site traffic: http or https")
+	productionServerName     = flag.String("a.tls-servername", "", "host name to present and verify when connecting to an https production target, instead of the one dialed")
+	alternateServerName      = flag.String("b.tls-servername", "", "host name to present and verify when connecting to an https alternate target, instead of the one dialed")
+	productionInsecure       = flag.Bool("a.insecure-skip-verify", false, "accept any certificate of an https production target, e.g. a self-signed one")
+	alternateInsecure        = flag.Bool("b.insecure-skip-verify", false, "accept any certificate of an https alternate target, e.g. a self-signed one")
+	tlsPrivateKey            = flag.String("key.file", "", "path to the TLS private key file")
+	tlsCertificate           = flag.String("cert.file", "", "path to the TLS certificate file")
+	forwardClientIP          = flag.Bool("forward-client-ip", false, "enable forwarding of the client IP to the backend using the 'X-Forwarded-For' and 'Forwarded' headers")
+	forwardProtoHost         = flag.Bool("forward-proto-host", false, "with -forward-client-ip, also forward the scheme and host the client used in 'X-Forwarded-Proto', 'X-Forwarded-Host' and the 'Forwarded' header")
+	cancelOnLoss             = flag.Bool("b.cancel-on-loss", false, "cancel the alternate request when production answers first, without comparing, for latency experiments")
+	alternateNoCookies       = flag.Bool("b.no-cookies", false, "strip the Cookie header from alternate site traffic")
+	alternateAcceptEncoding  = flag.String("b.accept-encoding", "", "Accept-Encoding header of alternate site traffic instead of the client's, e.g. 'identity' for uncompressed responses")
+	alternateMaxConnsPerHost = flag.Int("b.max-conns-per-host", 0, "maximum number of connections to the alternate site, 0 means no limit")
+	alternateMaxConnsWait    = flag.Int("b.max-conns-wait", 100, "milliseconds an alternate request waits for a connection before it is skipped")
+	compareMode              = flag.String("compare-mode", "json", "how alternate responses are compared: none to only drain them, bytes to compare their bodies byte for byte, or json to compare JSON bodies as documents")
+	closeConnections         = flag.Bool("close-connections", false, "close connections to the clients and backends after every request; by default they are kept alive, including the alternate ones, which were always closed before")
+	productionConnect        = flag.Int("a.connect-timeout", 0, "timeout in milliseconds for connecting to production, TLS handshake included; 0 leaves it to -a.timeout")
+	alternateConnect         = flag.Int("b.connect-timeout", 0, "timeout in milliseconds for connecting to the alternate sites, TLS handshake included; 0 leaves it to -b.timeout")
+	productionKeepAlive      = flag.Int("a.keepalive", 30000, "interval in milliseconds of TCP keep-alive probes on connections to production, 0 disables them")
+	alternateKeepAlive       = flag.Int("b.keepalive", 30000, "interval in milliseconds of TCP keep-alive probes on connections to the alternate sites, 0 disables them")
+	serverTimeout            = flag.Int("server.timeout", 0, "milliseconds after which a client receives a 503 regardless of the backends, 0 means no limit; comparisons still complete")
+	bodyReadTimeout          = flag.Int("body-read-timeout", 10000, "milliseconds to receive a request body before the request is rejected with a 400")
+	verifyDuplication        = flag.Bool("verify-duplication", false, "checksum duplicated request bodies against the source and log divergences")
+	preserveRawURI           = flag.Bool("preserve-raw-uri", false, "forward the request URI byte for byte instead of normalizing it")
+	errorFormat              = flag.String("error-format", "json", "body format of errors returned by teeproxy itself: json or plain")
+	maxResponseSize          = flag.Int64("max-response-size", 0, "bytes of a production response body forwarded to the client, 0 is unlimited")
+	maxBufferBytes           = flag.Int64("max-buffer-bytes", 0, "bytes of a request body buffered to duplicate it; larger bodies are streamed to production only, without mirroring, 0 is unlimited")
+	oversizedAction          = flag.String("max-response-size.action", "truncate", "what to do with bodies beyond -max-response-size: truncate, or error to answer with a 502")
+	headerConflict           = flag.String("response-header-conflict", "backend", "which of the headers set by both teeproxy and the production response reach the client: backend, teeproxy, or append for both")
+	noMirrorHeader           = flag.String("no-mirror-header", "", "header whose presence disables mirroring of the request, honored from -no-mirror-trusted sources only")
+	noMirrorTrusted          cidrList
+	trustedProxies           cidrList
+	alternateTargets         = targetList{targets: []string{"localhost:8081"}}
 )
 
+func init() {
+	flag.Var(&alternateTargets, "b", "where testing traffic goes. response are skipped. http://localhost:8081/test; can be repeated to mirror to several alternate sites")
+	flag.Var(&noMirrorTrusted, "no-mirror-trusted", "comma-separated IPs or CIDRs allowed to disable mirroring with -no-mirror-header")
+	flag.Var(&trustedProxies, "trusted-proxies", "comma-separated IPs or CIDRs of proxies whose forwarding headers are extended with -forward-client-ip; those of other peers are replaced. Every peer is trusted if empty")
+}
+
+// productionTransport and alternateTransport are shared by all production and
+// alternate requests, respectively, so that their connections are reused.
+var productionTransport, alternateTransport *http.Transport
+
 // Sets the request URL.
 //
 // This turns a inbound request (a request without URL) into an outbound request.
-func setRequestTarget(request *http.Request, target *string) {
-	URL, err := url.Parse("http://" + *target + request.URL.String())
-	if err != nil {
-		log.Println(err)
+// Only the scheme and host of the URL are set, so that its path and query are
+// forwarded as received, without being re-encoded.
+//
+// A request in absolute form (e.g. "GET http://host/path") keeps only its path
+// and query, so that the outbound URL is not garbled.
+func setRequestTarget(request *http.Request, scheme string, target *string) {
+	URL := *request.URL
+	URL.Scheme, URL.Host, URL.User = scheme, *target, nil
+	if URL.Path == "" && URL.Opaque == "" {
+		URL.Path = "/"
 	}
-	request.URL = URL
+	request.URL = &URL
 }
 
-// Sends a request and returns the response.
-func handleRequest(request *http.Request, timeout time.Duration) *http.Response {
+// newTransport returns a transport dialing with dialer. The stages of a
+// request up to its response headers are bounded by deadlineTransport instead
+// of the transport, so that the timeouts can change at runtime; timeout only
+// bounds the wait for a 100 Continue. The TLS handshake is bounded by the
+// timeout of the dialer, if any, as part of connecting.
+//
+// HTTPS targets are dialed over TLS by the transport itself. serverName, if
+// not empty, overrides the host name used for SNI and to verify their
+// certificate, e.g. when they are dialed by IP; with insecure their
+// certificate is not verified at all.
+func newTransport(timeout time.Duration, dialer *net.Dialer, serverName string, insecure bool) *http.Transport {
 	transport := &http.Transport{
-		// NOTE(girone): DialTLS is not needed here, because the teeproxy works
-		// as an SSL terminator.
-		Dial: (&net.Dialer{ // go1.8 deprecated: Use DialContext instead
-			Timeout:   timeout,
-			KeepAlive: 10 * timeout,
-		}).Dial,
+		DialContext: dialer.DialContext,
 		// Close connections to the production and alternative servers?
-		DisableKeepAlives: *closeConnections,
-		//IdleConnTimeout: timeout,  // go1.8
-		TLSHandshakeTimeout:   timeout,
-		ResponseHeaderTimeout: timeout,
+		DisableKeepAlives:     *closeConnections,
+		TLSHandshakeTimeout:   dialer.Timeout,
 		ExpectContinueTimeout: timeout,
 	}
+	transport.DialContext = guardDial(transport.DialContext, allowedBackends)
+	if *maxRequestsPerConn > 0 {
+		transport.DialContext = countRequests(transport.DialContext)
+	}
+	if serverName != "" || insecure {
+		transport.TLSClientConfig = &tls.Config{ServerName: serverName, InsecureSkipVerify: insecure}
+	}
+	return transport
+}
+
+// deadlineTransport bounds every round trip by a timeout, up to the response
+// headers. Once it elapses the dial or read in flight is canceled, and the
+// round trip fails with a timeout. The round trip is also canceled along with
+// the context of the request, e.g. when the client goes away, but not when
+// that context times out: -server.timeout lets the comparison complete.
+type deadlineTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+func (t deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parent := req.Context()
+	ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+	stopParent := context.AfterFunc(parent, func() {
+		if errors.Is(parent.Err(), context.Canceled) {
+			cancel()
+		}
+	})
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(t.timeout, func() {
+		timedOut.Store(true)
+		cancel()
+	})
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		stopParent()
+		cancel()
+		if timedOut.Load() {
+			err = fmt.Errorf("%w after %s: %v", context.DeadlineExceeded, t.timeout, err)
+		}
+		return nil, err
+	}
+	timer.Stop()
+	resp.Body = &cancelingBody{resp.Body, func() {
+		stopParent()
+		cancel()
+	}}
+	return resp, nil
+}
+
+// cancelingBody releases the context of a round trip once the body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel func()
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// tlsServerName returns the TLS server name of a backend: serverName if set,
+// or else the name in host, so that the handshake matches a Host header set by
+// -a.host or -b.host. An empty name means the dialed host, which -a.rewrite
+// and -b.rewrite put into the Host header.
+func tlsServerName(serverName, host string) string {
+	if serverName != "" || host == "" {
+		return serverName
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return strings.Trim(host, "[]")
+}
+
+// preserveRequestURI makes an outbound request use the path and query of
+// requestURI byte for byte, instead of the re-encoded URL. Request targets not
+// in origin form (e.g. "*") are left alone.
+func preserveRequestURI(request *http.Request, requestURI string) {
+	if !strings.HasPrefix(requestURI, "/") {
+		return
+	}
+	path, query := requestURI, ""
+	if i := strings.Index(requestURI, "?"); i >= 0 {
+		path, query = requestURI[:i], requestURI[i+1:]
+		request.URL.ForceQuery = query == ""
+	}
+	if strings.HasPrefix(path, "//") {
+		// An opaque "//..." is taken as an authority, so send the absolute form.
+		path = "//" + request.URL.Host + path
+	}
+	request.URL.Opaque = path
+	request.URL.RawQuery = query
+}
+
+// Sends a request and returns the response.
+func handleRequest(request *http.Request, timeout time.Duration) *http.Response {
+	transport := deadlineTransport{productionTransport, timeout}
 	// Do not use http.Client here, because it's higher level and processes
 	// redirects internally, which is not what we want.
 	//client := &http.Client{
@@ -69,177 +225,854 @@ func handleRequest(request *http.Request, timeout time.Duration) *http.Response
 	//	Transport: transport,
 	//}
 	//response, err := client.Do(request)
+	start := time.Now()
 	response, err := transport.RoundTrip(request)
 	if err != nil {
-		log.Println("Request failed:", err)
+		logUpstreamError("production", request, time.Since(start), err)
 	}
 	return response
 }
 
-// Sends a request and returns channel to wait for response.
-func handleAsyncRequest(request *http.Request, timeout time.Duration) chan *http.Response {
-	ch := make(chan *http.Response)
-	transport := &http.Transport{
-		// NOTE(girone): DialTLS is not needed here, because the teeproxy works
-		// as an SSL terminator.
-		Dial: (&net.Dialer{ // go1.8 deprecated: Use DialContext instead
-			Timeout:   timeout,
-			KeepAlive: 10 * timeout,
-		}).Dial,
-		// Close connections to the production and alternative servers?
-		DisableKeepAlives: *closeConnections,
-		//IdleConnTimeout: timeout,  // go1.8
-		TLSHandshakeTimeout:   timeout,
-		ResponseHeaderTimeout: timeout,
-		ExpectContinueTimeout: timeout,
+// Sends a request over the shared production transport and returns channel to wait for
+// response, retrying it as configured by -a.retries. A failure is stored in
+// errp before the channel yields nil, and the time until the response in
+// latency, if not nil.
+func handleAsyncRequest(request *http.Request, timeout time.Duration, errp *error, latency *time.Duration) chan *http.Response {
+	// Buffered, so that the goroutine completes even if nobody receives.
+	ch := make(chan *http.Response, 1)
+	transport := deadlineTransport{productionTransport, timeout}
+	request, retire := limitRequestsPerConn(request, *maxRequestsPerConn)
+	retry := productionRetryPolicy()
+	go func() {
+		start := time.Now()
+		response, err := retry.RoundTrip(transport, request)
+		elapsed := time.Since(start)
+		observeBackend("production", request.URL.Host, elapsed.Seconds(), err)
+		if err != nil {
+			logUpstreamError("production", request, elapsed, err)
+		} else {
+			backendLatency["production"].Observe(elapsed.Seconds())
+		}
+		*errp = err
+		if latency != nil {
+			*latency = elapsed
+		}
+		ch <- retire(response)
+	}()
+	return ch
+}
+
+// drainResponse receives the response from ch and closes its body, releasing
+// its connection.
+func drainResponse(ch chan *http.Response) {
+	if resp := <-ch; resp != nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+// newDialer returns a dialer giving up connecting after connectTimeout
+// milliseconds, if not 0, and sending TCP keep-alive probes every keepAlive
+// milliseconds, or none if it is 0.
+func newDialer(keepAlive, connectTimeout int) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(connectTimeout) * time.Millisecond,
+		KeepAlive: time.Duration(keepAlive) * time.Millisecond,
+	}
+	if keepAlive <= 0 {
+		// A zero KeepAlive of the dialer is a default, not no probes.
+		dialer.KeepAlive = -1
 	}
+	return dialer
+}
+
+// newProductionTransport returns the transport shared by all production
+// requests.
+func newProductionTransport() *http.Transport {
+	return newTransport(backendTimeout(productionTimeout), newDialer(*productionKeepAlive, *productionConnect), tlsServerName(*productionServerName, *productionHost), *productionInsecure)
+}
+
+// newAlternateTransport returns the transport shared by all alternate
+// requests. It is shared so that -b.max-conns-per-host applies across them.
+func newAlternateTransport() *http.Transport {
+	transport := newTransport(backendTimeout(alternateTimeout), newDialer(*alternateKeepAlive, *alternateConnect), tlsServerName(*alternateServerName, *alternateHost), *alternateInsecure)
+	transport.MaxConnsPerHost = *alternateMaxConnsPerHost
+	return transport
+}
+
+// Sends a request over the shared alternate transport and returns channel to
+// wait for response.
+//
+// When -b.max-conns-per-host is reached the request waits for a connection for
+// at most -b.max-conns-wait, after which it is skipped and the channel yields
+// nil. A failure is stored in errp before the channel yields nil, and the
+// time until the response in latency, if not nil.
+func handleAlternateRequest(request *http.Request, errp *error, latency *time.Duration) chan *http.Response {
+	// Buffered, so that the goroutine completes even if nobody receives.
+	ch := make(chan *http.Response, 1)
+	transport := deadlineTransport{alternateTransport, backendTimeout(alternateTimeout)}
+	request, retire := limitRequestsPerConn(request, *maxRequestsPerConn)
 	go func() {
+		// Cancel the request if it is still queued for a connection once the
+		// wait is over. The states are 0 (queued), 1 (got a connection) and
+		// 2 (gave up).
+		var state int32
+		if *alternateMaxConnsPerHost > 0 {
+			ctx, cancel := context.WithCancel(request.Context())
+			defer cancel()
+			wait := time.AfterFunc(time.Duration(*alternateMaxConnsWait)*time.Millisecond, func() {
+				if atomic.CompareAndSwapInt32(&state, 0, 2) {
+					cancel()
+				}
+			})
+			defer wait.Stop()
+			trace := &httptrace.ClientTrace{
+				GotConn: func(httptrace.GotConnInfo) {
+					atomic.CompareAndSwapInt32(&state, 0, 1)
+				},
+			}
+			request = request.WithContext(httptrace.WithClientTrace(ctx, trace))
+		}
+		start := time.Now()
 		response, err := transport.RoundTrip(request)
-		if err != nil {
-			log.Println("Request failed:", err)
+		elapsed := time.Since(start)
+		if err == nil {
+			backendLatency["alternate"].Observe(elapsed.Seconds())
+		}
+		switch {
+		case err != nil && atomic.LoadInt32(&state) == 2:
+			alternateQueueTimeouts.Add(1)
+			if *debug {
+				log.Println("Skipped alternate request waiting for a connection:", err)
+			}
+		case errors.Is(err, context.Canceled):
+			// Canceled with -b.cancel-on-loss, which is no failure.
+			promRequests.Inc("backend", "alternate", "target", request.URL.Host)
+		default:
+			if err != nil {
+				logUpstreamError("alternate", request, elapsed, err)
+			}
+			observeBackend("alternate", request.URL.Host, elapsed.Seconds(), err)
 		}
-		ch <- response
+		*errp = err
+		if latency != nil {
+			*latency = elapsed
+		}
+		ch <- retire(response)
 	}()
 	return ch
 }
 
-// process response. Return true if resp is not nil
-func processResponse(resp *http.Response, w http.ResponseWriter) []byte {
-	if resp != nil {
-		defer resp.Body.Close()
+// process response. Returns the forwarded body, or nil if resp is nil.
+//
+// A nil resp means the production request failed with err; the client then
+// receives a 504 if it timed out, or else the -maintenance-page or a 502, each
+// carrying requestID. A body not received within -a.body-timeout is answered
+// with a 504 as well. Bodies beyond -max-response-size are truncated or
+// answered with a 502, depending on -max-response-size.action.
+func processResponse(resp *http.Response, err error, w http.ResponseWriter, requestID string) []byte {
+	recordStatus("production", resp)
+	if resp == nil {
+		if isTimeout(err) {
+			writeError(w, http.StatusGatewayTimeout, requestID, "production backend timed out")
+			return nil
+		}
+		if *maintenancePage != "" && serveMaintenancePage(w, requestID) {
+			return nil
+		}
+		writeError(w, http.StatusBadGateway, requestID, "production backend unavailable")
+		return nil
+	}
+	defer resp.Body.Close()
 
-		// Forward response headers.
-		for k, v := range resp.Header {
-			w.Header()[k] = v
+	// Read the response body, at most one byte beyond -max-response-size.
+	var reader io.Reader = resp.Body
+	if *maxResponseSize > 0 {
+		reader = io.LimitReader(resp.Body, *maxResponseSize+1)
+	}
+	// deadlineTransport doesn't bound the body, so a backend can hang
+	// after the headers, e.g. by never sending the last chunk. Closing the
+	// body unblocks the read.
+	var bodyTimer *time.Timer
+	if *productionBodyTimeout > 0 {
+		bodyTimer = time.AfterFunc(time.Duration(*productionBodyTimeout)*time.Millisecond, func() {
+			resp.Body.Close()
+		})
+	}
+	body, _ := ioutil.ReadAll(reader)
+	if bodyTimer != nil && !bodyTimer.Stop() {
+		if resp.Request != nil {
+			observeBackendError("production", resp.Request.URL.Host, context.DeadlineExceeded)
+		}
+		writeError(w, http.StatusGatewayTimeout, requestID, "production response body timed out")
+		return nil
+	}
+	if *maxResponseSize > 0 && int64(len(body)) > *maxResponseSize {
+		oversizedResponses.Add(1)
+		if *oversizedAction == "error" {
+			writeError(w, http.StatusBadGateway, requestID, fmt.Sprintf("production response larger than %d bytes", *maxResponseSize))
+			return nil
 		}
-		w.WriteHeader(resp.StatusCode)
+		body = body[:*maxResponseSize]
+		resp.Header.Del("Content-Length")
+	}
+
+	// Forward response headers, except the ones only meant for this hop.
+	removeHopHeaders(resp.Header)
+	productionHeaderRewrites.Apply(resp.Header)
+	mergeHeaders(w.Header(), resp.Header, *headerConflict)
+	w.WriteHeader(resp.StatusCode)
+
+	// Forward response body.
+	w.Write(body)
+	return body
+}
 
-		// Forward response body.
-		body, _ := ioutil.ReadAll(resp.Body)
-		w.Write(body)
-		return body
+// mergeHeaders copies the backend headers in src to dst, which may hold
+// headers set by teeproxy. For a header in both, policy "teeproxy" keeps the
+// one in dst, "append" keeps both, and anything else replaces it with src.
+func mergeHeaders(dst, src http.Header, policy string) {
+	for k, v := range src {
+		if existing := dst[k]; len(existing) > 0 {
+			switch policy {
+			case "teeproxy":
+				continue
+			case "append":
+				dst[k] = append(existing[:len(existing):len(existing)], v...)
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// respond forwards the production response of the exchange to the client and
+// captures it with the -response-capture and the -record.
+func (h handler) respond(w http.ResponseWriter, x *exchange) {
+	x.ProductionBody = processResponse(x.Production, x.ProductionErr, w, x.RequestID)
+	if h.Capture != nil {
+		h.Capture.Capture(x)
+	}
+	if h.Recording != nil {
+		h.Recording.Record(x)
+	}
+}
+
+// isTimeout reports whether a request failed because it timed out.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// hopHeaders apply to a single connection and are not forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders removes the hop-by-hop headers from h, including the ones
+// listed in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
 	}
-	return nil
+}
+
+// wantsClose reports whether the client expects the connection to be closed
+// after the response: HTTP/1.0 clients unless they ask for keep-alive, and
+// any client sending "Connection: close".
+func wantsClose(req *http.Request) bool {
+	connection := strings.ToLower(strings.Join(req.Header.Values("Connection"), ","))
+	if !req.ProtoAtLeast(1, 1) {
+		return !strings.Contains(connection, "keep-alive")
+	}
+	return strings.Contains(connection, "close")
 }
 
 // compareResp compares responses assuming there is a json inside of body
-func compareResp(respProdBody []byte, respAlt *http.Response) {
+//
+// prodHeader is the header of the production response. Both bodies are decoded
+// according to their Content-Encoding before comparison, so that differing
+// encodings are no mismatch. Bodies of a media type with a registered
+// comparator are compared by it. It reports whether the responses are equal.
+func compareResp(respProdBody []byte, prodHeader http.Header, respAlt *http.Response) bool {
 	if respAlt == nil {
-		// TODO: log alternative request error
-	} else {
-		defer respAlt.Body.Close()
+		return false
+	}
+	defer respAlt.Body.Close()
 
-		// don't compare headers
+	// Headers are compared separately, with -compare-headers.
 
-		// Get entire response body.
-		respAltBody, _ := ioutil.ReadAll(respAlt.Body)
-		var respProdDeserealized interface{}
-		var respAltDeserealized interface{}
-		err := json.Unmarshal(respProdBody, respProdDeserealized)
-		if err != nil {
-			// then compare bytes
-			if bytes.Equal(respProdBody, respAltBody) {
-				log.Println("Equal")
-				return
-			} else {
-				log.Println("Not equal")
-				return
-			}
+	// Get entire response body.
+	respAltBody, _ := ioutil.ReadAll(respAlt.Body)
+	respProdBody = decodedBody(respProdBody, prodHeader.Get("Content-Encoding"))
+	respAltBody = decodedBody(respAltBody, respAlt.Header.Get("Content-Encoding"))
+	if *compareMode == "bytes" {
+		return bytes.Equal(respProdBody, respAltBody)
+	}
+	if paths := canonicalQueries.Paths(); paths != nil {
+		respProdBody = canonicalizeQueries(respProdBody, paths)
+		respAltBody = canonicalizeQueries(respAltBody, paths)
+	}
+	if paths := ignoredFields.Paths(); paths != nil {
+		respProdBody = removeFields(respProdBody, paths)
+		respAltBody = removeFields(respAltBody, paths)
+	}
+	if compare := comparatorFor(prodHeader); compare != nil {
+		equal, err := compare(respProdBody, prodHeader, respAltBody, respAlt.Header)
+		if err == nil {
+			return equal
 		}
-		err = json.Unmarshal(respAltBody, respAltDeserealized)
-		if err != nil {
-			if bytes.Equal(respProdBody, respAltBody) {
-				log.Println("Equal")
-				return
-			} else {
-				log.Println("Not equal")
-				return
-			}
+		log.Println("Falling back to the default comparison:", err)
+	}
+	if *compareCanonical {
+		prod, prodErr := canonicalJSON(respProdBody)
+		alt, altErr := canonicalJSON(respAltBody)
+		// Numbers within -float-tolerance differ in the canonical form.
+		if prodErr == nil && altErr == nil && (*floatTolerance == 0 || bytes.Equal(prod, alt)) {
+			return bytes.Equal(prod, alt)
 		}
+	}
+	var respProdDeserealized interface{}
+	var respAltDeserealized interface{}
+	err := json.Unmarshal(respProdBody, &respProdDeserealized)
+	if err != nil {
+		// then compare bytes
+		return bytes.Equal(respProdBody, respAltBody)
+	}
+	err = json.Unmarshal(respAltBody, &respAltDeserealized)
+	if err != nil {
+		return bytes.Equal(respProdBody, respAltBody)
+	}
+	return equalJSON(respAltDeserealized, respProdDeserealized, *floatTolerance)
+}
+
+// exchange is a request together with the responses of both targets, as far
+// as they are known.
+type exchange struct {
+	RequestID         string
+	Request           *http.Request
+	RequestBody       []byte
+	Production        *http.Response
+	ProductionBody    []byte
+	ProductionErr     error         // why Production is nil
+	ProductionLatency time.Duration // until the production response headers
+	Alternate         *http.Response
+	AlternateBody     []byte
+	AlternateErr      error         // why Alternate is nil
+	AlternateLatency  time.Duration // until the alternate response headers
+	// The alternate site the exchange was mirrored to, and its position
+	// among the -b flags.
+	AlternateTarget string
+	AlternateIndex  int
+	// The requests are kept to send them again with -b.self-compare and
+	// -compare.prod-samples.
+	ProductionRequest *http.Request
+	AlternateRequest  *http.Request
+	Diff              string // describes how the responses differ, if the comparison tells
+	HeaderDiff        string // the compared headers differing, see diffHeaders
+	BodiesDiffer      bool   // the bodies compared unequal, see mismatchDiff
+	// Production answered the request differently when it was sent again
+	// with -compare.prod-samples, so a mismatch says nothing about the
+	// alternate site.
+	ProductionFlaky bool
+}
 
-		if respAltDeserealized != respProdDeserealized {
-			log.Println("Not equal")
+// productionHeader returns the header of the production response, if any.
+func productionHeader(x *exchange) http.Header {
+	if x.Production == nil {
+		return nil
+	}
+	return x.Production.Header
+}
+
+// settleAlternate compares the alternate response with the production body,
+// or only drains it when compare is false. Comparisons are counted in
+// comparisonQueueDepth from when they are scheduled until they complete.
+func (h handler) settleAlternate(x *exchange, compare bool) {
+	recordStatus("alternate", x.Alternate)
+	if x.Alternate != nil {
+		h.AltRewrites.Apply(x.Alternate.Header)
+	}
+	if isTimeout(x.ProductionErr) && isTimeout(x.AlternateErr) {
+		bothTimeouts.Add(1)
+	}
+	selfCompared := x.Alternate != nil && x.AlternateRequest != nil
+	if x.Alternate != nil && (h.Recorder != nil || h.Observer != nil || compare || selfCompared) {
+		x.AlternateBody, _ = ioutil.ReadAll(x.Alternate.Body)
+		x.Alternate.Body.Close()
+		x.Alternate.Body = ioutil.NopCloser(bytes.NewReader(x.AlternateBody))
+	}
+	// Only the exchanges with the first alternate site are recorded.
+	if h.Recorder != nil && x.AlternateIndex == 0 {
+		h.Recorder.Record(x)
+	}
+	if h.Observer != nil {
+		h.Observer.Observe(x)
+	}
+	if selfCompared {
+		selfCompare(x)
+	}
+
+	if compare {
+		var fault string
+		if len(alternateFaults) > 0 {
+			fault = injectFault(x, rand.Float64())
+		}
+		start := time.Now()
+		var equal bool
+		if h.Structures != nil {
+			equal = h.Structures.compareExchange(x)
 		} else {
-			log.Println("Equal")
+			equal = h.Exec.compareExchange(x)
+		}
+		x.BodiesDiffer = !equal
+		if fault == faultStatus && x.Alternate.StatusCode != x.Production.StatusCode {
+			equal = false
+		}
+		if x.Alternate != nil {
+			if x.HeaderDiff = diffHeaders(productionHeader(x), x.Alternate.Header); x.HeaderDiff != "" {
+				equal = false
+			}
 		}
+		x.ProductionFlaky = !equal && x.ProductionRequest != nil && productionFlaky(x, h.ProdSamples)
+		if x.ProductionFlaky {
+			productionFlakes.Add(1)
+		}
+		comparisonLatency.Observe(time.Since(start).Seconds())
+		comparisonQueueDepth.Add(-1)
+		h.reportComparison(x, equal)
+	} else if x.Alternate != nil {
+		io.Copy(ioutil.Discard, x.Alternate.Body)
+		x.Alternate.Body.Close()
+	}
+}
 
+// reportComparison logs the result of comparing the responses of the exchange
+// and passes it on to the collector, if any. Nothing is reported during the
+// warmup. Repeated mismatches are suppressed by the deduplicator, and
+// mismatches beyond -compare.log-rate by the summary, if any. A mismatch with
+// a flaky production is reported as such instead.
+func (h handler) reportComparison(x *exchange, equal bool) {
+	if x.Alternate == nil || time.Now().Before(h.WarmupUntil) {
+		return
+	}
+	r := newComparisonResult(x, equal)
+	r.Env, r.Instance = h.Labels.Env, h.Labels.Instance
+	divergences.Count(r)
+	promComparisons.Inc("result", r.result(), "target", r.Alternate)
+	comparisonStream.Publish(r)
+	if h.Summary != nil {
+		h.Summary.Count(r.result())
+	}
+	switch {
+	case r.Flaky:
+		logEvent(slog.LevelInfo, fmt.Sprintf("Production not deterministic, not comparing: %s %s (request id %s)",
+			r.Method, r.Path, r.RequestID), comparisonFields(x, r)...)
+	case equal:
+		logEvent(slog.LevelInfo, fmt.Sprintf("Equal: alternate %s (request id %s)", r.Alternate, r.RequestID),
+			comparisonFields(x, r)...)
+	default:
+		line := fmt.Sprintf("Not equal: %s %s (request id %s), production %d, alternate %s %d",
+			r.Method, r.Path, r.RequestID, r.ProductionStatus, r.Alternate, r.AlternateStatus)
+		if (h.Dedup == nil || !h.Dedup.Seen(mismatchFingerprint(x), line)) &&
+			(h.Summary == nil || h.Summary.Allow()) {
+			diff := mismatchDiff(x)
+			message := line
+			if diff != "" && h.DiffLog == nil {
+				message += "\n" + diff
+			}
+			logEvent(slog.LevelInfo, message, comparisonFields(x, r)...)
+			if diff != "" && h.DiffLog != nil {
+				h.DiffLog.Printf("%s\n%s\n", line, diff)
+			}
+		}
+		if h.Webhook != nil {
+			h.Webhook.Notify(x, r)
+		}
+	}
+	if h.Collector != nil {
+		h.Collector.Send(r)
 	}
 }
 
-// handler contains the address of the main Target and the one for the Alternative target
+// handler contains the address of the main Target and the ones for the Alternatives
 type handler struct {
-	Target      string
-	Alternative string
-	Randomizer  rand.Rand
+	Target       string
+	Production   []weightedTarget // the production hosts, picked by weight
+	Alternatives []string
+	Randomizer   rand.Rand
+	Recorder     *walWriter                 // write-ahead log, if any
+	Rules        []*rule                    // per-path rules, the first match applies
+	Collector    *collector                 // receives comparison results, if any
+	Capture      *responseCapture           // copies production responses, if any
+	Recording    *trafficRecorder           // records requests with their production responses, if any
+	Sampler      *adaptiveSampler           // replaces the percentage, if any
+	Dedup        *dedup                     // suppresses repeated mismatches, if any
+	Observer     *observer                  // receives alternate responses, if any
+	Summary      *comparisonSummary         // counts comparisons, if any
+	WarmupUntil  time.Time                  // comparisons are not reported before
+	Exec         *execComparator            // compares instead of compareResp, if any
+	SelfCompare  bool                       // sends alternate requests twice, see selfCompare
+	ProdSamples  int                        // production responses compared before blaming the alternate
+	Labels       labels                     // tag the comparison results
+	AltRewrites  headerRewrites             // rewrite the alternate response headers
+	Comparisons  *comparisonLimiter         // bounds the comparisons in flight, if any
+	Workers      *comparisonPool            // settles the alternate responses, if any
+	Breakers     map[string]*circuitBreaker // by alternate target, if any
+	Decisions    *decisionService           // decides on mirroring instead of sampling, if any
+	Structures   *structureBaselines        // compares structures instead, if any
+	Health       *healthChecker             // skips backends that are down, if any
+	DiffLog      *log.Logger                // receives the diffs of mismatches instead of the log, if any
+	Webhook      *webhook                   // receives the mismatches, if any
+	// ServerTimeout bounds the time a client waits for its answer, if not 0.
+	ServerTimeout time.Duration
+}
+
+// alternateRequest prepares a duplicate of req for the alternate target.
+func (h handler) alternateRequest(alternativeRequest, req *http.Request, target string) *http.Request {
+	setRequestTarget(alternativeRequest, *alternateScheme, &target)
+	if *preserveRawURI {
+		preserveRequestURI(alternativeRequest, req.RequestURI)
+	}
+	if *alternateHostRewrite {
+		alternativeRequest.Host = target
+	}
+	if *alternateHost != "" {
+		alternativeRequest.Host = *alternateHost
+	}
+	if *alternateNoCookies {
+		alternativeRequest.Header.Del("Cookie")
+	}
+	if *alternateAcceptEncoding != "" {
+		alternativeRequest.Header.Set("Accept-Encoding", *alternateAcceptEncoding)
+	}
+	stripHeaders(alternativeRequest.Header, alternateStripped)
+	addAlternateHeaders(alternativeRequest.Header)
+	return alternativeRequest
 }
 
 // ServeHTTP duplicates the incoming request (req) and does the request to the
 // Target and the Alternate target discading the Alternate response
 func (h handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	var productionRequest, alternativeRequest *http.Request
+	if wantsClose(req) {
+		// Makes the server close the connection after the response.
+		w.Header().Set("Connection", "close")
+	}
+	if serveHealth(w, req) || serveStatic(w, req) {
+		return
+	}
+
+	x := &exchange{RequestID: requestID(req), Request: req}
+	if logEnabled(slog.LevelDebug) {
+		logEvent(slog.LevelDebug, "Request received: "+req.Method+" "+req.URL.Path,
+			"event", "request", "request_id", x.RequestID, "method", req.Method, "path", req.URL.Path,
+			"remote_addr", req.RemoteAddr)
+	}
+	if *requestIDHeader != "" {
+		// Both backends receive the ID, to correlate their logs with ours.
+		req.Header.Set(*requestIDHeader, x.RequestID)
+		w.Header().Set(*requestIDHeader, x.RequestID)
+	}
+	if h.ServerTimeout > 0 {
+		h.proxyWithin(w, req, x, h.ServerTimeout)
+		return
+	}
+	h.proxy(w, req, x)
+}
+
+// proxy sends the request of the exchange to production, and to the alternate
+// targets if it is mirrored, and answers the client with the production
+// response.
+func (h handler) proxy(w http.ResponseWriter, req *http.Request, x *exchange) {
+	if overGoroutineLimit() {
+		writeError(w, http.StatusServiceUnavailable, x.RequestID, "too many goroutines")
+		return
+	}
+	// Production known to be down is not even tried.
+	if *maintenancePage != "" && h.productionDown() && serveMaintenancePage(w, x.RequestID) {
+		return
+	}
 	if *forwardClientIP {
 		updateForwardedHeaders(req)
 	}
 
+	body, stream, err := readRequestBody(w, req, *maxBufferBytes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, x.RequestID, "incomplete request body: "+err.Error())
+		return
+	}
+	if stream != nil {
+		streamedBodies.Add(1)
+	} else {
+		x.RequestBody = body
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	matched := matchRule(h.Rules, req.URL.Path)
+	// Only requests whose body matches -compare.body-match are compared.
+	compare := *compareMode != "none" && matched.compare() &&
+		(compareBodyMatch.Path == nil || compareBodyMatch.Matches(x.RequestBody))
+
+	// Alternate sites whose circuit is open are left out. With none left the
+	// request is not mirrored at all, and costs no more than proxying it.
+	// Neither are bodies too large to be buffered.
+	alternatives := h.liveAlternatives()
+	mirrored := stream == nil && len(alternatives) > 0
+	if mirrored {
+		// The decision service, if any, replaces the local sampling.
+		if verdict, ok := h.Decisions.Decide(req); ok {
+			mirrored = verdict.Mirror && h.mirrorable(req)
+			compare = compare && verdict.Compare
+		} else {
+			mirrored = h.mirror(req, matched)
+		}
+	}
+	if !mirrored {
+		alternatives = nil
+	}
+
 	// preparing prod request (we always need it)
-	alternativeRequest, productionRequest = DuplicateRequest(req)
-	setRequestTarget(productionRequest, targetProduction)
+	var requests []*http.Request
+	if stream != nil {
+		requests = []*http.Request{streamingRequest(req, stream)}
+	} else {
+		requests = DuplicateRequest(req, 1+len(alternatives))
+	}
+	// The production request is canceled when the client goes away, see
+	// deadlineTransport.
+	productionRequest := requests[0].WithContext(req.Context())
+	productionTarget := h.pickProduction()
+	setRequestTarget(productionRequest, *productionScheme, &productionTarget)
+	if *preserveRawURI {
+		preserveRequestURI(productionRequest, req.RequestURI)
+	}
 	if *productionHostRewrite {
-		productionRequest.Host = h.Target
+		productionRequest.Host = productionTarget
+	}
+	if *productionHost != "" {
+		productionRequest.Host = *productionHost
 	}
-	timeoutProd := time.Duration(*productionTimeout) * time.Millisecond
+	stripHeaders(productionRequest.Header, productionStripped)
+	timeoutProd := backendTimeout(productionTimeout)
 
 	defer func() {
 		if r := recover(); r != nil && *debug {
-			log.Println("Recovered in ServeHTTP from:", r)
+			logEvent(slog.LevelError, fmt.Sprint("Recovered in ServeHTTP from: ", r),
+				"event", "panic", "request_id", x.RequestID, "panic", fmt.Sprint(r))
 		}
 	}()
 
-	if *percent == 100.0 || h.Randomizer.Float64()*100 < *percent {
-
-		setRequestTarget(alternativeRequest, altTarget)
-		if *alternateHostRewrite {
-			alternativeRequest.Host = h.Alternative
+	if mirrored {
+		if h.ProdSamples > 1 && compare && selfComparable(req.Method) {
+			x.ProductionRequest = productionRequest
 		}
-		timeoutAlt := time.Duration(*alternateTimeout) * time.Millisecond
 
-		prodRespCh := handleAsyncRequest(productionRequest, timeoutProd)
-		altRespCh := handleAsyncRequest(alternativeRequest, timeoutAlt)
+		// Every alternate site gets its own exchange, completed with the
+		// production side once it is known.
+		mirrors := make([]*exchange, len(alternatives))
+		altRespChs := make([]chan *http.Response, len(alternatives))
+		// With -b.cancel-on-loss the alternate requests are canceled once
+		// production answers first, and nothing is compared.
+		cancels := make([]context.CancelFunc, len(alternatives))
+		// They are all canceled should the client go away before it is
+		// answered. Once it is, they are left to complete for the comparison,
+		// so their context is not the one of the client's request.
+		alternatesCtx, cancelAlternates := context.WithCancel(context.Background())
+		clientGone := context.AfterFunc(req.Context(), func() {
+			clientGoneAlternates.Add(int64(len(alternatives)))
+			cancelAlternates()
+		})
+		d := newDispatch()
+		prodRespCh := handleAsyncRequest(d.trace(productionRequest), timeoutProd, &x.ProductionErr, &x.ProductionLatency)
+		for i, target := range alternatives {
+			alternativeRequest := h.alternateRequest(requests[1+i], req, target)
+			m := &exchange{
+				RequestID:       x.RequestID,
+				Request:         req,
+				RequestBody:     x.RequestBody,
+				AlternateTarget: target,
+				AlternateIndex:  i,
+			}
+			if h.SelfCompare && compare && selfComparable(req.Method) {
+				m.AlternateRequest = alternativeRequest
+			}
+			ctx, cancel := context.WithCancel(alternatesCtx)
+			cancels[i] = cancel
+			alternativeRequest = alternativeRequest.WithContext(ctx)
+			mirrors[i] = m
+			altRespChs[i] = handleAlternateRequest(d.trace(alternativeRequest), &m.AlternateErr, &m.AlternateLatency)
+		}
+		d.release()
+		// Every alternate channel is handed to a goroutine below. Should
+		// responding panic, the ones left are drained here instead, so that
+		// their connections are released.
+		settled := 0
+		defer func() {
+			for i := settled; i < len(altRespChs); i++ {
+				cancels[i]()
+				go drainResponse(altRespChs[i])
+			}
+		}()
 
-		select {
-		case prodResp := <-prodRespCh:
-			respProdBody := processResponse(prodResp, w)
-			if respProdBody != nil {
+		x.Production = <-prodRespCh
+		h.respond(w, x)
+		clientGone()
+		// Without a production response there is nothing to compare.
+		compare := compare && x.ProductionBody != nil
+		for i, m := range mirrors {
+			settled++
+			m.Production, m.ProductionBody, m.ProductionErr = x.Production, x.ProductionBody, x.ProductionErr
+			m.ProductionLatency = x.ProductionLatency
+			m.ProductionRequest = x.ProductionRequest
+			altRespCh, cancel := altRespChs[i], cancels[i]
+			if *cancelOnLoss {
+				select {
+				case m.Alternate = <-altRespCh:
+					// The alternate site answered first.
+				default:
+					cancel()
+					canceledAlternates.Add(1)
+					go drainResponse(altRespCh)
+					// Recorded without the alternate response.
+					if h.Recorder != nil && m.AlternateIndex == 0 {
+						h.Recorder.Record(m)
+					}
+					continue
+				}
+			}
+			if compare {
+				comparisonQueueDepth.Add(1)
+			}
+			settle := func() {
+				defer cancel()
+				if m.Alternate == nil {
+					m.Alternate = <-altRespCh
+				}
+				h.Breakers[m.AlternateTarget].Record(m.Alternate, m.AlternateErr)
+				compare := compare
+				if compare && !h.Comparisons.Acquire() {
+					comparisonQueueDepth.Add(-1)
+					compare = false
+				} else if compare {
+					defer h.Comparisons.Release()
+				}
+				h.settleAlternate(m, compare)
+			}
+			if !h.Workers.Submit(settle) {
+				if compare {
+					comparisonQueueDepth.Add(-1)
+				}
+				// Dropped, the response is only drained. It is not recorded
+				// either, since its body is not read.
+				if h.Recorder != nil && m.AlternateIndex == 0 {
+					walDropped.Add(1)
+				}
 				go func() {
-					altResp := <-altRespCh
-					compareResp(respProdBody, altResp)
+					defer cancel()
+					if m.Alternate == nil {
+						m.Alternate = <-altRespCh
+					}
+					// The breaker still hears of failures while the pool is
+					// saturated.
+					h.Breakers[m.AlternateTarget].Record(m.Alternate, m.AlternateErr)
+					if m.Alternate != nil {
+						io.Copy(ioutil.Discard, m.Alternate.Body)
+						m.Alternate.Body.Close()
+					}
 				}()
 			}
-		case altResp := <-altRespCh:
-			prodResp := <-prodRespCh
-			respProdBody := processResponse(prodResp, w)
-			go compareResp(respProdBody, altResp)
 		}
 
 		return
-
-	} else {
-		productionRequest = req
 	}
 
-	alternativeRequest = nil
-	respCh := handleAsyncRequest(productionRequest, timeoutProd)
+	respCh := handleAsyncRequest(productionRequest, timeoutProd, &x.ProductionErr, &x.ProductionLatency)
+
+	x.Production = <-respCh
 
-	resp := <-respCh
+	h.respond(w, x)
+	// The body of a streamed request is not kept for the log.
+	if h.Recorder != nil && stream == nil {
+		h.Recorder.Record(x)
+	}
+}
+
+// mirror decides whether the request is also sent to the alternate target.
+// Requests with a -p.bucket-header are mirrored by cohort, the others by
+// percentage, or by the adaptive sampler unless the percentage is 0. matched
+// is the rule matching the request, if any.
+func (h handler) mirror(req *http.Request, matched *rule) bool {
+	if !h.mirrorable(req) {
+		return false
+	}
+	if *bucketHeader != "" {
+		if value := req.Header.Get(*bucketHeader); value != "" {
+			return inActiveBucket(value)
+		}
+	}
+	p := samplingPercent(matched, req.Method)
+	if h.Sampler != nil && p > 0 {
+		return h.Sampler.Sample(h.Randomizer.Float64(), matched.weight())
+	}
+	return p == 100.0 || h.Randomizer.Float64()*100 < p
+}
 
-	processResponse(resp, w)
+// mirrorable reports whether the request may be mirrored at all: only methods
+// in -b.methods are, and no requests disabling it with -no-mirror-header.
+func (h handler) mirrorable(req *http.Request) bool {
+	if !mirroredMethods.Contains(req.Method) {
+		return false
+	}
+	return *noMirrorHeader == "" || len(req.Header.Values(*noMirrorHeader)) == 0 ||
+		!noMirrorTrusted.Contains(remoteIP(req))
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayCommand(os.Args[2:], os.Stdout))
+	}
 	flag.Parse()
+	config := &Config{}
+	if *configFile != "" {
+		var err error
+		config, err = LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to load the config: %s", err)
+		}
+		if err := config.apply(flag.CommandLine); err != nil {
+			log.Fatalf("Failed to apply the config from %s: %s", *configFile, err)
+		}
+	}
+	switch *compareMode {
+	case "none", "bytes", "json":
+	default:
+		log.Fatalf("Unknown -compare-mode %q, expected none, bytes or json", *compareMode)
+	}
+	if *bucketCount < 1 {
+		log.Fatalf("Invalid -p.buckets %d, expected at least 1", *bucketCount)
+	}
+	if *compareMaxInFlight > 0 && *compareWorkers > 0 {
+		log.Fatalf("-compare.max-inflight cannot be combined with -compare-workers, which bounds the comparisons in flight too")
+	}
+	tags := labels{Env: *envLabel, Instance: *instanceID}
+	if err := useLogFormat(*logFormat, os.Stderr, tags); err != nil {
+		log.Fatal(err)
+	}
 
 	log.Printf("Starting teeproxy at %s sending to A: %s and B: %s",
-		*listen, *targetProduction, *altTarget)
+		*listen, *targetProduction, strings.Join(alternateTargets.targets, ", "))
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -248,27 +1081,167 @@ func main() {
 	var listener net.Listener
 
 	if len(*tlsPrivateKey) > 0 {
-		cer, err := tls.LoadX509KeyPair(*tlsCertificate, *tlsPrivateKey)
+		certificates, err := newCertificateReloader(*tlsCertificate, *tlsPrivateKey)
 		if err != nil {
 			log.Fatalf("Failed to load certficate: %s and private key: %s", *tlsCertificate, *tlsPrivateKey)
 		}
+		go reloadOnHangup(certificates)
 
-		config := &tls.Config{Certificates: []tls.Certificate{cer}}
-		listener, err = tls.Listen("tcp", *listen, config)
+		config, err := serverTLSConfig(*tlsMinVersion, *tlsCiphers)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %s", err)
+		}
+		config.GetCertificate = certificates.GetCertificate
+		listener, err = net.Listen("tcp", *listen)
 		if err != nil {
 			log.Fatalf("Failed to listen to %s: %s", *listen, err)
 		}
+		if *proxyProtocol {
+			// The PROXY protocol header precedes the TLS handshake.
+			listener = proxyProtocolListener{listener}
+		}
+		listener = tls.NewListener(listener, config)
 	} else {
 		listener, err = net.Listen("tcp", *listen)
 		if err != nil {
 			log.Fatalf("Failed to listen to %s: %s", *listen, err)
 		}
+		if *proxyProtocol {
+			listener = proxyProtocolListener{listener}
+		}
 	}
 
+	production, err := parseProductionPool(*targetProduction)
+	if err != nil {
+		log.Fatalf("Failed to parse the production hosts: %s", err)
+	}
+	if err := checkBackends(allowedBackends, append(productionHosts(production), alternateTargets.targets...)...); err != nil {
+		log.Fatalf("Failed to check the backends: %s", err)
+	}
+	productionTransport = newProductionTransport()
+	alternateTransport = newAlternateTransport()
+
 	h := handler{
-		Target:      *targetProduction,
-		Alternative: *altTarget,
-		Randomizer:  *rand.New(rand.NewSource(time.Now().UnixNano())),
+		Target:        production[0].Host,
+		Production:    production,
+		Alternatives:  alternateTargets.targets,
+		Randomizer:    *newRandomizer(time.Now().UnixNano()),
+		Labels:        tags,
+		AltRewrites:   alternateHeaderRewrites,
+		ServerTimeout: time.Duration(*serverTimeout) * time.Millisecond,
+	}
+	if *compareMaxInFlight > 0 {
+		h.Comparisons = newComparisonLimiter(*compareMaxInFlight, *compareQueueMode, time.Duration(*compareQueueWait)*time.Millisecond)
+	}
+	if *compareWorkers > 0 {
+		h.Workers = newComparisonPool(*compareWorkers, *compareWorkerQueue)
+	}
+	if *compareStructureOnly {
+		h.Structures = newStructureBaselines()
+	}
+	h.Breakers = newCircuitBreakers(h.Alternatives, *breakerFailures, time.Duration(*breakerCooldown)*time.Millisecond)
+	if *healthPath != "" {
+		h.Health = newHealthChecker(*healthPath, time.Duration(*healthInterval)*time.Millisecond,
+			time.Duration(*healthTimeout)*time.Millisecond, *healthUnhealthy, *healthHealthy)
+		for _, target := range production {
+			h.Health.Watch(target.Host, *productionScheme, productionTransport)
+		}
+		if *healthAlternate {
+			for _, target := range h.Alternatives {
+				h.Health.Watch(target, *alternateScheme, alternateTransport)
+			}
+		}
+	}
+	if *warmup > 0 {
+		h.WarmupUntil = time.Now().Add(*warmup)
+		time.AfterFunc(*warmup, func() {
+			log.Println("Warmup over, reporting comparisons")
+		})
+	}
+	h.SelfCompare = *alternateSelfCompare
+	h.ProdSamples = *productionSamples
+	if *compareExec != "" {
+		h.Exec, err = newExecComparator(*compareExec, time.Duration(*compareExecTimeout)*time.Millisecond, *compareExecParallel)
+		if err != nil {
+			log.Fatalf("Invalid -compare.exec %q: %s", *compareExec, err)
+		}
+	}
+	if *decisionURL != "" {
+		h.Decisions = newDecisionService(*decisionURL, time.Duration(*decisionTimeout)*time.Millisecond,
+			time.Duration(*decisionTTL)*time.Second, time.Now)
+	}
+	if *targetRate > 0 {
+		h.Sampler = newAdaptiveSampler(*targetRate, time.Now)
+	}
+	if *compareLogRate > 0 || *summaryInterval > 0 {
+		h.Summary = newComparisonSummary(*compareLogRate, time.Now)
+		interval := time.Duration(*summaryInterval) * time.Second
+		if interval == 0 {
+			interval = time.Minute
+		}
+		go func() {
+			for range time.Tick(interval) {
+				h.Summary.Log()
+			}
+		}()
+	}
+	if *dedupEnabled {
+		h.Dedup = newDedup(*dedupSize, time.Duration(*dedupWindow)*time.Second, time.Now)
+		go func() {
+			for range time.Tick(time.Duration(*dedupWindow) * time.Second) {
+				h.Dedup.Flush()
+			}
+		}()
+	}
+	if *rulesFile != "" {
+		h.Rules, err = loadRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("Failed to load rules from %s: %s", *rulesFile, err)
+		}
+	} else {
+		h.Rules = config.Rules
+	}
+	if *walDir != "" {
+		h.Recorder, err = newWALWriter(*walDir, *walMaxSize, *walBuffer)
+		if err != nil {
+			log.Fatalf("Failed to open write-ahead log %s: %s", *walDir, err)
+		}
+	}
+	if *protoDescriptor != "" {
+		registry, err := loadProtoDescriptors(*protoDescriptor)
+		if err != nil {
+			log.Fatalf("Failed to load protobuf descriptors: %s", err)
+		}
+		protoTypes.Store(&registry)
+	}
+	if *captureSink != "" {
+		h.Capture, err = newResponseCapture(*captureSink, *captureMaxSize, *captureBuffer)
+		if err != nil {
+			log.Fatalf("Failed to open response capture %s: %s", *captureSink, err)
+		}
+	}
+	if *recordFile != "" {
+		h.Recording, err = newTrafficRecorder(*recordFile, *recordMaxBody, *recordKeepCreds)
+		if err != nil {
+			log.Fatalf("Failed to open recording %s: %s", *recordFile, err)
+		}
+	}
+	if *observerURL != "" {
+		h.Observer = newObserver(*observerURL, *observerBuffer)
+	}
+	if *mismatchWebhook != "" {
+		h.Webhook = newWebhook(*mismatchWebhook, *mismatchWebhookRate,
+			time.Duration(*mismatchWebhookTimeout)*time.Millisecond, *mismatchWebhookBody, time.Now)
+	}
+	if *diffLogFile != "" {
+		file, err := os.OpenFile(*diffLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open diff log %s: %s", *diffLogFile, err)
+		}
+		h.DiffLog = log.New(file, "", log.LstdFlags)
+	}
+	if *collectorAddr != "" {
+		h.Collector = newCollector(*collectorAddr, *collectorBuffer)
 	}
 
 	server := &http.Server{
@@ -280,10 +1253,34 @@ func main() {
 	}
 
 	go func() {
-		log.Fatal(server.Serve(listener))
+		if err := server.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
+	go shutdownOnSignal(server)
+
+	if *walReplay != "" {
+		go func() {
+			n, err := replayWAL(*walReplay, h)
+			if err != nil {
+				log.Printf("Replay of %s stopped: %s", *walReplay, err)
+			}
+			log.Printf("Replayed %d requests from %s", n, *walReplay)
+		}()
+	}
 
-	log.Fatal(http.ListenAndServe("localhost:6060", nil))
+	if *metricsAddr != "" {
+		go func() {
+			log.Fatal(newMetricsServer(*metricsAddr).ListenAndServe())
+		}()
+	}
+	if *pprofAddr != "" {
+		go func() {
+			log.Fatal(newPprofServer(*pprofAddr).ListenAndServe())
+		}()
+	}
+
+	log.Fatal(http.ListenAndServe("localhost:6060", debugHandler()))
 }
 
 type nopCloser struct {
@@ -292,50 +1289,269 @@ type nopCloser struct {
 
 func (nopCloser) Close() error { return nil }
 
-func DuplicateRequest(request *http.Request) (request1 *http.Request, request2 *http.Request) {
-	b1 := new(bytes.Buffer)
-	b2 := new(bytes.Buffer)
-	w := io.MultiWriter(b1, b2)
-	io.Copy(w, request.Body)
+// DuplicateRequest returns n copies of the request, each with its own copy of
+// the header and the body, so that changing one copy affects none of the
+// others or the request.
+func DuplicateRequest(request *http.Request, n int) []*http.Request {
+	buffers := make([]*bytes.Buffer, n)
+	writers := make([]io.Writer, n, n+1)
+	for i := range buffers {
+		buffers[i] = new(bytes.Buffer)
+		writers[i] = buffers[i]
+	}
+	var source hash.Hash
+	if *verifyDuplication {
+		source = sha256.New()
+		writers = append(writers, source)
+	}
+	io.Copy(io.MultiWriter(writers...), request.Body)
 	defer request.Body.Close()
-	request1 = &http.Request{
-		Method:        request.Method,
-		URL:           request.URL,
-		Proto:         request.Proto,
-		ProtoMajor:    request.ProtoMajor,
-		ProtoMinor:    request.ProtoMinor,
-		Header:        request.Header,
-		Body:          nopCloser{b1},
-		Host:          request.Host,
-		ContentLength: request.ContentLength,
-		Close:         true,
+	copies := make([][]byte, n)
+	for i, b := range buffers {
+		copies[i] = b.Bytes()
 	}
-	request2 = &http.Request{
+	if source != nil {
+		verifyDuplicates(source.Sum(nil), copies...)
+	}
+	requests := make([]*http.Request, n)
+	for i := range requests {
+		// GetBody lets the transports retry a request on a new connection
+		// when a reused one turns out to be closed.
+		body := copies[i]
+		requests[i] = &http.Request{
+			Method:        request.Method,
+			URL:           request.URL,
+			Proto:         request.Proto,
+			ProtoMajor:    request.ProtoMajor,
+			ProtoMinor:    request.ProtoMinor,
+			Header:        request.Header.Clone(),
+			Body:          nopCloser{buffers[i]},
+			GetBody:       func() (io.ReadCloser, error) { return nopCloser{bytes.NewReader(body)}, nil },
+			Host:          request.Host,
+			ContentLength: request.ContentLength,
+			Close:         *closeConnections,
+		}
+		// A chunked body may turn out empty. It is then sent without one,
+		// framed the same way for every backend, rather than as a lone
+		// terminating chunk.
+		if len(body) == 0 {
+			requests[i].Body, requests[i].GetBody = http.NoBody, nil
+			requests[i].ContentLength = 0
+		}
+	}
+	return requests
+}
+
+// streamingRequest returns a copy of request sending body as it is read, for
+// a body too large to be buffered. It cannot be retried.
+func streamingRequest(request *http.Request, body io.Reader) *http.Request {
+	return &http.Request{
 		Method:        request.Method,
 		URL:           request.URL,
 		Proto:         request.Proto,
 		ProtoMajor:    request.ProtoMajor,
 		ProtoMinor:    request.ProtoMinor,
-		Header:        request.Header,
-		Body:          nopCloser{b2},
+		Header:        request.Header.Clone(),
+		Body:          ioutil.NopCloser(body),
 		Host:          request.Host,
 		ContentLength: request.ContentLength,
-		Close:         true,
+		Close:         *closeConnections,
+	}
+}
+
+// proxyWithin proxies the request like proxy, but answers the client with a
+// 503 once timeout elapses. The request carries on in the background, so the
+// alternate responses are still compared; it is only canceled if the client
+// goes away before it is answered.
+//
+// http.TimeoutHandler does much the same, but cannot be used: its 503 has a
+// fixed body, without the request ID nor the -error-format of writeError, and
+// it cancels the context of the request on the timeout, which would cancel
+// the alternate requests before they are compared.
+func (h handler) proxyWithin(w http.ResponseWriter, req *http.Request, x *exchange, timeout time.Duration) {
+	deadline, stopDeadline := context.WithTimeout(req.Context(), timeout)
+	defer stopDeadline()
+	ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+	stopCancel := context.AfterFunc(req.Context(), cancel)
+
+	buffer := &bufferedWriter{w: w, header: w.Header().Clone()}
+	done := make(chan struct{})
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked <- r
+			}
+		}()
+		defer cancel()
+		h.proxy(buffer, req.WithContext(ctx), x)
+		buffer.finish()
+		close(done)
+	}()
+	select {
+	case <-done:
+		stopCancel()
+		buffer.writeTo(w)
+	case r := <-panicked:
+		panic(r)
+	case <-deadline.Done():
+		if !stopCancel() {
+			// The client went away, and the request was canceled with it.
+			return
+		}
+		if !buffer.timeOut() {
+			// The response was complete just in time.
+			<-done
+			buffer.writeTo(w)
+			return
+		}
+		writeError(w, http.StatusServiceUnavailable, x.RequestID, "request timed out")
+	}
+}
+
+// bufferedWriter holds a response until it is complete, so that it can be
+// replaced by an error should it take too long. Once timed out, it discards
+// what is written to it.
+type bufferedWriter struct {
+	w        http.ResponseWriter // only used for read deadlines
+	mu       sync.Mutex
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	timedOut bool
+	finished bool
+}
+
+func (b *bufferedWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedWriter) WriteHeader(status int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.status == 0 {
+		b.status = status
 	}
-	return
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// SetReadDeadline lets readRequestBody bound the read of the request body,
+// through http.ResponseController.
+func (b *bufferedWriter) SetReadDeadline(deadline time.Time) error {
+	return http.NewResponseController(b.w).SetReadDeadline(deadline)
+}
+
+// finish marks the response as complete.
+func (b *bufferedWriter) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.finished = true
+}
+
+// timeOut discards the response from now on, and reports whether it was not
+// written yet.
+func (b *bufferedWriter) timeOut() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.finished {
+		return false
+	}
+	b.timedOut = true
+	return true
+}
+
+// writeTo copies the complete response to w.
+func (b *bufferedWriter) writeTo(w http.ResponseWriter) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
+
+// readRequestBody reads the whole body of req within -body-read-timeout, so
+// that a client sending less than its Content-Length, or stalling, is detected
+// instead of holding the request until the backends time out.
+//
+// A body longer than limit, if positive, is not buffered: readRequestBody then
+// returns a stream of the whole body instead, read as it arrives, without a
+// timeout. Only limit bytes of it are held in memory at most.
+func readRequestBody(w http.ResponseWriter, req *http.Request, limit int64) ([]byte, io.Reader, error) {
+	if limit > 0 && req.ContentLength > limit {
+		return nil, req.Body, nil
+	}
+	rc := http.NewResponseController(w)
+	// Writers without deadlines, like in tests, read without a bound.
+	bounded := rc.SetReadDeadline(time.Now().Add(time.Duration(*bodyReadTimeout)*time.Millisecond)) == nil
+	var reader io.Reader = req.Body
+	if limit > 0 {
+		reader = io.LimitReader(req.Body, limit+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		req.Body.Close()
+		// The rest of the body will not arrive, so the connection cannot be
+		// reused. The server would otherwise wait for it before responding.
+		w.Header().Set("Connection", "close")
+		return nil, nil, err
+	}
+	if bounded {
+		rc.SetReadDeadline(time.Time{})
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		// A chunked body turned out too large.
+		return nil, io.MultiReader(bytes.NewReader(body), req.Body), nil
+	}
+	req.Body.Close()
+	return body, nil, nil
+}
+
+// verifyDuplicates checks that the copies of a request body match the SHA-256
+// checksum of the source. A mismatch is a bug in the duplication path.
+func verifyDuplicates(source []byte, copies ...[]byte) bool {
+	ok := true
+	for i, c := range copies {
+		if sum := sha256.Sum256(c); !bytes.Equal(sum[:], source) {
+			log.Printf("ERROR: copy %d of the request body diverged from the source: sha256 %x != %x",
+				i+1, sum, source)
+			duplicationMismatches.Add(1)
+			ok = false
+		}
+	}
+	return ok
 }
 
 func updateForwardedHeaders(request *http.Request) {
-	positionOfColon := strings.LastIndex(request.RemoteAddr, ":")
-	var remoteIP string
-	if positionOfColon != -1 {
-		remoteIP = request.RemoteAddr[:positionOfColon]
-	} else {
-		log.Printf("The default format of request.RemoteAddr should be IP:Port but was %s\n", remoteIP)
-		remoteIP = request.RemoteAddr
+	remoteIP, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		log.Printf("The default format of request.RemoteAddr should be IP:Port but was %s\n", request.RemoteAddr)
+		remoteIP = strings.TrimSuffix(strings.TrimPrefix(request.RemoteAddr, "["), "]")
+	}
+	if len(trustedProxies) > 0 && !trustedProxies.Contains(net.ParseIP(remoteIP)) {
+		// The client may have forged the headers of proxies in front of it.
+		for _, header := range []string{FORWARDED_HEADER, XFF_HEADER, XFP_HEADER, XFH_HEADER} {
+			request.Header.Del(header)
+		}
 	}
 	insertOrExtendForwardedHeader(request, remoteIP)
 	insertOrExtendXFFHeader(request, remoteIP)
+	if *forwardProtoHost {
+		insertProtoAndHostHeaders(request)
+	}
 }
 
 const XFF_HEADER = "X-Forwarded-For"
@@ -351,11 +1567,47 @@ func insertOrExtendXFFHeader(request *http.Request, remoteIP string) {
 	}
 }
 
+const (
+	XFP_HEADER = "X-Forwarded-Proto"
+	XFH_HEADER = "X-Forwarded-Host"
+)
+
+// insertProtoAndHostHeaders sets the X-Forwarded-Proto and X-Forwarded-Host
+// headers, unless a proxy in front of teeproxy already set them to what the
+// client used.
+func insertProtoAndHostHeaders(request *http.Request) {
+	if request.Header.Get(XFP_HEADER) == "" {
+		request.Header.Set(XFP_HEADER, requestScheme(request))
+	}
+	if request.Header.Get(XFH_HEADER) == "" && request.Host != "" {
+		request.Header.Set(XFH_HEADER, request.Host)
+	}
+}
+
+// requestScheme returns https if the request was received over TLS, and http
+// otherwise.
+func requestScheme(request *http.Request) string {
+	if request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
 const FORWARDED_HEADER = "Forwarded"
 
 // Implementation according to rfc7239
 func insertOrExtendForwardedHeader(request *http.Request, remoteIP string) {
-	extension := "for=" + remoteIP
+	extension := "for=" + forwardedValue(remoteIP)
+	if strings.Contains(remoteIP, ":") {
+		// IPv6 addresses are bracketed and, as they contain colons, quoted.
+		extension = `for="[` + remoteIP + `]"`
+	}
+	if *forwardProtoHost {
+		extension += ";proto=" + requestScheme(request)
+		if request.Host != "" {
+			extension += ";host=" + forwardedValue(request.Host)
+		}
+	}
 	header := request.Header.Get(FORWARDED_HEADER)
 	if header != "" {
 		// extend
@@ -365,3 +1617,101 @@ func insertOrExtendForwardedHeader(request *http.Request, remoteIP string) {
 		request.Header.Set(FORWARDED_HEADER, extension)
 	}
 }
+
+// forwardedValue quotes value for a parameter of the Forwarded header unless
+// it is a token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) && !('0' <= c && c <= '9') && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+// remoteIP returns the IP of the client that sent the request, or nil if
+// request.RemoteAddr cannot be parsed.
+func remoteIP(request *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// targetList is a flag value of hosts, given comma-separated or by repeating
+// the flag. The first one given replaces the default.
+type targetList struct {
+	targets  []string
+	explicit bool
+}
+
+func (l *targetList) String() string {
+	return strings.Join(l.targets, ",")
+}
+
+func (l *targetList) Set(value string) error {
+	if !l.explicit {
+		l.targets, l.explicit = nil, true
+	}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			l.targets = append(l.targets, v)
+		}
+	}
+	return nil
+}
+
+// cidrList is a flag value holding a comma-separated list of networks. Plain
+// IPs are accepted as single-host networks.
+type cidrList []*net.IPNet
+
+func (l *cidrList) String() string {
+	var s []string
+	for _, n := range *l {
+		s = append(s, n.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *cidrList) Set(value string) error {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return fmt.Errorf("invalid IP %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	*l = nets
+	return nil
+}
+
+// Contains reports whether ip is in one of the networks.
+func (l cidrList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,1023 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setFlag sets a command line flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("Unknown flag '%s'", name)
+	}
+	old := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("Failed to set flag '%s': %s", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects the standard logger for the duration of the test. The
+// comparisons of earlier tests may still be logged to it, so assertions about
+// comparisons use the request IDs of newRequest.
+func captureLog(t *testing.T) *syncBuffer {
+	buf := &syncBuffer{}
+	log.SetOutput(buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return buf
+}
+
+// waitLog waits until the captured log contains substr n times.
+func waitLog(t *testing.T, logs *syncBuffer, substr string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(logs.String(), substr) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected '%s' %d times in the log, but received '%s'", substr, n, logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newBackend starts a test server answering every request with body. Each
+// received request is reported on the returned channel without blocking.
+func newBackend(t *testing.T, body string) (*httptest.Server, chan *http.Request) {
+	hits := make(chan *http.Request, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case hits <- r:
+		default:
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, hits
+}
+
+// hostOf returns the host:port of a test server.
+func hostOf(server *httptest.Server) string {
+	return strings.TrimPrefix(strings.TrimPrefix(server.URL, "http://"), "https://")
+}
+
+// newTestHandler points the proxy at the given production and alternate
+// servers.
+func newTestHandler(t *testing.T, production, alternate *httptest.Server) handler {
+	setFlag(t, "a", hostOf(production))
+	useTransports(t)
+	return handler{
+		Target:       hostOf(production),
+		Alternatives: []string{hostOf(alternate)},
+		Randomizer:   *newRandomizer(1),
+	}
+}
+
+// useTransports rebuilds the shared production and alternate transports from
+// the current flags.
+func useTransports(t *testing.T) {
+	productionTransport = newProductionTransport()
+	alternateTransport = newAlternateTransport()
+	for _, transport := range []*http.Transport{productionTransport, alternateTransport} {
+		t.Cleanup(transport.CloseIdleConnections)
+	}
+}
+
+// serve sends req through the handler and returns the recorded response.
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// testRequests numbers the requests returned by newRequest.
+var testRequests atomic.Int64
+
+// newRequest returns a request like httptest.NewRequest, with a request ID
+// unique to the test binary. The comparisons of other tests may still be
+// logged after they return, so assertions about the comparison of a request
+// look for the lines with its ID only.
+func newRequest(method, target string, body io.Reader) (*http.Request, string) {
+	id := fmt.Sprintf("test-%d", testRequests.Add(1))
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set("X-Request-Id", id)
+	return req, id
+}
+
+// countComparisons returns how often the comparison of the request with id
+// was logged with result, e.g. "Equal" or "Not equal".
+func countComparisons(logs *syncBuffer, id, result string) int {
+	n := 0
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, result+": ") && strings.Contains(line, "(request id "+id+")") {
+			n++
+		}
+	}
+	return n
+}
+
+// waitComparison waits until the comparison of the request with id was logged
+// with result n times.
+func waitComparison(t *testing.T, logs *syncBuffer, id, result string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for countComparisons(logs, id, result) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected '%s' %d times for request '%s', but received '%s'", result, n, id, logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitHit waits for a request to arrive on hits.
+func waitHit(t *testing.T, hits chan *http.Request) *http.Request {
+	t.Helper()
+	select {
+	case r := <-hits:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a request, but received none")
+	}
+	return nil
+}
+
+// expectNoHit asserts that no request arrives on hits for a short while.
+func expectNoHit(t *testing.T, hits chan *http.Request) {
+	t.Helper()
+	select {
+	case r := <-hits:
+		t.Errorf("Expected no request, but received '%s %s'", r.Method, r.URL)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestProductionResponseIsForwarded(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+
+	recorder := serve(h, httptest.NewRequest("GET", "/path", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	if expectation := "production"; string(body) != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, body)
+	}
+	if r := waitHit(t, altHits); r.URL.Path != "/path" {
+		t.Errorf("Expected '%s', but received '%s'", "/path", r.URL.Path)
+	}
+}
+
+func TestUnsampledRequestReachesProduction(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "p", "0")
+
+	recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+	if expectation := "production"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	waitHit(t, prodHits)
+	expectNoHit(t, altHits)
+}
+
+func TestNoMirrorHeaderSkipsAlternate(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "no-mirror-header", "X-No-Mirror")
+	setFlag(t, "no-mirror-trusted", "192.0.2.0/24,2001:db8::1")
+
+	for _, remoteAddr := range []string{"192.0.2.10:4000", "[2001:db8::1]:4000"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-No-Mirror", "1")
+		recorder := serve(h, req)
+		if expectation := "production"; recorder.Body.String() != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+		}
+	}
+	expectNoHit(t, altHits)
+
+	// The header is ignored from untrusted sources.
+	req := httptest.NewRequest("GET", "/untrusted", nil)
+	req.RemoteAddr = "198.51.100.1:4000"
+	req.Header.Set("X-No-Mirror", "1")
+	serve(h, req)
+	if r := waitHit(t, altHits); r.URL.Path != "/untrusted" {
+		t.Errorf("Expected '%s', but received '%s'", "/untrusted", r.URL.Path)
+	}
+}
+
+func TestAlternateConnectionCapSkipsExcessRequests(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	release := make(chan struct{})
+	altHits := make(chan *http.Request, 10)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		altHits <- r
+		<-release
+	}))
+	defer alternate.Close()
+	defer close(release)
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "b.max-conns-per-host", "1")
+	setFlag(t, "b.max-conns-wait", "50")
+	useTransports(t)
+	skipped := alternateQueueTimeouts.Value()
+
+	for i := 0; i < 3; i++ {
+		recorder := serve(h, httptest.NewRequest("GET", "/", nil))
+		if expectation := "production"; recorder.Body.String() != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+		}
+		waitHit(t, prodHits)
+	}
+	waitHit(t, altHits)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for alternateQueueTimeouts.Value()-skipped < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := alternateQueueTimeouts.Value() - skipped; n != 2 {
+		t.Errorf("Expected '%d' skipped alternate requests, but received '%d'", 2, n)
+	}
+	expectNoHit(t, altHits)
+}
+
+func TestConnectionIsRetiredAfterMaxRequests(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	alternate, altHits := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "transport.max-requests-per-conn", "2")
+	useTransports(t)
+	logs := captureLog(t)
+
+	conns := make(map[string]int)
+	for i := 1; i <= 6; i++ {
+		req, id := newRequest("POST", "/", strings.NewReader("body"))
+		serve(h, req)
+		conns[waitHit(t, altHits).RemoteAddr]++
+		// The connection is closed with the alternate body, after the comparison.
+		waitComparison(t, logs, id, "Equal", 1)
+	}
+	if len(conns) != 3 {
+		t.Errorf("Expected '%d' connections, but received '%v'", 3, conns)
+	}
+	for addr, n := range conns {
+		if n != 2 {
+			t.Errorf("Expected '%d' requests over %s, but received '%d'", 2, addr, n)
+		}
+	}
+}
+
+func TestProductionConnectionsAreReused(t *testing.T) {
+	production, prodHits := newBackend(t, "same")
+	alternate, _ := newBackend(t, "same")
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	conns := make(map[string]int)
+	for i := 0; i < 3; i++ {
+		req, id := newRequest("GET", "/", nil)
+		serve(h, req)
+		conns[waitHit(t, prodHits).RemoteAddr]++
+		waitComparison(t, logs, id, "Equal", 1)
+	}
+	if len(conns) != 1 {
+		t.Errorf("Expected '%d' connection, but received '%v'", 1, conns)
+	}
+
+	setFlag(t, "close-connections", "true")
+	useTransports(t)
+	conns = make(map[string]int)
+	for i := 0; i < 3; i++ {
+		req, id := newRequest("GET", "/", nil)
+		serve(h, req)
+		conns[waitHit(t, prodHits).RemoteAddr]++
+		waitComparison(t, logs, id, "Equal", 1)
+	}
+	if len(conns) != 3 {
+		t.Errorf("Expected '%d' connections, but received '%v'", 3, conns)
+	}
+}
+
+func TestAlternateIsCanceledWhenProductionWins(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	canceled := make(chan struct{}, 1)
+	alternate := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer alternate.Close()
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "b.cancel-on-loss", "true")
+	setFlag(t, "b.timeout", "5000")
+	useTransports(t)
+	dir := t.TempDir()
+	wal, err := newWALWriter(dir, 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Recorder = wal
+	logs := captureLog(t)
+	count := canceledAlternates.Value()
+
+	req, id := newRequest("GET", "/", nil)
+	recorder := serve(h, req)
+	if expectation := "production"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the alternate request to be canceled")
+	}
+	if n := canceledAlternates.Value() - count; n != 1 {
+		t.Errorf("Expected '%d' canceled alternate request, but received '%d'", 1, n)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if countComparisons(logs, id, "Equal")+countComparisons(logs, id, "Not equal") != 0 {
+		t.Errorf("Expected no comparison, but received '%s'", logs.String())
+	}
+
+	// The exchange is still recorded, without the alternate response.
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var records []*walRecord
+	readWAL(dir, func(r *walRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	if len(records) != 1 || records[0].RequestID != id || records[0].Production.Status != 200 ||
+		records[0].Alternate.Status != 0 {
+		t.Errorf("Expected the exchange recorded without the alternate response, but received '%+v'", records)
+	}
+}
+
+func TestMirrorToSeveralAlternates(t *testing.T) {
+	production, _ := newBackend(t, "same")
+	equal, equalHits := newBackend(t, "same")
+	different, differentHits := newBackend(t, "different")
+	h := newTestHandler(t, production, equal)
+	h.Alternatives = append(h.Alternatives, hostOf(different))
+	logs := captureLog(t)
+
+	recorder := serve(h, httptest.NewRequest("POST", "/path", strings.NewReader("body")))
+	if recorder.Body.String() != "same" {
+		t.Errorf("Expected '%s', but received '%s'", "same", recorder.Body.String())
+	}
+	for _, hits := range []chan *http.Request{equalHits, differentHits} {
+		if r := waitHit(t, hits); r.ContentLength != 4 {
+			t.Errorf("Expected '%d', but received '%d'", 4, r.ContentLength)
+		}
+	}
+	waitLog(t, logs, "Equal: alternate "+hostOf(equal), 1)
+	waitLog(t, logs, "alternate "+hostOf(different)+" 200", 1)
+}
+
+func TestTargetList(t *testing.T) {
+	targets := targetList{targets: []string{"localhost:8081"}}
+	for _, value := range []string{"b1:80", "b2:80,b3:80"} {
+		if err := targets.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if targets.String() != "b1:80,b2:80,b3:80" {
+		t.Errorf("Expected '%s', but received '%s'", "b1:80,b2:80,b3:80", targets.String())
+	}
+}
+
+func TestVerifyDuplication(t *testing.T) {
+	setFlag(t, "verify-duplication", "true")
+	logs := captureLog(t)
+	mismatches := duplicationMismatches.Value()
+
+	body := strings.Repeat("known body ", 1000)
+	requests := DuplicateRequest(httptest.NewRequest("POST", "/", strings.NewReader(body)), 3)
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 copies, but received %d", len(requests))
+	}
+	for _, r := range requests {
+		if b, _ := ioutil.ReadAll(r.Body); string(b) != body {
+			t.Errorf("Expected the duplicated body to equal the source")
+		}
+	}
+	if n := duplicationMismatches.Value() - mismatches; n != 0 || logs.String() != "" {
+		t.Errorf("Expected matching checksums, but received %d mismatches: '%s'", n, logs.String())
+	}
+
+	source := sha256.Sum256([]byte(body))
+	if verifyDuplicates(source[:], []byte(body), []byte(body[1:])) {
+		t.Errorf("Expected a diverged copy to be detected")
+	}
+	if !strings.Contains(logs.String(), "copy 2 of the request body diverged") {
+		t.Errorf("Expected the divergence to be logged, but received '%s'", logs.String())
+	}
+}
+
+func TestAlternateWithoutCookies(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "b.no-cookies", "true")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cookie", "session=1")
+	serve(h, req)
+	if cookie := waitHit(t, prodHits).Header.Get("Cookie"); cookie != "session=1" {
+		t.Errorf("Expected '%s', but received '%s'", "session=1", cookie)
+	}
+	if cookie := waitHit(t, altHits).Header.Get("Cookie"); cookie != "" {
+		t.Errorf("Expected no cookie, but received '%s'", cookie)
+	}
+}
+
+func TestAlternateAcceptEncoding(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "b.accept-encoding", "identity")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	serve(h, req)
+	if encoding := waitHit(t, prodHits).Header.Get("Accept-Encoding"); encoding != "gzip, br" {
+		t.Errorf("Expected '%s', but received '%s'", "gzip, br", encoding)
+	}
+	if encoding := waitHit(t, altHits).Header.Get("Accept-Encoding"); encoding != "identity" {
+		t.Errorf("Expected '%s', but received '%s'", "identity", encoding)
+	}
+}
+
+func TestSetRequestTargetWithAbsoluteURL(t *testing.T) {
+	target := "backend:8080"
+	for uri, expectation := range map[string]string{
+		"/path?q=1":                      "http://backend:8080/path?q=1",
+		"http://client.example/path?q=1": "http://backend:8080/path?q=1",
+		"https://client.example:443/a/b": "http://backend:8080/a/b",
+		"http://client.example":          "http://backend:8080/",
+	} {
+		req := httptest.NewRequest("GET", uri, nil)
+		setRequestTarget(req, "http", &target)
+		if req.URL.String() != expectation {
+			t.Errorf("Expected '%s' for '%s', but received '%s'", expectation, uri, req.URL.String())
+		}
+	}
+}
+
+func TestEncodedURIIsForwardedUnchanged(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+
+	// E.g. a signature over the query breaks if %2B, %3d or + are re-encoded.
+	uri := "/x%2Fy/%41?sig=a%2Bb%3d&q=%7e+1&r=a;b"
+	serve(h, httptest.NewRequest("GET", uri, nil))
+	for _, hits := range []chan *http.Request{prodHits, altHits} {
+		if r := waitHit(t, hits); r.RequestURI != uri {
+			t.Errorf("Expected '%s', but received '%s'", uri, r.RequestURI)
+		}
+	}
+}
+
+func TestAbsoluteFormRequestIsForwarded(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+
+	serve(h, httptest.NewRequest("GET", "http://client.example/path?q=1", nil))
+	for _, hits := range []chan *http.Request{prodHits, altHits} {
+		if r := waitHit(t, hits); r.RequestURI != "/path?q=1" {
+			t.Errorf("Expected '%s', but received '%s'", "/path?q=1", r.RequestURI)
+		}
+	}
+}
+
+func TestPreserveRawURI(t *testing.T) {
+	production, prodHits := newBackend(t, "production")
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "preserve-raw-uri", "true")
+
+	for _, uri := range []string{
+		"/a;b=c/%7e%41/x%2fy?q=%2F+&r=a;b",
+		"/caf\u00e9/na\u00efve",
+		"/path?",
+		"//double//slashes",
+	} {
+		serve(h, httptest.NewRequest("GET", uri, nil))
+		for _, hits := range []chan *http.Request{prodHits, altHits} {
+			if r := waitHit(t, hits); r.RequestURI != uri && r.URL.RequestURI() != uri {
+				t.Errorf("Expected '%s', but received '%s'", uri, r.RequestURI)
+			}
+		}
+	}
+}
+
+func TestHTTP10ClientConnectionIsClosed(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Write([]byte("production"))
+	}))
+	defer production.Close()
+	alternate, _ := newBackend(t, "alternate")
+	proxy := httptest.NewServer(newTestHandler(t, production, alternate))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", hostOf(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	request := func(header string) *http.Response {
+		t.Helper()
+		if _, err := conn.Write([]byte("GET / HTTP/1.0\r\nHost: proxy\r\n" + header + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, _ := ioutil.ReadAll(resp.Body); string(body) != "production" {
+			t.Errorf("Expected '%s', but received '%s'", "production", body)
+		}
+		if v := resp.Header.Get("Keep-Alive"); v != "" {
+			t.Errorf("Expected no '%s' header, but received '%s'", "Keep-Alive", v)
+		}
+		return resp
+	}
+
+	// A keep-alive connection serves the next request.
+	if resp := request("Connection: keep-alive\r\n"); resp.Close {
+		t.Errorf("Expected the keep-alive connection to stay open")
+	}
+	if resp := request(""); !resp.Close {
+		t.Errorf("Expected 'Connection: close', but received '%s'", resp.Header.Get("Connection"))
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the connection to be closed, but received '%v'", err)
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{"Connection": {"keep-alive, X-Hop"}, "X-Hop": {"1"}, "Upgrade": {"h2c"}, "X-End": {"1"}}
+	removeHopHeaders(h)
+	if len(h) != 1 || h.Get("X-End") != "1" {
+		t.Errorf("Expected only the end-to-end header, but received '%v'", h)
+	}
+}
+
+func TestTLSServerNameFollowsHost(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	type handshake struct{ host, serverName string }
+	handshakes := make(chan handshake, 10)
+	alternate := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handshakes <- handshake{r.Host, r.TLS.ServerName}
+	}))
+	defer alternate.Close()
+	roots := alternate.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "b.scheme", "https")
+	captureLog(t)
+
+	for _, test := range []struct {
+		host, serverName string
+		expected         handshake
+	}{
+		{"example.com:8443", "", handshake{"example.com:8443", "example.com"}},
+		{"www.example.net", "example.com", handshake{"www.example.net", "example.com"}},
+	} {
+		setFlag(t, "b.host", test.host)
+		setFlag(t, "b.tls-servername", test.serverName)
+		useTransports(t)
+		alternateTransport.TLSClientConfig.RootCAs = roots
+
+		serve(h, httptest.NewRequest("GET", "/", nil))
+		select {
+		case received := <-handshakes:
+			if received != test.expected {
+				t.Errorf("Expected '%+v', but received '%+v'", test.expected, received)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a request for '%s', but received none", test.host)
+		}
+	}
+}
+
+func TestInsecureSkipVerify(t *testing.T) {
+	production := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("production over " + r.Proto))
+	}))
+	defer production.Close()
+	alternate, hits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.scheme", "https")
+	captureLog(t)
+
+	// The test certificate is self-signed, so it is only accepted when
+	// verification is skipped.
+	for insecure, expected := range map[string]int{"true": 200, "false": 502} {
+		setFlag(t, "a.insecure-skip-verify", insecure)
+		useTransports(t)
+		w := serve(h, httptest.NewRequest("GET", "/", nil))
+		if w.Code != expected {
+			t.Errorf("Expected '%d', but received '%d'", expected, w.Code)
+		}
+		if expected == 200 && w.Body.String() != "production over HTTP/1.1" {
+			t.Errorf("Expected '%s', but received '%s'", "production over HTTP/1.1", w.Body.String())
+		}
+		waitHit(t, hits)
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	for _, test := range []struct{ serverName, host, expected string }{
+		{"", "", ""},
+		{"", "example.com", "example.com"},
+		{"", "example.com:443", "example.com"},
+		{"", "[::1]", "::1"},
+		{"override.com", "example.com", "override.com"},
+	} {
+		if name := tlsServerName(test.serverName, test.host); name != test.expected {
+			t.Errorf("Expected '%s', but received '%s'", test.expected, name)
+		}
+	}
+}
+
+func TestKeepAliveFromFlags(t *testing.T) {
+	for _, c := range []struct {
+		production, alternate string
+		expectation           [2]time.Duration
+	}{
+		{"30000", "30000", [2]time.Duration{30 * time.Second, 30 * time.Second}},
+		{"1500", "0", [2]time.Duration{1500 * time.Millisecond, -1}},
+	} {
+		setFlag(t, "a.keepalive", c.production)
+		setFlag(t, "b.keepalive", c.alternate)
+		for i, keepAlive := range []int{*productionKeepAlive, *alternateKeepAlive} {
+			if dialer := newDialer(keepAlive, 0); dialer.KeepAlive != c.expectation[i] {
+				t.Errorf("Expected '%s', but received '%s'", c.expectation[i], dialer.KeepAlive)
+			}
+		}
+	}
+}
+
+func TestTLSServerNameOverride(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("verified"))
+	}))
+	defer backend.Close()
+	roots := backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	captureLog(t)
+
+	// The test certificate is valid for example.com, but not for localhost.
+	for serverName, verified := range map[string]bool{"example.com": true, "localhost": false} {
+		transport := newTransport(time.Second, newDialer(0, 0), serverName, false)
+		transport.TLSClientConfig.RootCAs = roots
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RequestURI = ""
+		target := hostOf(backend)
+		setRequestTarget(req, "https", &target)
+		resp, err := transport.RoundTrip(req)
+		if verified && err != nil {
+			t.Errorf("Expected a verified handshake for '%s', but received '%s'", serverName, err)
+		} else if !verified && err == nil {
+			t.Errorf("Expected a failed verification for '%s'", serverName)
+		}
+		if resp != nil {
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "verified" {
+				t.Errorf("Expected '%s', but received '%s'", "verified", body)
+			}
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestCompareJSON(t *testing.T) {
+	for _, test := range []struct {
+		prod, alt string
+		equal     bool
+	}{
+		{`{"a": 1, "b": "x"}`, `{"b":"x","a":1}`, true},
+		{`{"a": {"b": [1, 2], "c": null}}`, `{"a": {"c": null, "b": [1, 2]}}`, true},
+		{`{"a": {"b": [1, 2]}}`, `{"a": {"b": [2, 1]}}`, false},
+		{`[{"id": 1}, {"id": 2}]`, ` [ {"id":1}, {"id":2} ] `, true},
+		{`[{"id": 1}, {"id": 2}]`, `[{"id": 1}]`, false},
+		{`{"a": 1}`, `{"a": "1"}`, false},
+		{`not json`, `not json`, true},
+		{`not json`, `not  json`, false},
+		{`{"a": 1}`, `{"a": 1`, false},
+	} {
+		recorder := httptest.NewRecorder()
+		recorder.WriteString(test.alt)
+		if equal := compareResp([]byte(test.prod), http.Header{}, recorder.Result()); equal != test.equal {
+			t.Errorf("Expected '%t' for '%s' and '%s', but received '%t'", test.equal, test.prod, test.alt, equal)
+		}
+	}
+}
+
+func TestChunkedEmptyBodyIsDuplicated(t *testing.T) {
+	type received struct {
+		contentLength    int64
+		transferEncoding []string
+		body             string
+		err              error
+	}
+	newRecordingBackend := func() (*httptest.Server, chan received) {
+		requests := make(chan received, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			requests <- received{r.ContentLength, r.TransferEncoding, string(body), err}
+			w.Write([]byte("same"))
+		}))
+		t.Cleanup(server.Close)
+		return server, requests
+	}
+	production, productionRequests := newRecordingBackend()
+	alternate, alternateRequests := newRecordingBackend()
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", hostOf(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST / HTTP/1.1\r\nHost: example.com\r\nX-Request-Id: empty-chunked\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected '%d', but received '%d'", http.StatusOK, resp.StatusCode)
+	}
+	for _, requests := range []chan received{productionRequests, alternateRequests} {
+		select {
+		case r := <-requests:
+			if r.err != nil || r.body != "" || r.contentLength != 0 || len(r.transferEncoding) != 0 {
+				t.Errorf("Expected an empty body with Content-Length 0, but received '%+v'", r)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected a request, but received none")
+		}
+	}
+	waitComparison(t, logs, "empty-chunked", "Equal", 1)
+}
+
+// newHangingBackend returns a backend never answering, and a channel yielding
+// when the connection of a request to it is aborted.
+func newHangingBackend(t *testing.T) (*httptest.Server, chan struct{}) {
+	aborted := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, aborted
+}
+
+func TestLargeBodyIsStreamed(t *testing.T) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		fmt.Fprint(w, n)
+	}))
+	defer production.Close()
+	alternate, altHits := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "max-buffer-bytes", "1048576")
+	// Copying the bodies can take longer than the default timeout under -race.
+	setFlag(t, "a.timeout", "60000")
+	captureLog(t)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+	streamed := streamedBodies.Value()
+
+	const size = 64 << 20
+	for _, contentLength := range []int64{-1, size} {
+		req, _ := http.NewRequest("POST", proxy.URL, io.LimitReader(rand.New(rand.NewSource(1)), size))
+		req.ContentLength = contentLength
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		runtime.ReadMemStats(&after)
+		if expectation := fmt.Sprint(size); string(body) != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, body)
+		}
+		// Buffering the body would take a multiple of its size.
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Errorf("Expected at most %d bytes allocated with Content-Length %d, but received '%d'", 16<<20, contentLength, allocated)
+		}
+	}
+	if n := streamedBodies.Value() - streamed; n != 2 {
+		t.Errorf("Expected '%d' streamed bodies, but received '%d'", 2, n)
+	}
+	expectNoHit(t, altHits)
+
+	// Smaller bodies are still mirrored.
+	resp, err := http.Post(proxy.URL, "text/plain", strings.NewReader("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if r := waitHit(t, altHits); r.ContentLength != 5 {
+		t.Errorf("Expected '%d', but received '%d'", 5, r.ContentLength)
+	}
+}
+
+func TestSlowBackendIsAbortedAtDeadline(t *testing.T) {
+	production, aborted := newHangingBackend(t)
+	request, _ := http.NewRequest("GET", production.URL, nil)
+	useTransports(t)
+	captureLog(t)
+
+	var err error
+	start := time.Now()
+	resp := <-handleAsyncRequest(request, 100*time.Millisecond, &err, nil)
+	if resp != nil || !isTimeout(err) {
+		t.Errorf("Expected a timeout, but received '%v'", err)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be aborted, but it was not")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to be aborted at the deadline, but it took '%s'", elapsed)
+	}
+}
+
+func TestProductionIsAbortedWhenClientGoesAway(t *testing.T) {
+	production, aborted := newHangingBackend(t)
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.timeout", "5000")
+	captureLog(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serve(h, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the production request to be aborted, but it was not")
+	}
+	<-done
+}
+
+func TestAlternateIsAbortedWhenClientDisconnects(t *testing.T) {
+	production, productionAborted := newHangingBackend(t)
+	alternate, alternateAborted := newHangingBackend(t)
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "a.timeout", "5000")
+	setFlag(t, "b.timeout", "5000")
+	captureLog(t)
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+	gone := clientGoneAlternates.Value()
+
+	conn, err := net.Dial("tcp", hostOf(proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", hostOf(proxy))
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	for name, aborted := range map[string]chan struct{}{"production": productionAborted, "alternate": alternateAborted} {
+		select {
+		case <-aborted:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the %s request to be aborted, but it was not", name)
+		}
+	}
+	if n := clientGoneAlternates.Value() - gone; n != 1 {
+		t.Errorf("Expected '%d' alternate request canceled, but received '%d'", 1, n)
+	}
+}
+
+func BenchmarkProductionRequest(b *testing.B) {
+	production := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("production"))
+	}))
+	defer production.Close()
+	target := hostOf(production)
+	productionTransport = newProductionTransport()
+	defer productionTransport.CloseIdleConnections()
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		request, _ := http.NewRequest("GET", "http://"+target+"/", nil)
+		var err error
+		resp := <-handleAsyncRequest(request, time.Second, &err, nil)
+		if resp == nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+func TestCompareModes(t *testing.T) {
+	production, _ := newBackend(t, `{"id": 1, "name": "a"}`)
+	alternate, altHits := newBackend(t, `{"name": "a", "id": 1}`)
+	h := newTestHandler(t, production, alternate)
+	logs := captureLog(t)
+
+	setFlag(t, "compare-mode", "json")
+	req, id := newRequest("GET", "/", nil)
+	serve(h, req)
+	waitHit(t, altHits)
+	waitLog(t, logs, "Equal: alternate "+hostOf(alternate)+" (request id "+id+")", 1)
+
+	setFlag(t, "compare-mode", "bytes")
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitHit(t, altHits)
+	waitLog(t, logs, "Not equal: GET / (request id "+id+")", 1)
+
+	setFlag(t, "compare-mode", "none")
+	req, id = newRequest("GET", "/", nil)
+	serve(h, req)
+	waitHit(t, altHits)
+	time.Sleep(50 * time.Millisecond)
+	if countComparisons(logs, id, "Equal")+countComparisons(logs, id, "Not equal") != 0 {
+		t.Errorf("Expected no comparison without a mode, but received '%s'", logs.String())
+	}
+}
+
+func TestDuplicatedHeadersAreIndependent(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Shared", "original")
+	requests := DuplicateRequest(req, 2)
+	requests[0].Header.Set("X-Shared", "changed")
+	requests[0].Header.Add("X-Forwarded-For", "192.0.2.1")
+	for _, header := range []http.Header{requests[1].Header, req.Header} {
+		if value := header.Get("X-Shared"); value != "original" {
+			t.Errorf("Expected '%s', but received '%s'", "original", value)
+		}
+		if value := header.Get("X-Forwarded-For"); value != "" {
+			t.Errorf("Expected no '%s', but received '%s'", "X-Forwarded-For", value)
+		}
+	}
+}
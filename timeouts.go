@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// backendTimeouts are the timeout flags adjustable on /config/timeout/, by
+// backend.
+var backendTimeouts = map[string]*int64{
+	"a": productionTimeout,
+	"b": alternateTimeout,
+}
+
+func init() {
+	http.HandleFunc("/config/timeout/", serveTimeout)
+}
+
+// backendTimeout returns the current value of a timeout flag. Requests read
+// it when they start, so a change applies to the following requests.
+func backendTimeout(flag *int64) time.Duration {
+	return time.Duration(atomic.LoadInt64(flag)) * time.Millisecond
+}
+
+// serveTimeout reports the timeout of the backend at /config/timeout/a or
+// /config/timeout/b and lets PUT change it with the 'ms' parameter, in
+// milliseconds.
+func serveTimeout(w http.ResponseWriter, req *http.Request) {
+	backend := req.URL.Path[len("/config/timeout/"):]
+	timeout, ok := backendTimeouts[backend]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+	case "PUT":
+		ms, err := strconv.ParseInt(req.FormValue("ms"), 10, 64)
+		if err != nil || ms <= 0 {
+			http.Error(w, "ms must be a positive number of milliseconds", http.StatusBadRequest)
+			return
+		}
+		atomic.StoreInt64(timeout, ms)
+		log.Printf("Timeout of -%s set to %dms", backend, ms)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"ms": atomic.LoadInt64(timeout)})
+}
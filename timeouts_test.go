@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutIsAdjustedAtRuntime(t *testing.T) {
+	production, aborted := newHangingBackend(t)
+	alternate, _ := newBackend(t, "alternate")
+	setFlag(t, "a.timeout", "5000")
+	h := newTestHandler(t, production, alternate)
+	captureLog(t)
+
+	recorder := httptest.NewRecorder()
+	serveTimeout(recorder, httptest.NewRequest("PUT", "/config/timeout/a?ms=100", nil))
+	if expectation := `{"ms":100}` + "\n"; recorder.Body.String() != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, recorder.Body.String())
+	}
+
+	// The transport was built with the old timeout, the request uses the new one.
+	start := time.Now()
+	recorder = serve(h, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != 504 {
+		t.Errorf("Expected '%d', but received '%d'", 504, recorder.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to be aborted after the new timeout, but it took '%s'", elapsed)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the request to be aborted, but it was not")
+	}
+
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{"PUT", "/config/timeout/a?ms=0", 400},
+		{"PUT", "/config/timeout/a?ms=fast", 400},
+		{"PUT", "/config/timeout/c?ms=100", 404},
+		{"POST", "/config/timeout/b?ms=100", 405},
+		{"GET", "/config/timeout/a", 200},
+	} {
+		recorder := httptest.NewRecorder()
+		serveTimeout(recorder, httptest.NewRequest(c.method, c.target, nil))
+		if recorder.Code != c.code {
+			t.Errorf("Expected '%d' for %s %s, but received '%d'", c.code, c.method, c.target, recorder.Code)
+		}
+	}
+	if timeout := backendTimeout(productionTimeout); timeout != 100*time.Millisecond {
+		t.Errorf("Expected '%s', but received '%s'", 100*time.Millisecond, timeout)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// The listener accepts connections but never answers the TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	captureLog(t)
+
+	for _, c := range []struct {
+		connect, timeout string
+		min, max         time.Duration
+		message          string
+	}{
+		// A short connect timeout gives up on the handshake early.
+		{"50", "5000", 0, time.Second, "TLS handshake timeout"},
+		// Without one, the single timeout applies to connecting, as before.
+		{"0", "200", 150 * time.Millisecond, time.Second, "deadline exceeded"},
+	} {
+		setFlag(t, "a.connect-timeout", c.connect)
+		setFlag(t, "a.timeout", c.timeout)
+		useTransports(t)
+		request, _ := http.NewRequest("GET", "https://"+listener.Addr().String()+"/", nil)
+		var err error
+		start := time.Now()
+		resp := <-handleAsyncRequest(request, backendTimeout(productionTimeout), &err, nil)
+		elapsed := time.Since(start)
+		if resp != nil || !isTimeout(err) || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("Expected a timeout with '%s', but received '%v'", c.message, err)
+		}
+		if elapsed < c.min || elapsed > c.max {
+			t.Errorf("Expected to give up after %s to %s, but it took '%s'", c.min, c.max, elapsed)
+		}
+	}
+	if dialer := newDialer(0, 250); dialer.Timeout != 250*time.Millisecond {
+		t.Errorf("Expected '%s', but received '%s'", 250*time.Millisecond, dialer.Timeout)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	tlsMinVersion = flag.String("tls-min-version", "1.2", "minimum TLS version accepted by the listener: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers    = flag.String("tls-ciphers", "", "comma-separated cipher suites accepted by the listener for TLS 1.2 and below, e.g. 'TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256'; the Go defaults when empty")
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig returns the TLS configuration of the listener, without its
+// certificates, from the minimum version and the comma-separated names of the
+// cipher suites. TLS 1.3 suites are not configurable.
+func serverTLSConfig(minVersion, ciphers string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+	suites := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(ciphers, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	return config, nil
+}
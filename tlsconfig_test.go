@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServerTLSConfig(t *testing.T) {
+	config, err := serverTLSConfig("1.3", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Errorf("Expected '%x', but received '%x'", tls.VersionTLS13, config.MinVersion)
+	}
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if len(config.CipherSuites) != 2 || config.CipherSuites[0] != expected[0] || config.CipherSuites[1] != expected[1] {
+		t.Errorf("Expected '%x', but received '%x'", expected, config.CipherSuites)
+	}
+	for _, invalid := range [][2]string{{"1.4", ""}, {"TLS1.2", ""}, {"1.2", "TLS_UNKNOWN"}} {
+		if _, err := serverTLSConfig(invalid[0], invalid[1]); err == nil {
+			t.Errorf("Expected an error for '%s' and '%s'", invalid[0], invalid[1])
+		}
+	}
+}
+
+func TestHandshakeBelowMinimumVersionIsRejected(t *testing.T) {
+	for minVersion, accepted := range map[string]bool{"1.2": false, "1.1": true} {
+		setFlag(t, "tls-min-version", minVersion)
+		config, err := serverTLSConfig(*tlsMinVersion, *tlsCiphers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		server.TLS = config
+		// The failed handshake is logged.
+		server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		server.StartTLS()
+		client := server.Client()
+		client.Transport.(*http.Transport).TLSClientConfig.MinVersion = tls.VersionTLS10
+		client.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS11
+		resp, err := client.Get(server.URL)
+		if accepted && err != nil {
+			t.Errorf("Expected a TLS 1.1 handshake with minimum %s, but received '%s'", minVersion, err)
+		} else if !accepted && err == nil {
+			t.Errorf("Expected a failed TLS 1.1 handshake with minimum %s", minVersion)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		server.Close()
+	}
+}
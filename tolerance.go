@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"math"
+)
+
+var floatTolerance = flag.Float64("float-tolerance", 0, "numbers in JSON responses differing by less than this are equal, e.g. 0.000001 for scores differing in the last decimals; 0 compares them exactly")
+
+// equalJSON reports whether the decoded JSON documents a and b are equal,
+// with their numbers differing by less than tolerance.
+func equalJSON(a, b interface{}, tolerance float64) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := b[key]
+			if !ok || !equalJSON(value, other, tolerance) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i], tolerance) {
+				return false
+			}
+		}
+		return true
+	case float64:
+		b, ok := b.(float64)
+		return ok && (a == b || math.Abs(a-b) < tolerance)
+	default:
+		return a == b
+	}
+}
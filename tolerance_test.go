@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFloatTolerance(t *testing.T) {
+	for _, test := range []struct {
+		tolerance, prod, alt string
+		equal                bool
+	}{
+		{"0", `{"score": 0.1234567}`, `{"score": 0.1234568}`, false},
+		{"0.000001", `{"score": 0.1234567}`, `{"score": 0.1234568}`, true},
+		{"0.000001", `{"score": 0.12345}`, `{"score": 0.12346}`, false},
+		{"0.001", `{"items": [{"score": 1.0001}, {"score": 2}]}`, `{"items": [{"score": 1.0002}, {"score": 2.0009}]}`, true},
+		{"0.001", `{"items": [[1, 2.5], [3]]}`, `{"items": [[1, 2.502], [3]]}`, false},
+		{"0.001", `[1.0001, "1.0001"]`, `[1.0002, "1.0002"]`, false},
+		{"0.001", `{"score": 1, "n": null}`, `{"score": 1.0001, "m": null}`, false},
+		{"0.001", `{"score": 1}`, `{"score": "1"}`, false},
+	} {
+		setFlag(t, "float-tolerance", test.tolerance)
+		for _, canonical := range []string{"false", "true"} {
+			setFlag(t, "compare.canonical", canonical)
+			recorder := httptest.NewRecorder()
+			recorder.WriteString(test.alt)
+			if equal := compareResp([]byte(test.prod), http.Header{}, recorder.Result()); equal != test.equal {
+				t.Errorf("Expected '%t' for '%s' and '%s' within %s, but received '%t'", test.equal, test.prod, test.alt, test.tolerance, equal)
+			}
+		}
+	}
+}
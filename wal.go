@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	walDir       = flag.String("wal.dir", "", "directory of a write-ahead log recording every request with both responses, disabled when empty")
+	walSample    = flag.Float64("wal.sample", 100.0, "percentage of requests recorded in the write-ahead log")
+	walMaxSize   = flag.Int64("wal.max-size", 64<<20, "bytes after which the write-ahead log rotates to a new file")
+	walBuffer    = flag.Int("wal.buffer", 1024, "records queued for the write-ahead log before new ones are dropped")
+	walReplay    = flag.String("wal.replay", "", "directory of a write-ahead log whose requests are replayed through teeproxy at startup")
+	walKeepCreds = flag.Bool("wal.keep-credentials", false, "record the credential headers like Authorization and Cookie as they are in the write-ahead log, instead of redacted")
+)
+
+var walDropped = expvar.NewInt("wal_dropped")
+
+// The write-ahead log is a directory of files named by a sequence number and
+// walSuffix. Each file is a series of frames consisting of a big-endian
+// uint32 payload length, the payload, and the CRC-32 (IEEE) of the payload.
+// The payload is an encoded walRecord, see walRecord.encode.
+const (
+	walSuffix  = ".wal"
+	walVersion = 1
+)
+
+// walRecord is a recorded request with the responses of both targets. A
+// response with a zero Status was not received.
+type walRecord struct {
+	Time       time.Time
+	RequestID  string
+	Method     string
+	URI        string
+	Host       string
+	Header     http.Header
+	Body       []byte
+	Production walResponse
+	Alternate  walResponse
+}
+
+type walResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+func newWALRecord(x *exchange) *walRecord {
+	r := &walRecord{
+		Time:      time.Now(),
+		RequestID: x.RequestID,
+		Method:    x.Request.Method,
+		URI:       x.Request.URL.RequestURI(),
+		Host:      x.Request.Host,
+		Header:    x.Request.Header,
+		Body:      x.RequestBody,
+	}
+	if x.Production != nil {
+		r.Production = walResponse{x.Production.StatusCode, x.Production.Header, x.ProductionBody}
+	}
+	if x.Alternate != nil {
+		r.Alternate = walResponse{x.Alternate.StatusCode, x.Alternate.Header, x.AlternateBody}
+	}
+	return r
+}
+
+// encode returns the payload of the record: a version byte followed by the
+// fields in declaration order. Integers are varints, strings and byte slices
+// are prefixed by their uvarint length, and headers are a uvarint count of
+// names, each followed by a uvarint count of values.
+func (r *walRecord) encode() []byte {
+	var e walEncoder
+	e.WriteByte(walVersion)
+	e.putVarint(r.Time.UnixNano())
+	e.putString(r.RequestID)
+	e.putString(r.Method)
+	e.putString(r.URI)
+	e.putString(r.Host)
+	e.putHeader(r.Header)
+	e.putBytes(r.Body)
+	for _, resp := range []walResponse{r.Production, r.Alternate} {
+		e.putVarint(int64(resp.Status))
+		e.putHeader(resp.Header)
+		e.putBytes(resp.Body)
+	}
+	return e.Bytes()
+}
+
+func decodeWALRecord(payload []byte) (*walRecord, error) {
+	if len(payload) == 0 || payload[0] != walVersion {
+		return nil, errors.New("unsupported record version")
+	}
+	d := walDecoder{b: payload[1:]}
+	r := &walRecord{
+		Time:      time.Unix(0, d.varint()),
+		RequestID: d.string(),
+		Method:    d.string(),
+		URI:       d.string(),
+		Host:      d.string(),
+		Header:    d.header(),
+		Body:      d.bytes(),
+	}
+	for _, resp := range []*walResponse{&r.Production, &r.Alternate} {
+		resp.Status = int(d.varint())
+		resp.Header = d.header()
+		resp.Body = d.bytes()
+	}
+	return r, d.err
+}
+
+type walEncoder struct {
+	bytes.Buffer
+}
+
+func (e *walEncoder) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *walEncoder) putUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (e *walEncoder) putBytes(b []byte) {
+	e.putUvarint(uint64(len(b)))
+	e.Write(b)
+}
+
+func (e *walEncoder) putString(s string) {
+	e.putUvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *walEncoder) putHeader(h http.Header) {
+	e.putUvarint(uint64(len(h)))
+	for name, values := range h {
+		e.putString(name)
+		e.putUvarint(uint64(len(values)))
+		for _, v := range values {
+			e.putString(v)
+		}
+	}
+}
+
+// walDecoder reads the values written by walEncoder. After the first error
+// every read returns a zero value and err is set.
+type walDecoder struct {
+	b   []byte
+	err error
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+func (d *walDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *walDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errCorruptRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *walDecoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.b)) {
+		d.err = errCorruptRecord
+		return nil
+	}
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	if n == 0 {
+		return nil
+	}
+	return b
+}
+
+func (d *walDecoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *walDecoder) header() http.Header {
+	n := d.uvarint()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	h := make(http.Header)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		name := d.string()
+		count := d.uvarint()
+		for j := uint64(0); j < count && d.err == nil; j++ {
+			h[name] = append(h[name], d.string())
+		}
+	}
+	return h
+}
+
+// walWriter appends records to the write-ahead log in the background.
+// Records are queued in a bounded buffer and dropped when it is full, so that
+// recording never slows down request serving.
+type walWriter struct {
+	dir     string
+	maxSize int64
+	records chan *walRecord
+	done    chan struct{}
+
+	// Only used by the writing goroutine.
+	file *os.File
+	size int64
+	seq  int
+}
+
+// newWALWriter opens a write-ahead log in dir. Records always go to a new
+// file, following the existing ones. The directory and files are only
+// accessible by their owner, since they hold the requests of the clients.
+func newWALWriter(dir string, maxSize int64, buffer int) (*walWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := walFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &walWriter{
+		dir:     dir,
+		maxSize: maxSize,
+		records: make(chan *walRecord, buffer),
+		done:    make(chan struct{}),
+	}
+	if len(files) > 0 {
+		fmt.Sscanf(filepath.Base(files[len(files)-1]), "%d", &w.seq)
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Record queues the exchange if it is sampled by -wal.sample. Its credential
+// headers are redacted unless -wal.keep-credentials is set.
+func (w *walWriter) Record(x *exchange) {
+	if *walSample < 100.0 && rand.Float64()*100 >= *walSample {
+		return
+	}
+	r := newWALRecord(x)
+	if !*walKeepCreds {
+		r.Header = redactedHeader(r.Header)
+		r.Production.Header = redactedHeader(r.Production.Header)
+		r.Alternate.Header = redactedHeader(r.Alternate.Header)
+	}
+	select {
+	case w.records <- r:
+	default:
+		walDropped.Add(1)
+	}
+}
+
+// Close writes the queued records and closes the log.
+func (w *walWriter) Close() error {
+	close(w.records)
+	<-w.done
+	return w.file.Close()
+}
+
+func (w *walWriter) run() {
+	defer close(w.done)
+	for r := range w.records {
+		if err := w.write(r); err != nil {
+			log.Println("Failed to write to the write-ahead log:", err)
+		}
+	}
+}
+
+func (w *walWriter) write(r *walRecord) error {
+	payload := r.encode()
+	frame := make([]byte, 4, len(payload)+8)
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+
+	if w.size > 0 && w.size+int64(len(frame)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(frame)
+	w.size += int64(n)
+	return err
+}
+
+// rotate closes the current file, if any, and starts the next one.
+func (w *walWriter) rotate() error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+	w.seq++
+	name := filepath.Join(w.dir, fmt.Sprintf("%08d%s", w.seq, walSuffix))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	w.file, w.size = file, 0
+	return nil
+}
+
+// walFiles returns the files of the write-ahead log in dir in order.
+func walFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+walSuffix))
+	sort.Strings(files)
+	return files, err
+}
+
+// readWAL calls fn for every record of the write-ahead log in dir, in the
+// order they were written.
+func readWAL(dir string, fn func(*walRecord) error) error {
+	files, err := walFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		for len(data) > 0 {
+			if len(data) < 4 || uint64(len(data)) < 8+uint64(binary.BigEndian.Uint32(data)) {
+				return fmt.Errorf("%s: truncated record", name)
+			}
+			n := binary.BigEndian.Uint32(data)
+			payload := data[4 : 4+n]
+			if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4+n:]) {
+				return fmt.Errorf("%s: checksum mismatch", name)
+			}
+			r, err := decodeWALRecord(payload)
+			if err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+			data = data[8+n:]
+		}
+	}
+	return nil
+}
+
+// replayWAL sends the recorded requests of the write-ahead log in dir through
+// h, one at a time, and returns how many were replayed.
+func replayWAL(dir string, h http.Handler) (int, error) {
+	n := 0
+	err := readWAL(dir, func(r *walRecord) error {
+		req, err := http.NewRequest(r.Method, r.URI, bytes.NewReader(r.Body))
+		if err != nil {
+			return err
+		}
+		req.RequestURI = r.URI
+		req.Host = r.Host
+		if r.Header != nil {
+			req.Header = r.Header
+		}
+		h.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, req)
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// discardResponseWriter is a ResponseWriter dropping everything written to it.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWALRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWALWriter(dir, 200, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"/one", "/two?x=1", "/three"}
+	for _, path := range paths {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("X-Test", path)
+		w.Record(&exchange{
+			RequestID:      "id" + path,
+			Request:        req,
+			RequestBody:    []byte("body" + path),
+			Production:     &http.Response{StatusCode: 200, Header: http.Header{"A": {"1", "2"}}},
+			ProductionBody: []byte("production"),
+		})
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := walFiles(dir)
+	if len(files) < 2 {
+		t.Errorf("Expected the log to rotate, but received %d files", len(files))
+	}
+	var records []*walRecord
+	if err := readWAL(dir, func(r *walRecord) error {
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(paths) {
+		t.Fatalf("Expected '%d' records, but received '%d'", len(paths), len(records))
+	}
+	for i, r := range records {
+		if r.URI != paths[i] || string(r.Body) != "body"+paths[i] || r.RequestID != "id"+paths[i] {
+			t.Errorf("Expected request '%s', but received '%s' with body '%s'", paths[i], r.URI, r.Body)
+		}
+		if r.Header.Get("X-Test") != paths[i] {
+			t.Errorf("Expected '%s', but received '%s'", paths[i], r.Header.Get("X-Test"))
+		}
+		if r.Production.Status != 200 || string(r.Production.Body) != "production" ||
+			!reflect.DeepEqual(r.Production.Header, http.Header{"A": {"1", "2"}}) {
+			t.Errorf("Expected the production response, but received '%+v'", r.Production)
+		}
+		if r.Alternate.Status != 0 {
+			t.Errorf("Expected no alternate response, but received '%+v'", r.Alternate)
+		}
+	}
+}
+
+func TestWALIsPrivate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	w, err := newWALWriter(dir, 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Test", "kept")
+	production := &http.Response{StatusCode: 200, Header: http.Header{"Set-Cookie": {"session=secret"}}}
+	w.Record(&exchange{RequestID: "private", Request: req, Production: production})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := walFiles(dir)
+	for name, expected := range map[string]os.FileMode{dir: 0700, files[0]: 0600} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != expected {
+			t.Errorf("Expected '%v' for '%s', but received '%v'", expected, name, info.Mode().Perm())
+		}
+	}
+	readWAL(dir, func(r *walRecord) error {
+		if r.Header.Get("Authorization") != redacted || r.Header.Get("X-Test") != "kept" ||
+			r.Production.Header.Get("Set-Cookie") != redacted {
+			t.Errorf("Expected the credentials redacted, but received '%v' and '%v'", r.Header, r.Production.Header)
+		}
+		return nil
+	})
+	if req.Header.Get("Authorization") != "Bearer secret" || production.Header.Get("Set-Cookie") != "session=secret" {
+		t.Errorf("Expected the exchange left as it is, but received '%v' and '%v'", req.Header, production.Header)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	production, _ := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "p", "0")
+	dir := t.TempDir()
+	w, err := newWALWriter(dir, 1<<20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Recorder = w
+	requests := []string{"PUT /first one", "POST /second?q=2 two", "GET /third "}
+	for _, r := range requests {
+		parts := strings.SplitN(r, " ", 3)
+		serve(h, httptest.NewRequest(parts[0], parts[1], strings.NewReader(parts[2])))
+	}
+	h.Recorder = nil
+	w.Close()
+
+	replayed := make(chan string, len(requests))
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		replayed <- r.Method + " " + r.URL.RequestURI() + " " + string(body)
+	}))
+	defer target.Close()
+	setFlag(t, "a", hostOf(target))
+
+	n, err := replayWAL(dir, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(requests) {
+		t.Errorf("Expected '%d' replayed requests, but received '%d'", len(requests), n)
+	}
+	close(replayed)
+	i := 0
+	for r := range replayed {
+		if r != requests[i] {
+			t.Errorf("Expected '%s', but received '%s'", requests[i], r)
+		}
+		i++
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	mismatchWebhook        = flag.String("mismatch-webhook", "", "URL every mismatch is POSTed to as JSON, for alerting; disabled when empty")
+	mismatchWebhookRate    = flag.Float64("mismatch-webhook.rate", 1, "mismatches per second POSTed to the -mismatch-webhook, excess ones are dropped")
+	mismatchWebhookTimeout = flag.Int("mismatch-webhook.timeout", 2000, "timeout in milliseconds of a POST to the -mismatch-webhook")
+	mismatchWebhookBody    = flag.Int("mismatch-webhook.max-body", 1024, "bytes of each response body included in a -mismatch-webhook payload")
+)
+
+var webhookDropped = expvar.NewInt("webhook_dropped")
+
+// webhookBuffer is the number of mismatches queued for the webhook.
+const webhookBuffer = 64
+
+// mismatchPayload is the JSON POSTed to the webhook for a mismatch.
+type mismatchPayload struct {
+	RequestID        string `json:"request_id"`
+	Method           string `json:"method"`
+	Path             string `json:"path"`
+	Alternate        string `json:"alternate,omitempty"`
+	ProductionStatus int    `json:"production_status"`
+	AlternateStatus  int    `json:"alternate_status"`
+	ProductionBody   string `json:"production_body"`
+	AlternateBody    string `json:"alternate_body"`
+}
+
+// webhook posts mismatches to an external URL in the background. Like the
+// observer, it queues them in a bounded buffer and drops them when it is
+// full; a token bucket holding up to one second's worth of mismatches also
+// limits their rate, so that a flood of mismatches does not flood the webhook.
+type webhook struct {
+	url      string
+	client   *http.Client
+	maxBody  int
+	rate     float64
+	now      func() time.Time
+	payloads chan *mismatchPayload
+	done     chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // when tokens were last added
+}
+
+func newWebhook(url string, rate float64, timeout time.Duration, maxBody int, now func() time.Time) *webhook {
+	w := &webhook{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		maxBody:  maxBody,
+		rate:     rate,
+		now:      now,
+		payloads: make(chan *mismatchPayload, webhookBuffer),
+		done:     make(chan struct{}),
+		tokens:   max(rate, 1),
+		last:     now(),
+	}
+	go w.run()
+	return w
+}
+
+// Notify queues the mismatch of the exchange, unless the rate is exceeded or
+// the queue is full. The alternate body must have been read into
+// x.AlternateBody.
+func (w *webhook) Notify(x *exchange, r *comparisonResult) {
+	if !w.allow() {
+		webhookDropped.Add(1)
+		return
+	}
+	p := &mismatchPayload{
+		RequestID:        r.RequestID,
+		Method:           r.Method,
+		Path:             r.Path,
+		Alternate:        r.Alternate,
+		ProductionStatus: r.ProductionStatus,
+		AlternateStatus:  r.AlternateStatus,
+		ProductionBody:   truncate(decodedBody(x.ProductionBody, productionHeader(x).Get("Content-Encoding")), w.maxBody),
+	}
+	if x.Alternate != nil {
+		p.AlternateBody = truncate(decodedBody(x.AlternateBody, x.Alternate.Header.Get("Content-Encoding")), w.maxBody)
+	}
+	select {
+	case w.payloads <- p:
+	default:
+		webhookDropped.Add(1)
+	}
+}
+
+func (w *webhook) allow() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.now()
+	w.tokens = min(w.tokens+now.Sub(w.last).Seconds()*w.rate, max(w.rate, 1))
+	w.last = now
+	if w.tokens < 1 {
+		return false
+	}
+	w.tokens--
+	return true
+}
+
+// truncate returns at most n bytes of body as a string.
+func truncate(body []byte, n int) string {
+	if len(body) > n {
+		body = body[:n]
+	}
+	return string(body)
+}
+
+// Close posts the queued mismatches.
+func (w *webhook) Close() {
+	close(w.payloads)
+	<-w.done
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+	for p := range w.payloads {
+		if err := w.post(p); err != nil {
+			log.Printf("Failed to post the mismatch of request %s to the webhook: %s", p.RequestID, err)
+		}
+	}
+}
+
+func (w *webhook) post(p *mismatchPayload) error {
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMismatchesArePostedToWebhook(t *testing.T) {
+	production, _ := newBackend(t, `{"name": "production"}`)
+	alternate, _ := newBackend(t, `{"name": "alternate"}`)
+	received := make(chan *mismatchPayload, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := &mismatchPayload{}
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			t.Errorf("Failed to decode the mismatch: %s", err)
+		}
+		received <- payload
+	}))
+	defer hook.Close()
+	h := newTestHandler(t, production, alternate)
+	// The clock stands still, so the bucket is not refilled.
+	now := time.Now()
+	h.Webhook = newWebhook(hook.URL, 2, time.Second, 12, func() time.Time { return now })
+	logs := captureLog(t)
+	dropped := webhookDropped.Value()
+
+	for i := 0; i < 5; i++ {
+		req, id := newRequest("POST", "/orders", nil)
+		serve(h, req)
+		waitComparison(t, logs, id, "Not equal", 1)
+	}
+	h.Webhook.Close()
+	close(received)
+
+	var payloads []*mismatchPayload
+	for p := range received {
+		payloads = append(payloads, p)
+	}
+	if len(payloads) != 2 {
+		t.Fatalf("Expected '%d' posted mismatches, but received '%d'", 2, len(payloads))
+	}
+	expectation := mismatchPayload{
+		RequestID:        payloads[0].RequestID,
+		Method:           "POST",
+		Path:             "/orders",
+		Alternate:        hostOf(alternate),
+		ProductionStatus: 200,
+		AlternateStatus:  200,
+		ProductionBody:   `{"name": "pr`,
+		AlternateBody:    `{"name": "al`,
+	}
+	if *payloads[0] != expectation || expectation.RequestID == "" {
+		t.Errorf("Expected '%+v', but received '%+v'", expectation, *payloads[0])
+	}
+	if n := webhookDropped.Value() - dropped; n != 3 {
+		t.Errorf("Expected '%d' dropped mismatches, but received '%d'", 3, n)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -80,3 +82,118 @@ func TestBothProvidedWithMoreProxies(t *testing.T) {
 		t.Errorf("Expected '%s', but received '%s'", expectation, forwardedHeader)
 	}
 }
+
+func TestRemoteAddrFormats(t *testing.T) {
+	for _, c := range []struct {
+		remoteAddr, xff, forwarded string
+	}{
+		{"192.168.0.1:80", "192.168.0.1", "for=192.168.0.1"},
+		{"[::1]:8080", "::1", `for="[::1]"`},
+		{"[2001:db8::1]:443", "2001:db8::1", `for="[2001:db8::1]"`},
+		{"192.168.0.1", "192.168.0.1", "for=192.168.0.1"},
+		{"[::1]", "::1", `for="[::1]"`},
+		{"::1", "::1", `for="[::1]"`},
+	} {
+		adserverRequest, _ := http.NewRequest("GET", "ad1/test", nil)
+		adserverRequest.RemoteAddr = c.remoteAddr
+		updateForwardedHeaders(adserverRequest)
+		if xffHeader := adserverRequest.Header.Get("X-FORWARDED-FOR"); xffHeader != c.xff {
+			t.Errorf("Expected '%s', but received '%s'", c.xff, xffHeader)
+		}
+		if forwardedHeader := adserverRequest.Header.Get("FORWARDED"); forwardedHeader != c.forwarded {
+			t.Errorf("Expected '%s', but received '%s'", c.forwarded, forwardedHeader)
+		}
+	}
+}
+
+func TestProtoAndHostForwarded(t *testing.T) {
+	production, hits := newBackend(t, "production")
+	alternate, _ := newBackend(t, "alternate")
+	h := newTestHandler(t, production, alternate)
+	setFlag(t, "forward-client-ip", "true")
+	setFlag(t, "forward-proto-host", "true")
+	for _, c := range []struct {
+		listener *httptest.Server
+		proto    string
+	}{
+		{httptest.NewServer(h), "http"},
+		{httptest.NewTLSServer(h), "https"},
+	} {
+		defer c.listener.Close()
+		req, _ := http.NewRequest("GET", c.listener.URL+"/", nil)
+		req.Host = "example.com:8443"
+		resp, err := c.listener.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Failed to request through the %s listener: %s", c.proto, err)
+		}
+		resp.Body.Close()
+		forwarded := waitHit(t, hits)
+		if xfp := forwarded.Header.Get("X-Forwarded-Proto"); xfp != c.proto {
+			t.Errorf("Expected '%s', but received '%s'", c.proto, xfp)
+		}
+		if expectation, xfh := "example.com:8443", forwarded.Header.Get("X-Forwarded-Host"); xfh != expectation {
+			t.Errorf("Expected '%s', but received '%s'", expectation, xfh)
+		}
+		if expectation, header := ";proto="+c.proto+`;host="example.com:8443"`, forwarded.Header.Get("Forwarded"); !strings.HasPrefix(header, "for=127.0.0.1") || !strings.HasSuffix(header, expectation) {
+			t.Errorf("Expected 'for=127.0.0.1%s', but received '%s'", expectation, header)
+		}
+	}
+}
+
+func TestProtoAndHostNotForwardedByDefault(t *testing.T) {
+	adserverRequest, _ := http.NewRequest("GET", "http://example.com/test", nil)
+	adserverRequest.RemoteAddr = "192.168.0.1:80"
+	updateForwardedHeaders(adserverRequest)
+	if xfp := adserverRequest.Header.Get("X-Forwarded-Proto"); xfp != "" {
+		t.Errorf("Expected no X-Forwarded-Proto, but received '%s'", xfp)
+	}
+	if expectation, forwardedHeader := "for=192.168.0.1", adserverRequest.Header.Get("FORWARDED"); forwardedHeader != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, forwardedHeader)
+	}
+}
+
+func TestProtoAndHostOfEarlierProxyAreKept(t *testing.T) {
+	setFlag(t, "forward-proto-host", "true")
+	adserverRequest, _ := http.NewRequest("GET", "http://backend.internal/test", nil)
+	adserverRequest.RemoteAddr = "192.168.0.1:80"
+	adserverRequest.Header.Set("X-Forwarded-Proto", "https")
+	adserverRequest.Header.Set("X-Forwarded-Host", "example.com")
+	updateForwardedHeaders(adserverRequest)
+	if expectation, xfp := "https", adserverRequest.Header.Get("X-Forwarded-Proto"); xfp != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, xfp)
+	}
+	if expectation, xfh := "example.com", adserverRequest.Header.Get("X-Forwarded-Host"); xfh != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, xfh)
+	}
+	if expectation, forwardedHeader := "for=192.168.0.1;proto=http;host=backend.internal", adserverRequest.Header.Get("FORWARDED"); forwardedHeader != expectation {
+		t.Errorf("Expected '%s', but received '%s'", expectation, forwardedHeader)
+	}
+}
+
+func TestUntrustedPeerForwardingHeadersAreReplaced(t *testing.T) {
+	setFlag(t, "trusted-proxies", "10.0.0.0/8,::1")
+	setFlag(t, "forward-proto-host", "true")
+	for _, c := range []struct {
+		remoteAddr, xff, forwarded, xfp string
+	}{
+		{"10.1.2.3:80", "172.20.2.5, 10.1.2.3", "for=172.20.2.5, for=10.1.2.3;proto=http;host=example.com", "https"},
+		{"[::1]:80", "172.20.2.5, ::1", `for=172.20.2.5, for="[::1]";proto=http;host=example.com`, "https"},
+		{"192.168.0.1:80", "192.168.0.1", "for=192.168.0.1;proto=http;host=example.com", "http"},
+	} {
+		adserverRequest, _ := http.NewRequest("GET", "http://example.com/test", nil)
+		adserverRequest.RemoteAddr = c.remoteAddr
+		adserverRequest.Header.Add("X-FORWARDED-FOR", "172.20.2.5")
+		adserverRequest.Header.Add("FORWARDED", "for=172.20.2.5")
+		adserverRequest.Header.Add("X-Forwarded-Proto", "https")
+		updateForwardedHeaders(adserverRequest)
+		if xffHeader := adserverRequest.Header.Get("X-FORWARDED-FOR"); xffHeader != c.xff {
+			t.Errorf("Expected '%s', but received '%s'", c.xff, xffHeader)
+		}
+		if forwardedHeader := adserverRequest.Header.Get("FORWARDED"); forwardedHeader != c.forwarded {
+			t.Errorf("Expected '%s', but received '%s'", c.forwarded, forwardedHeader)
+		}
+		if xfp := adserverRequest.Header.Get("X-Forwarded-Proto"); xfp != c.xfp {
+			t.Errorf("Expected '%s', but received '%s'", c.xfp, xfp)
+		}
+	}
+}